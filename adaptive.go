@@ -0,0 +1,189 @@
+package traefik_ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/limiter"
+)
+
+const (
+	defaultAdaptiveDecrease  = 0.5
+	defaultAdaptiveErrorRate = 0.05
+	defaultAdaptiveInterval  = time.Second
+)
+
+// adaptiveLimit скомпилированный Adaptive, меняет лимит бакета rps по наблюдениям за upstream
+type adaptiveLimit struct {
+	min       int
+	max       int
+	increase  int
+	decrease  float64
+	latency   time.Duration
+	errorRate float64
+	interval  time.Duration
+
+	current       atomic.Int64
+	logged        atomic.Int64 // значение, выведенное в лог последним
+	intervalStart atomic.Int64 // unix nano начала текущего интервала наблюдений
+	total         atomic.Int64
+	errors        atomic.Int64
+	latencySum    atomic.Int64 // nano
+
+	// бакет rps, лимит которого подстраивается: общий или по bucketkey
+	limiter *limiter.Limiter
+	keyed   *limiter.Keyed
+}
+
+// compile проверяет и компилирует настройки, start - начальный лимит (limit), 0 - начать с max
+func (a *Adaptive) compile(start int) (*adaptiveLimit, error) {
+	al := &adaptiveLimit{
+		min:       a.Min,
+		max:       a.Max,
+		increase:  a.Increase,
+		decrease:  a.Decrease,
+		errorRate: a.ErrorRate,
+		interval:  defaultAdaptiveInterval,
+	}
+
+	if al.min == 0 {
+		al.min = 1
+	}
+
+	if al.min < 0 || al.max < al.min {
+		return nil, fmt.Errorf("min and max must satisfy 0 < min <= max, got min %d, max %d", al.min, al.max)
+	}
+
+	if start == 0 {
+		start = al.max
+	}
+
+	if start < al.min || start > al.max {
+		return nil, fmt.Errorf("limit %d is out of [%d, %d]", start, al.min, al.max)
+	}
+
+	if al.increase == 0 {
+		al.increase = al.max / 20
+		if al.increase < 1 {
+			al.increase = 1
+		}
+	}
+
+	if al.increase < 0 {
+		return nil, fmt.Errorf("increase must be greater than 0")
+	}
+
+	if al.decrease == 0 {
+		al.decrease = defaultAdaptiveDecrease
+	}
+
+	if al.decrease <= 0 || al.decrease >= 1 {
+		return nil, fmt.Errorf("decrease must be in (0, 1), got %v", al.decrease)
+	}
+
+	if al.errorRate == 0 {
+		al.errorRate = defaultAdaptiveErrorRate
+	}
+
+	if al.errorRate < 0 || al.errorRate > 1 {
+		return nil, fmt.Errorf("errorrate must be in (0, 1], got %v", al.errorRate)
+	}
+
+	if a.Latency != "" {
+		latency, err := time.ParseDuration(a.Latency)
+		if err != nil || latency <= 0 {
+			return nil, fmt.Errorf("invalid latency '%s'", a.Latency)
+		}
+
+		al.latency = latency
+	}
+
+	if a.Interval != "" {
+		interval, err := time.ParseDuration(a.Interval)
+		if err != nil || interval < 100*time.Millisecond {
+			return nil, fmt.Errorf("invalid interval '%s', must be at least 100ms", a.Interval)
+		}
+
+		al.interval = interval
+	}
+
+	al.current.Store(int64(start))
+	al.logged.Store(int64(start))
+	al.intervalStart.Store(time.Now().UnixNano())
+
+	return al, nil
+}
+
+func (al *adaptiveLimit) Current() int {
+	return int(al.current.Load())
+}
+
+// observe учитывает ответ upstream и раз в interval пересчитывает лимит
+func (al *adaptiveLimit) observe(latency time.Duration, status int, now time.Time) {
+	al.total.Add(1)
+	al.latencySum.Add(int64(latency))
+
+	if status >= http.StatusInternalServerError {
+		al.errors.Add(1)
+	}
+
+	start := al.intervalStart.Load()
+	if now.UnixNano()-start < int64(al.interval) || !al.intervalStart.CompareAndSwap(start, now.UnixNano()) {
+		return
+	}
+
+	// пересчёт выполняет только выигравший CAS запрос
+	al.evaluate(al.total.Swap(0), al.errors.Swap(0), time.Duration(al.latencySum.Swap(0)))
+}
+
+// evaluate аддитивно увеличивает лимит, пока upstream здоров, и мультипликативно уменьшает при деградации
+func (al *adaptiveLimit) evaluate(total, errors int64, latencySum time.Duration) {
+	if total == 0 {
+		return
+	}
+
+	current := int(al.current.Load())
+
+	degraded := float64(errors)/float64(total) > al.errorRate ||
+		(al.latency > 0 && latencySum/time.Duration(total) > al.latency)
+
+	next := current + al.increase
+	if degraded {
+		next = int(float64(current) * al.decrease)
+	}
+
+	if next < al.min {
+		next = al.min
+	}
+
+	if next > al.max {
+		next = al.max
+	}
+
+	if next == current {
+		return
+	}
+
+	al.current.Store(int64(next))
+
+	if al.limiter != nil {
+		al.limiter.SetLimit(next)
+	}
+
+	if al.keyed != nil {
+		al.keyed.SetLimit(next)
+	}
+}
+
+// changedSinceLog сообщает, что лимит изменился с прошлого вызова
+func (al *adaptiveLimit) changedSinceLog() bool {
+	current := al.current.Load()
+	return al.logged.Swap(current) != current
+}
+
+func (al *adaptiveLimit) String() string {
+	return "adaptive: " + strconv.Itoa(al.Current()) + " [" + strconv.Itoa(al.min) + ", " + strconv.Itoa(al.max) + "]"
+}
@@ -0,0 +1,141 @@
+package traefik_ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdaptive_compile(t *testing.T) {
+	tests := []struct {
+		name     string
+		adaptive Adaptive
+		start    int
+		wantErr  string
+	}{
+		{name: "defaults", adaptive: Adaptive{Max: 100}},
+		{name: "full", adaptive: Adaptive{Min: 10, Max: 100, Increase: 5, Decrease: 0.7, Latency: "300ms", ErrorRate: 0.1, Interval: "5s"}, start: 50},
+		{name: "no max", adaptive: Adaptive{Min: 10}, wantErr: "min and max"},
+		{name: "start out of range", adaptive: Adaptive{Min: 10, Max: 100}, start: 500, wantErr: "limit 500 is out of [10, 100]"},
+		{name: "decrease too big", adaptive: Adaptive{Max: 100, Decrease: 1}, wantErr: "decrease must be in (0, 1)"},
+		{name: "invalid latency", adaptive: Adaptive{Max: 100, Latency: "fast"}, wantErr: "invalid latency"},
+		{name: "interval too short", adaptive: Adaptive{Max: 100, Interval: "10ms"}, wantErr: "invalid interval"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.adaptive.compile(tt.start)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("compile() unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("compile() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimit_evaluate(t *testing.T) {
+	al, err := (&Adaptive{Min: 10, Max: 100, Increase: 10, Latency: "100ms"}).compile(50)
+	if err != nil {
+		t.Fatalf("compile() error: %v", err)
+	}
+
+	steps := []struct {
+		name       string
+		total      int64
+		errors     int64
+		latencySum time.Duration
+		want       int
+	}{
+		{name: "healthy increases", total: 100, latencySum: 100 * 10 * time.Millisecond, want: 60},
+		{name: "no traffic keeps", total: 0, want: 60},
+		{name: "errors halve", total: 100, errors: 10, latencySum: 100 * 10 * time.Millisecond, want: 30},
+		{name: "slow halves", total: 10, latencySum: 10 * 200 * time.Millisecond, want: 15},
+		{name: "min bound", total: 10, errors: 10, want: 10},
+	}
+
+	for _, step := range steps {
+		al.evaluate(step.total, step.errors, step.latencySum)
+
+		if got := al.Current(); got != step.want {
+			t.Fatalf("%s: Current() = %d, want %d", step.name, got, step.want)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		al.evaluate(1, 0, 0)
+	}
+
+	if got := al.Current(); got != 100 {
+		t.Errorf("Current() = %d, want max 100", got)
+	}
+}
+
+func TestRateLimiter_Adaptive(t *testing.T) {
+	rl := &RateLimiter{
+		rules: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+
+	rl.hotReloadLimits(&Limits{
+		Limits: []Limit{
+			{
+				Limit:    100,
+				Adaptive: &Adaptive{Min: 10, Max: 200, Interval: "100ms"},
+				Rules:    []Rule{{URLPathPattern: "/api/**"}},
+			},
+		},
+	})
+
+	var lim *LimitImpl
+	rl.rules.Load().(*sync.Map).Range(func(_, v any) bool {
+		lim = v.(*LimitImpl)
+		return false
+	})
+
+	failing := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusBadGateway)
+	})
+
+	serve := func() {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/api/payments", http.NoBody)
+
+		d := rl.decide(req, nil)
+		if !d.observes() {
+			t.Fatal("decision should observe upstream for adaptive limit")
+		}
+
+		d.serveObserved(failing, httptest.NewRecorder(), req)
+	}
+
+	serve()
+	time.Sleep(150 * time.Millisecond)
+	serve()
+
+	if got := lim.Limit(); got != 50 {
+		t.Errorf("Limit() = %d, want 50 after upstream errors", got)
+	}
+
+	if got := lim.limiter.Limit(); got != 50 {
+		t.Errorf("limiter.Limit() = %d, want 50", got)
+	}
+
+	if !strings.Contains(lim.String(), "adaptive: 50 [10, 200]") {
+		t.Errorf("String() = %q, want effective value", lim.String())
+	}
+
+	if !lim.adaptive.changedSinceLog() || lim.adaptive.changedSinceLog() {
+		t.Error("changedSinceLog() should report the change exactly once")
+	}
+}
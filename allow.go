@@ -2,41 +2,280 @@ package traefik_ratelimit
 
 import (
 	"net/http"
+	"net/netip"
+	"strconv"
 	"sync"
+	"time"
 
-	"github.com/wbpaygate/traefik-ratelimit/internal/limiter"
+	"github.com/wbpaygate/traefik-ratelimit/internal/bypass"
+	"github.com/wbpaygate/traefik-ratelimit/internal/clientip"
+	"github.com/wbpaygate/traefik-ratelimit/internal/jwt"
 	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
 )
 
+// requestInfo данные запроса, нужные правилам.
+// Дорогие значения (адрес клиента) вычисляются лениво и один раз на запрос
+type requestInfo struct {
+	req      *http.Request
+	urlPath  []byte
+	resolver *clientip.Resolver
+	jwt      *jwtSettings
+
+	ip         netip.Addr
+	ipResolved bool
+
+	token       *jwt.Token
+	tokenParsed bool
+
+	debited []debit // бакеты, из которых уже списана стоимость запроса
+}
+
+// debit списание из бакета лимита, хранится для возврата при отказе другого лимита
+type debit struct {
+	limit *LimitImpl
+	rule  *RuleImpl
+	n     int
+	at    time.Time
+}
+
+func (ri *requestInfo) isDebited(li *LimitImpl) bool {
+	for _, d := range ri.debited {
+		if d.limit == li {
+			return true
+		}
+	}
+
+	return false
+}
+
+// refund возвращает всё, что списано для запроса, начиная со списания from
+func (ri *requestInfo) refund(from int) {
+	for _, d := range ri.debited[from:] {
+		d.limit.giveBack(d.rule, ri, d.n, d.at)
+	}
+
+	ri.debited = ri.debited[:from]
+}
+
+func (ri *requestInfo) clientIP() netip.Addr {
+	if !ri.ipResolved {
+		ri.ip = ri.resolver.ClientIP(ri.req)
+		ri.ipResolved = true
+	}
+
+	return ri.ip
+}
+
+// jwtToken разбирает токен один раз на запрос, сколько бы правил его ни использовали
+func (ri *requestInfo) jwtToken() *jwt.Token {
+	if !ri.tokenParsed {
+		if ri.jwt != nil {
+			ri.token = ri.jwt.token(ri.req)
+		}
+
+		ri.tokenParsed = true
+	}
+
+	return ri.token
+}
+
+// match проверяет все условия правила, кроме лимита
+func (ri *requestInfo) match(rule *RuleImpl) bool {
+	if !rule.matchPath(ri.urlPath) {
+		return false
+	}
+
+	if rule.Header != nil && !rule.Header.Match(ri.req.Header) {
+		return false
+	}
+
+	if rule.SourceCIDRs != nil && !rule.SourceCIDRs.Contains(ri.clientIP()) {
+		return false
+	}
+
+	if rule.Claims != nil && !rule.Claims.Match(ri.jwtToken()) {
+		return false
+	}
+
+	return true
+}
+
+// accessRules скомпилированные списки allow и deny
+type accessRules struct {
+	allow      []RuleImpl
+	deny       []RuleImpl
+	denyStatus int
+}
+
+// decision результат проверки запроса
+type decision struct {
+	allow  bool
+	status int       // код ответа, если запрос отклонён
+	rate   rateState // окно с наименьшим остатком среди применённых лимитов
+	// retryAfter время до пробного запроса разомкнутого circuit breaker
+	retryAfter time.Duration
+	// debited лимиты, пропустившие запрос, для наблюдения за ответом upstream
+	debited []debit
+}
+
+// writeHeaders добавляет в ответ заголовки X-RateLimit-*, если к запросу применялся лимит
+func (d *decision) writeHeaders(h http.Header) {
+	if d.rate.limit <= 0 {
+		return
+	}
+
+	// время до сброса округляется вверх, чтобы клиент не повторил запрос раньше
+	reset := strconv.FormatInt(int64((d.rate.reset+time.Second-1)/time.Second), 10)
+
+	h.Set("X-RateLimit-Id", d.rate.id)
+	h.Set("X-RateLimit-Limit", strconv.Itoa(d.rate.limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(d.rate.remaining))
+	h.Set("X-RateLimit-Reset", reset)
+
+	if !d.allow {
+		h.Set("Retry-After", reset)
+	}
+}
+
 func (rl *RateLimiter) Allow(req *http.Request) bool {
+	return rl.decide(req, nil).allow
+}
+
+// decide проверяет запрос, exempt - claims токена обхода лимитов (может быть nil).
+// Токен освобождает только от лимитов, allow и deny проверяются всегда
+func (rl *RateLimiter) decide(req *http.Request, exempt *bypass.Claims) decision {
 	rules, ok := rl.rules.Load().(*sync.Map)
 	if !ok {
 		logger.Error(req.Context(), "rules: cannot type assert *sync.Map")
-		return true
+		return decision{allow: true}
+	}
+
+	resolver, _ := rl.clientIP.Load().(*clientip.Resolver)
+	jwtCfg, _ := rl.jwt.Load().(*jwtSettings)
+
+	ri := &requestInfo{
+		req:      req,
+		urlPath:  []byte(req.URL.Path),
+		resolver: resolver,
+		jwt:      jwtCfg,
+	}
+
+	if access, okAccess := rl.access.Load().(*accessRules); okAccess {
+		for i := range access.deny {
+			if ri.match(&access.deny[i]) {
+				rl.counters().denied.Add(1)
+				if logger.DebugEnabled(req.Context()) {
+					logger.Debug(req.Context(), "request denied by rule "+access.deny[i].String())
+				}
+
+				return decision{allow: false, status: access.denyStatus}
+			}
+		}
+
+		for i := range access.allow {
+			if ri.match(&access.allow[i]) {
+				rl.counters().allowlisted.Add(1)
+				return decision{allow: true}
+			}
+		}
+	}
+
+	if exempt != nil && exempt.ExemptsAll() {
+		return decision{allow: true}
 	}
 
-	var allow = true
+	var status int
+	var rate rateState
+	var retryAfter time.Duration
+
+	matchFirst := rl.matchFirst.Load()
+
+	var first *LimitImpl
+	var firstRule RuleImpl
 
 	rules.Range(func(k, v any) bool {
 		if rule, okRule := k.(RuleImpl); okRule {
-			if lim, okLim := v.(*limiter.Limiter); okLim {
-				if !rule.URLPathPattern.Match([]byte(req.URL.Path)) {
+			if lim, okLim := v.(*LimitImpl); okLim {
+				if !ri.match(&rule) {
 					return true // это return из функции обхода мапы
 				}
 
-				if rule.Header != nil {
-					if req.Header.Get(rule.Header.key) != rule.Header.val {
-						return true // это return из функции обхода мапы
+				// порядок обхода мапы случайный, поэтому первый в конфигурации лимит выбирается по order
+				if matchFirst {
+					if first == nil || lim.order < first.order {
+						first, firstRule = lim, rule
 					}
+
+					return true // это return из функции обхода мапы
 				}
 
-				allow = lim.Allow()
-				return allow // это return из функции обхода мапы
+				status, retryAfter = rl.allowRule(&rule, lim, ri, exempt, &rate)
+
+				return status == 0 // это return из функции обхода мапы
 			}
 		}
 
 		return true
 	})
 
-	return allow
+	if first != nil {
+		status, retryAfter = rl.allowRule(&firstRule, first, ri, exempt, &rate)
+	}
+
+	if status != 0 {
+		// разрешения, списанные лимитами, пропустившими запрос, возвращаются
+		ri.refund(0)
+
+		if status == http.StatusServiceUnavailable {
+			rl.counters().circuitOpen.Add(1)
+		} else {
+			rl.counters().limited.Add(1)
+		}
+
+		return decision{allow: false, status: status, rate: rate, retryAfter: retryAfter}
+	}
+
+	return decision{allow: true, rate: rate, debited: ri.debited}
+}
+
+// allowRule проверяет circuit breaker и лимит совпавшего правила и обновляет rate окном с наименьшим остатком.
+// Возвращает код ответа, если запрос отклонён, иначе 0, и для 503 время до пробного запроса
+func (rl *RateLimiter) allowRule(rule *RuleImpl, lim *LimitImpl, ri *requestInfo, exempt *bypass.Claims, rate *rateState) (int, time.Duration) {
+	if exempt != nil && exempt.Exempts(rule.selector()) {
+		return 0, 0
+	}
+
+	if ok, wait := lim.breakerAllow(ri.req.Context(), time.Now()); !ok {
+		if logger.DebugEnabled(ri.req.Context()) {
+			logger.Debug(ri.req.Context(), "request rejected by open circuit breaker of rule "+rule.String(), rule.params(ri.urlPath)...)
+		}
+
+		return http.StatusServiceUnavailable, wait
+	}
+
+	allow, state := lim.allow(rule, ri)
+
+	if state.limit > 0 && (!allow || state.tighter(*rate)) {
+		*rate = state
+	}
+
+	if !allow && logger.DebugEnabled(ri.req.Context()) {
+		fields := rule.params(ri.urlPath)
+		if ip := ri.clientIP(); ip.IsValid() {
+			fields = append(fields, "ip="+ip.String())
+		}
+
+		if lim.tiers != nil {
+			fields = append(fields, "tier="+lim.tiers.tier(ri))
+		}
+
+		logger.Debug(ri.req.Context(), "request rejected by rule "+rule.String(), fields...)
+	}
+
+	if !allow {
+		rl.counters().limitedBy(state.id)
+		return http.StatusTooManyRequests, 0
+	}
+
+	return 0, 0
 }
@@ -0,0 +1,488 @@
+package traefik_ratelimit
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeader_Match(t *testing.T) {
+	tests := []struct {
+		name          string
+		key           string
+		val           string
+		caseSensitive bool
+		header        http.Header
+		want          bool
+	}{
+		{
+			name:   "insensitive:exact",
+			key:    "X-Client",
+			val:    "mobile",
+			header: http.Header{"X-Client": {"mobile"}},
+			want:   true,
+		},
+		{
+			name:   "insensitive:different case",
+			key:    "x-client",
+			val:    "Mobile",
+			header: http.Header{"X-Client": {"MOBILE"}},
+			want:   true,
+		},
+		{
+			name:   "insensitive:other value",
+			key:    "X-Client",
+			val:    "mobile",
+			header: http.Header{"X-Client": {"web"}},
+			want:   false,
+		},
+		{
+			name:   "insensitive:no header",
+			key:    "X-Client",
+			val:    "mobile",
+			header: http.Header{},
+			want:   false,
+		},
+		{
+			name:          "sensitive:exact",
+			key:           "X-Client",
+			val:           "Mobile",
+			caseSensitive: true,
+			header:        http.Header{"X-Client": {"Mobile"}},
+			want:          true,
+		},
+		{
+			name:          "sensitive:different case",
+			key:           "X-Client",
+			val:           "Mobile",
+			caseSensitive: true,
+			header:        http.Header{"X-Client": {"mobile"}},
+			want:          false,
+		},
+		{
+			name:   "comma separated:entry matches",
+			key:    "Accept-Encoding",
+			val:    "GZIP",
+			header: http.Header{"Accept-Encoding": {"deflate, gzip ,br"}},
+			want:   true,
+		},
+		{
+			name:          "comma separated:sensitive entry mismatch",
+			key:           "Accept-Encoding",
+			val:           "GZIP",
+			caseSensitive: true,
+			header:        http.Header{"Accept-Encoding": {"deflate, gzip"}},
+			want:          false,
+		},
+		{
+			name:   "comma separated:no partial entry match",
+			key:    "Accept-Encoding",
+			val:    "gz",
+			header: http.Header{"Accept-Encoding": {"deflate, gzip"}},
+			want:   false,
+		},
+		{
+			name:   "comma separated:value with comma matches whole",
+			key:    "X-Tags",
+			val:    "a, b",
+			header: http.Header{"X-Tags": {"A, B"}},
+			want:   true,
+		},
+		{
+			name:   "multiple header lines",
+			key:    "X-Client",
+			val:    "mobile",
+			header: http.Header{"X-Client": {"web", "Mobile"}},
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHeader(tt.key, tt.val, tt.caseSensitive)
+
+			if got := h.Match(tt.header); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeader_String(t *testing.T) {
+	// значение выводится как в конфигурации, регистр учитывается только при сравнении
+	if got := newHeader("x-env", " Prod ", false).String(); got != "X-Env: Prod" {
+		t.Errorf("String() = %q, want %q", got, "X-Env: Prod")
+	}
+
+	if got := newHeader("x-env", "Prod", true).String(); got != "X-Env: Prod (case sensitive)" {
+		t.Errorf("String() = %q, want %q", got, "X-Env: Prod (case sensitive)")
+	}
+}
+
+func TestRateLimiter_Allow_HeaderCase(t *testing.T) {
+	tests := []struct {
+		name          string
+		caseSensitive bool
+		headerVal     string
+		wantLimited   bool
+	}{
+		{name: "insensitive by default", headerVal: "TEST", wantLimited: true},
+		{name: "sensitive mismatch", caseSensitive: true, headerVal: "TEST", wantLimited: false},
+		{name: "sensitive match", caseSensitive: true, headerVal: "Test", wantLimited: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := &RateLimiter{
+				rules: atomic.Value{},
+			}
+
+			rl.rules.Store(&sync.Map{})
+
+			// лимит меньше количества окон, значит в текущем окне нет ни одного разрешения
+			rl.hotReloadLimits(&Limits{
+				Limits: []Limit{
+					{
+						Limit: 1,
+						Rules: []Rule{
+							{URLPathPattern: "/api", HeaderKey: "x-user", HeaderVal: "Test", CaseSensitive: tt.caseSensitive},
+						},
+					},
+				},
+			})
+
+			req, err := http.NewRequest(http.MethodGet, "http://localhost/api", http.NoBody)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			req.Header.Set("X-User", tt.headerVal)
+
+			if limited := !rl.Allow(req); limited != tt.wantLimited {
+				t.Errorf("limited = %v, want %v", limited, tt.wantLimited)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Allow_BucketKey(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{name: "pattern param", rule: Rule{URLPathPattern: "/merchants/{merchantId}/payments"}},
+		{name: "regex group", rule: Rule{URLPathRegex: `^/merchants/(?P<merchantId>[0-9]+)/payments$`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := &RateLimiter{
+				rules: atomic.Value{},
+			}
+
+			rl.rules.Store(&sync.Map{})
+
+			rl.hotReloadLimits(&Limits{
+				Limits: []Limit{
+					{
+						Limit:     1,
+						BucketKey: "param:merchantId",
+						Rules:     []Rule{tt.rule},
+					},
+				},
+			})
+
+			allow := func(path string) bool {
+				req, err := http.NewRequest(http.MethodGet, "http://localhost"+path, http.NoBody)
+				if err != nil {
+					t.Fatalf("failed to create request: %v", err)
+				}
+
+				return rl.Allow(req)
+			}
+
+			if !allow("/merchants/1/payments") {
+				t.Error("first request of merchant 1 should be allowed")
+			}
+
+			if allow("/merchants/1/payments") {
+				t.Error("second request of merchant 1 should be limited")
+			}
+
+			if !allow("/merchants/2/payments") {
+				t.Error("first request of merchant 2 should be allowed")
+			}
+
+			if !allow("/merchants/1/refunds") {
+				t.Error("request not matching the rule should be allowed")
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Allow_ClientIP(t *testing.T) {
+	rl := &RateLimiter{
+		rules: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+
+	rl.hotReloadLimits(&Limits{
+		ClientIP: &ClientIP{TrustedProxies: []string{"10.0.0.0/8"}},
+		Limits: []Limit{
+			{
+				Limit: 1,
+				Rules: []Rule{{SourceCIDRs: []string{"192.168.0.0/16"}}},
+			},
+			{
+				Limit:     1,
+				BucketKey: "ip",
+				Rules:     []Rule{{URLPathPattern: "/per-ip"}},
+			},
+		},
+	})
+
+	allow := func(path, remoteAddr, xff string) bool {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost"+path, http.NoBody)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		req.RemoteAddr = remoteAddr
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+
+		return rl.Allow(req)
+	}
+
+	t.Run("source cidrs", func(t *testing.T) {
+		// лимит меньше количества окон, значит в текущем окне нет ни одного разрешения
+		if allow("/any", "192.168.1.1:1000", "") {
+			t.Error("request from limited subnet should be limited")
+		}
+
+		if allow("/any", "10.0.0.1:1000", "192.168.1.1") {
+			t.Error("request forwarded by trusted proxy from limited subnet should be limited")
+		}
+
+		if !allow("/any", "172.16.0.1:1000", "192.168.1.1") {
+			t.Error("spoofed X-Forwarded-For from untrusted remote should be ignored")
+		}
+	})
+
+	t.Run("per ip buckets", func(t *testing.T) {
+		if !allow("/per-ip", "10.0.0.1:1000", "1.1.1.1") {
+			t.Error("first request of client 1.1.1.1 should be allowed")
+		}
+
+		if allow("/per-ip", "10.0.0.2:1000", "1.1.1.1") {
+			t.Error("second request of client 1.1.1.1 should be limited")
+		}
+
+		if !allow("/per-ip", "10.0.0.1:1000", "2.2.2.2") {
+			t.Error("first request of client 2.2.2.2 should be allowed")
+		}
+	})
+}
+
+func TestRateLimiter_decide_AccessLists(t *testing.T) {
+	tests := []struct {
+		name       string
+		denyStatus int
+		path       string
+		remoteAddr string
+		header     http.Header
+		wantAllow  bool
+		wantStatus int
+	}{
+		{
+			name:       "denied by path with default status",
+			path:       "/api/admin",
+			remoteAddr: "1.1.1.1:1000",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "denied with configured status",
+			denyStatus: http.StatusTooManyRequests,
+			path:       "/api/admin",
+			remoteAddr: "1.1.1.1:1000",
+			wantStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:       "deny has priority over allow",
+			path:       "/api/admin",
+			remoteAddr: "10.0.0.1:1000",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "allowlisted ip bypasses limit",
+			path:       "/api/users",
+			remoteAddr: "10.0.0.1:1000",
+			wantAllow:  true,
+		},
+		{
+			name:       "allowlisted header bypasses limit",
+			path:       "/api/users",
+			remoteAddr: "1.1.1.1:1000",
+			header:     http.Header{"X-Health-Check": {"true"}},
+			wantAllow:  true,
+		},
+		{
+			name:       "not listed request is limited",
+			path:       "/api/users",
+			remoteAddr: "1.1.1.1:1000",
+			wantStatus: http.StatusTooManyRequests,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := &RateLimiter{
+				rules: atomic.Value{},
+			}
+
+			rl.rules.Store(&sync.Map{})
+
+			// лимит меньше количества окон, значит в текущем окне нет ни одного разрешения
+			rl.hotReloadLimits(&Limits{
+				Limits: []Limit{
+					{Limit: 1, Rules: []Rule{{URLPathPattern: "/api/**"}}},
+				},
+				Allow: []Rule{
+					{SourceCIDRs: []string{"10.0.0.0/8"}},
+					{HeaderKey: "X-Health-Check", HeaderVal: "true"},
+				},
+				Deny:       []Rule{{URLPathPattern: "/api/admin"}},
+				DenyStatus: tt.denyStatus,
+			})
+
+			req, err := http.NewRequest(http.MethodGet, "http://localhost"+tt.path, http.NoBody)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != nil {
+				req.Header = tt.header
+			}
+
+			d := rl.decide(req, nil)
+			if d.allow != tt.wantAllow {
+				t.Fatalf("allow = %v, want %v", d.allow, tt.wantAllow)
+			}
+
+			if !d.allow && d.status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", d.status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_decide_AccessStats(t *testing.T) {
+	rl := &RateLimiter{
+		rules: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+
+	rl.hotReloadLimits(&Limits{
+		Limits: []Limit{{Limit: 1, Rules: []Rule{{URLPathPattern: "/limited"}}}},
+		Allow:  []Rule{{URLPathPattern: "/health"}},
+		Deny:   []Rule{{URLPathPattern: "/admin"}},
+	})
+
+	for _, path := range []string{"/health", "/health", "/admin", "/limited", "/other"} {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost"+path, http.NoBody)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		rl.decide(req, nil)
+	}
+
+	if got := rl.stats.allowlisted.Load(); got != 2 {
+		t.Errorf("allowlisted = %d, want 2", got)
+	}
+
+	if got := rl.stats.denied.Load(); got != 1 {
+		t.Errorf("denied = %d, want 1", got)
+	}
+
+	if got := rl.stats.limited.Load(); got != 1 {
+		t.Errorf("limited = %d, want 1", got)
+	}
+}
+
+func TestRateLimiter_decide_MatchPolicy(t *testing.T) {
+	newRateLimiter := func(policy string) *RateLimiter {
+		rl := &RateLimiter{
+			rules: atomic.Value{},
+		}
+
+		rl.rules.Store(&sync.Map{})
+
+		rl.hotReloadLimits(&Limits{
+			MatchPolicy: policy,
+			Limits: []Limit{
+				{PerMinute: 2, Rules: []Rule{{URLPathPattern: "/api/users"}}},
+				{PerMinute: 1, Rules: []Rule{{URLPathPattern: "/api/**"}}},
+			},
+		})
+
+		return rl
+	}
+
+	allow := func(rl *RateLimiter, path string) bool {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost"+path, http.NoBody)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		return rl.Allow(req)
+	}
+
+	t.Run("first", func(t *testing.T) {
+		rl := newRateLimiter(matchPolicyFirst)
+
+		if !allow(rl, "/api/users") || !allow(rl, "/api/users") {
+			t.Fatal("only the first matching limit should be consulted")
+		}
+
+		if allow(rl, "/api/users") {
+			t.Error("third request should be rejected by the first limit")
+		}
+
+		if !allow(rl, "/api/orders") {
+			t.Error("catch-all limit should not be debited by /api/users")
+		}
+	})
+
+	t.Run("all", func(t *testing.T) {
+		rl := newRateLimiter(matchPolicyAll)
+
+		if !allow(rl, "/api/users") {
+			t.Fatal("first request should pass both limits")
+		}
+
+		if allow(rl, "/api/users") {
+			t.Fatal("second request should be rejected by the catch-all limit")
+		}
+
+		var endpoint *LimitImpl
+		rl.rules.Load().(*sync.Map).Range(func(_, v any) bool {
+			if lim := v.(*LimitImpl); lim.order == 0 {
+				endpoint = lim
+			}
+
+			return true
+		})
+
+		// разрешение, списанное лимитом эндпоинта для отклонённого запроса, возвращено
+		if remaining, ok := endpoint.windows[0].Take("", 1, time.Now()); !ok || remaining != 0 {
+			t.Errorf("endpoint Take() = %d, %v, want 0, true", remaining, ok)
+		}
+	})
+}
@@ -0,0 +1,241 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
+)
+
+const (
+	breakerClosed int32 = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+const (
+	defaultBreakerMinRequests = 20
+	defaultBreakerWindow      = 10 * time.Second
+	defaultBreakerOpenTimeout = 30 * time.Second
+)
+
+var breakerStateNames = map[int32]string{
+	breakerClosed:   "closed",
+	breakerOpen:     "open",
+	breakerHalfOpen: "half-open",
+}
+
+// circuitBreaker скомпилированный Breaker.
+// closed - запросы пропускаются, ответы upstream считаются;
+// open - запросы отклоняются с 503 до истечения openTimeout;
+// half-open - пропускаются halfOpenRequests пробных запросов, все успешные замыкают breaker, любая ошибка размыкает снова
+type circuitBreaker struct {
+	id                  string // id лимита для лога
+	errorRate           float64
+	minRequests         int64
+	consecutiveFailures int64
+	window              time.Duration
+	openTimeout         time.Duration
+	halfOpenRequests    int64
+
+	state atomic.Int32
+
+	mu       sync.Mutex // смена состояния и half-open
+	openedAt time.Time  // время перехода в open или half-open
+
+	windowStart atomic.Int64 // unix nano начала окна подсчёта ошибок
+	total       atomic.Int64 // ответы в текущем окне
+	errors      atomic.Int64
+	consecutive atomic.Int64 // ошибки подряд
+	probes      atomic.Int64 // пропущено пробных запросов в half-open
+	succeeded   atomic.Int64 // успешных пробных запросов
+
+	logged atomic.Int32 // состояние, выведенное в лог рабочих лимитов последним
+}
+
+// compile проверяет и компилирует настройки breaker лимита id
+func (b *Breaker) compile(id string) (*circuitBreaker, error) {
+	cb := &circuitBreaker{
+		id:                  id,
+		errorRate:           b.ErrorRate,
+		minRequests:         int64(b.MinRequests),
+		consecutiveFailures: int64(b.ConsecutiveFailures),
+		window:              defaultBreakerWindow,
+		openTimeout:         defaultBreakerOpenTimeout,
+		halfOpenRequests:    int64(b.HalfOpenRequests),
+	}
+
+	if cb.errorRate == 0 && cb.consecutiveFailures == 0 {
+		return nil, fmt.Errorf("errorrate or consecutivefailures is required")
+	}
+
+	if cb.errorRate < 0 || cb.errorRate > 1 {
+		return nil, fmt.Errorf("errorrate must be in (0, 1], got %v", cb.errorRate)
+	}
+
+	if cb.consecutiveFailures < 0 || cb.minRequests < 0 || cb.halfOpenRequests < 0 {
+		return nil, fmt.Errorf("consecutivefailures, minrequests and halfopenrequests must not be negative")
+	}
+
+	if cb.minRequests == 0 {
+		cb.minRequests = defaultBreakerMinRequests
+	}
+
+	if cb.halfOpenRequests == 0 {
+		cb.halfOpenRequests = 1
+	}
+
+	if b.Window != "" {
+		window, err := time.ParseDuration(b.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid window '%s'", b.Window)
+		}
+
+		cb.window = window
+	}
+
+	if b.OpenTimeout != "" {
+		openTimeout, err := time.ParseDuration(b.OpenTimeout)
+		if err != nil || openTimeout <= 0 {
+			return nil, fmt.Errorf("invalid opentimeout '%s'", b.OpenTimeout)
+		}
+
+		cb.openTimeout = openTimeout
+	}
+
+	cb.windowStart.Store(time.Now().UnixNano())
+
+	return cb, nil
+}
+
+// allow сообщает, можно ли пропустить запрос, и время до следующей проверки upstream, если нельзя
+func (cb *circuitBreaker) allow(ctx context.Context, now time.Time) (bool, time.Duration) {
+	if cb.state.Load() == breakerClosed {
+		return true, 0
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state.Load() {
+	case breakerClosed:
+		return true, 0
+
+	case breakerOpen:
+		if wait := cb.openedAt.Add(cb.openTimeout).Sub(now); wait > 0 {
+			return false, wait
+		}
+
+		cb.setState(ctx, breakerHalfOpen, now)
+
+	case breakerHalfOpen:
+		// пробные запросы могли быть отклонены лимитом и не дойти до upstream,
+		// поэтому через openTimeout без результата пробы начинаются заново
+		if now.Sub(cb.openedAt) > cb.openTimeout {
+			cb.setState(ctx, breakerHalfOpen, now)
+		}
+	}
+
+	if cb.probes.Add(1) <= cb.halfOpenRequests {
+		return true, 0
+	}
+
+	return false, cb.openedAt.Add(cb.openTimeout).Sub(now)
+}
+
+// observe учитывает ответ upstream на пропущенный запрос
+func (cb *circuitBreaker) observe(ctx context.Context, status int, now time.Time) {
+	failed := status >= http.StatusInternalServerError
+
+	switch cb.state.Load() {
+	case breakerHalfOpen:
+		if failed {
+			cb.transition(ctx, breakerHalfOpen, breakerOpen, now)
+			return
+		}
+
+		if cb.succeeded.Add(1) >= cb.halfOpenRequests {
+			cb.transition(ctx, breakerHalfOpen, breakerClosed, now)
+		}
+
+		return
+
+	case breakerOpen:
+		return // ответ на запрос, пропущенный до размыкания
+	}
+
+	if !failed {
+		cb.consecutive.Store(0)
+	} else if cb.consecutiveFailures > 0 && cb.consecutive.Add(1) >= cb.consecutiveFailures {
+		cb.transition(ctx, breakerClosed, breakerOpen, now)
+		return
+	}
+
+	if start := cb.windowStart.Load(); now.UnixNano()-start >= int64(cb.window) && cb.windowStart.CompareAndSwap(start, now.UnixNano()) {
+		cb.total.Store(0)
+		cb.errors.Store(0)
+	}
+
+	total := cb.total.Add(1)
+
+	errors := cb.errors.Load()
+	if failed {
+		errors = cb.errors.Add(1)
+	}
+
+	if cb.errorRate > 0 && total >= cb.minRequests && float64(errors)/float64(total) >= cb.errorRate {
+		cb.transition(ctx, breakerClosed, breakerOpen, now)
+	}
+}
+
+// transition меняет состояние, если текущее равно from
+func (cb *circuitBreaker) transition(ctx context.Context, from, to int32, now time.Time) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state.Load() == from {
+		cb.setState(ctx, to, now)
+	}
+}
+
+// setState меняет состояние и сбрасывает счётчики, вызывается под mu
+func (cb *circuitBreaker) setState(ctx context.Context, to int32, now time.Time) {
+	from := cb.state.Swap(to)
+
+	cb.openedAt = now
+	cb.windowStart.Store(now.UnixNano())
+	cb.total.Store(0)
+	cb.errors.Store(0)
+	cb.consecutive.Store(0)
+	cb.probes.Store(0)
+	cb.succeeded.Store(0)
+
+	if from != to {
+		logger.Warn(ctx, "circuit breaker "+breakerStateNames[to], "id="+cb.id, "from="+breakerStateNames[from])
+	}
+}
+
+// changedSinceLog сообщает, что состояние изменилось с прошлого вызова
+func (cb *circuitBreaker) changedSinceLog() bool {
+	state := cb.state.Load()
+	return cb.logged.Swap(state) != state
+}
+
+func (cb *circuitBreaker) String() string {
+	str := "breaker: " + breakerStateNames[cb.state.Load()]
+
+	if cb.errorRate > 0 {
+		str += ", errorrate: " + strconv.FormatFloat(cb.errorRate, 'f', -1, 64)
+	}
+
+	if cb.consecutiveFailures > 0 {
+		str += ", consecutivefailures: " + strconv.FormatInt(cb.consecutiveFailures, 10)
+	}
+
+	return str
+}
@@ -0,0 +1,205 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreaker_compile(t *testing.T) {
+	tests := []struct {
+		name    string
+		breaker Breaker
+		wantErr string
+	}{
+		{name: "error rate", breaker: Breaker{ErrorRate: 0.5}},
+		{name: "full", breaker: Breaker{ErrorRate: 0.5, MinRequests: 10, ConsecutiveFailures: 3, Window: "5s", OpenTimeout: "1m", HalfOpenRequests: 2}},
+		{name: "no thresholds", breaker: Breaker{}, wantErr: "errorrate or consecutivefailures is required"},
+		{name: "error rate too big", breaker: Breaker{ErrorRate: 1.5}, wantErr: "errorrate must be in (0, 1]"},
+		{name: "negative", breaker: Breaker{ConsecutiveFailures: 3, HalfOpenRequests: -1}, wantErr: "must not be negative"},
+		{name: "invalid window", breaker: Breaker{ErrorRate: 0.5, Window: "often"}, wantErr: "invalid window"},
+		{name: "invalid open timeout", breaker: Breaker{ErrorRate: 0.5, OpenTimeout: "-1s"}, wantErr: "invalid opentimeout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.breaker.compile("")
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("compile() unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("compile() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker_transitions(t *testing.T) {
+	ctx := context.Background()
+
+	cb, err := (&Breaker{ConsecutiveFailures: 3, OpenTimeout: "10s", HalfOpenRequests: 2}).compile("payments")
+	if err != nil {
+		t.Fatalf("compile() error: %v", err)
+	}
+
+	now := time.Unix(1700000000, 0)
+
+	cb.observe(ctx, http.StatusBadGateway, now)
+	cb.observe(ctx, http.StatusOK, now)
+	cb.observe(ctx, http.StatusBadGateway, now)
+	cb.observe(ctx, http.StatusBadGateway, now)
+
+	if ok, _ := cb.allow(ctx, now); !ok {
+		t.Fatal("breaker should stay closed: failures were not consecutive")
+	}
+
+	cb.observe(ctx, http.StatusServiceUnavailable, now)
+
+	if ok, wait := cb.allow(ctx, now.Add(4*time.Second)); ok || wait != 6*time.Second {
+		t.Fatalf("allow() = %v, %v, want false, 6s while open", ok, wait)
+	}
+
+	later := now.Add(10 * time.Second)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := cb.allow(ctx, later); !ok {
+			t.Fatalf("probe %d should be allowed in half-open", i)
+		}
+	}
+
+	if ok, _ := cb.allow(ctx, later); ok {
+		t.Fatal("only halfopenrequests probes should be allowed")
+	}
+
+	cb.observe(ctx, http.StatusOK, later)
+	cb.observe(ctx, http.StatusInternalServerError, later)
+
+	if got := breakerStateNames[cb.state.Load()]; got != "open" {
+		t.Fatalf("state = %s, want open after failed probe", got)
+	}
+
+	later = later.Add(10 * time.Second)
+
+	cb.allow(ctx, later)
+	cb.allow(ctx, later)
+	cb.observe(ctx, http.StatusOK, later)
+	cb.observe(ctx, http.StatusOK, later)
+
+	if got := breakerStateNames[cb.state.Load()]; got != "closed" {
+		t.Errorf("state = %s, want closed after successful probes", got)
+	}
+}
+
+func TestCircuitBreaker_errorRate(t *testing.T) {
+	ctx := context.Background()
+
+	cb, err := (&Breaker{ErrorRate: 0.5, MinRequests: 4, Window: "10s"}).compile("payments")
+	if err != nil {
+		t.Fatalf("compile() error: %v", err)
+	}
+
+	now := time.Now()
+
+	cb.observe(ctx, http.StatusBadGateway, now)
+	cb.observe(ctx, http.StatusBadGateway, now)
+	cb.observe(ctx, http.StatusOK, now)
+
+	if got := breakerStateNames[cb.state.Load()]; got != "closed" {
+		t.Fatalf("state = %s, want closed before minrequests", got)
+	}
+
+	// новое окно, ошибки предыдущего не учитываются
+	now = now.Add(10 * time.Second)
+
+	cb.observe(ctx, http.StatusOK, now)
+	cb.observe(ctx, http.StatusOK, now)
+	cb.observe(ctx, http.StatusOK, now)
+	cb.observe(ctx, http.StatusBadGateway, now)
+
+	if got := breakerStateNames[cb.state.Load()]; got != "closed" {
+		t.Fatalf("state = %s, want closed at error rate 0.25", got)
+	}
+
+	cb.observe(ctx, http.StatusBadGateway, now)
+	cb.observe(ctx, http.StatusBadGateway, now)
+
+	if got := breakerStateNames[cb.state.Load()]; got != "open" {
+		t.Errorf("state = %s, want open at error rate 0.5", got)
+	}
+}
+
+func TestRateLimiter_Breaker(t *testing.T) {
+	rl := &RateLimiter{
+		rules: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+
+	rl.hotReloadLimits(&Limits{
+		Limits: []Limit{
+			{
+				Breaker: &Breaker{ConsecutiveFailures: 2, OpenTimeout: "1m"},
+				Rules:   []Rule{{URLPathPattern: "/api/**"}},
+			},
+		},
+	})
+
+	failing := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusBadGateway)
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/api/payments", http.NoBody)
+
+		d := rl.decide(req, nil)
+		if !d.allow || !d.observes() {
+			t.Fatalf("request %d: allow = %v, observes = %v, want both true", i, d.allow, d.observes())
+		}
+
+		d.serveObserved(failing, httptest.NewRecorder(), req)
+	}
+
+	d := rl.decide(httptest.NewRequest(http.MethodGet, "http://localhost/api/payments", http.NoBody), nil)
+	if d.allow || d.status != http.StatusServiceUnavailable {
+		t.Fatalf("decide() = %v, %d, want false, 503 while breaker is open", d.allow, d.status)
+	}
+
+	if d.retryAfter <= 0 || d.retryAfter > time.Minute {
+		t.Errorf("retryAfter = %v, want within opentimeout", d.retryAfter)
+	}
+
+	if got := rl.stats.circuitOpen.Load(); got != 1 {
+		t.Errorf("stats.circuitOpen = %d, want 1", got)
+	}
+
+	if d = rl.decide(httptest.NewRequest(http.MethodGet, "http://localhost/other", http.NoBody), nil); !d.allow {
+		t.Error("requests of other rules should not be affected by the breaker")
+	}
+	lim, ok := findPattern(rl.rules.Load().(*sync.Map), "/api/**")
+	if !ok {
+		t.Fatal("limit for /api/** not found")
+	}
+
+	if lim.breaker.id == "" || lim.breaker.id != lim.id {
+		t.Errorf("breaker id = %q, want limit id %q", lim.breaker.id, lim.id)
+	}
+
+	// размыкание выводит рабочие лимиты один раз
+	if !lim.changedSinceLog(time.Now()) {
+		t.Error("changedSinceLog() should report the opened breaker")
+	}
+
+	if lim.changedSinceLog(time.Now()) {
+		t.Error("changedSinceLog() should not report the same breaker state twice")
+	}
+}
@@ -0,0 +1,105 @@
+package traefik_ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/bypass"
+	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
+)
+
+const defaultBypassHeader = "X-Ratelimit-Bypass"
+
+// bypassSettings скомпилированные настройки токенов обхода лимитов
+type bypassSettings struct {
+	header   string
+	verifier *bypass.Verifier // nil, если ключей нет
+}
+
+// verifier собирает проверяющего из ключей конфигурации middleware (staticKeys) и ключей из Bypass.
+// При совпадении id приоритет у ключа из конфигурации middleware
+func (b *Bypass) verifier(staticKeys []bypass.Key) (*bypass.Verifier, error) {
+	var maxTTL time.Duration
+	if b != nil && b.MaxTTL != "" {
+		du, err := time.ParseDuration(b.MaxTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max ttl: %w", err)
+		}
+
+		maxTTL = du
+	}
+
+	keys := append([]bypass.Key(nil), staticKeys...)
+
+	if b != nil {
+		for _, k := range b.Keys {
+			if containsKey(staticKeys, k.ID) {
+				continue
+			}
+
+			keys = append(keys, bypass.Key{ID: k.ID, Secret: []byte(k.Secret)})
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	return bypass.NewVerifier(keys, maxTTL)
+}
+
+func containsKey(keys []bypass.Key, id string) bool {
+	for _, k := range keys {
+		if k.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newBypassSettings(b *Bypass, staticKeys []bypass.Key) *bypassSettings {
+	settings := &bypassSettings{
+		header: defaultBypassHeader,
+	}
+
+	if b != nil && b.Header != "" {
+		settings.header = http.CanonicalHeaderKey(b.Header)
+	}
+
+	// ошибки уже проверены в validate
+	settings.verifier, _ = b.verifier(staticKeys)
+
+	return settings
+}
+
+// verifyBypass проверяет токен обхода лимитов в запросе.
+// Заголовок с токеном удаляется, чтобы не передавать его в upstream.
+// Возвращает nil, если токена нет или он недействителен
+func (rl *RateLimiter) verifyBypass(req *http.Request) *bypass.Claims {
+	settings, ok := rl.bypass.Load().(*bypassSettings)
+	if !ok || settings.verifier == nil {
+		return nil
+	}
+
+	token := req.Header.Get(settings.header)
+	if token == "" {
+		return nil
+	}
+
+	req.Header.Del(settings.header)
+
+	claims, err := settings.verifier.Verify(token, time.Now())
+	if err != nil {
+		rl.counters().bypassRejected.Add(1)
+		logger.Debug(req.Context(), fmt.Sprintf("bypass token rejected: %v", err))
+
+		return nil
+	}
+
+	rl.counters().bypassed.Add(1)
+	logger.Debug(req.Context(), "bypass token accepted", "sub="+claims.Subject)
+
+	return claims
+}
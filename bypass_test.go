@@ -0,0 +1,90 @@
+package traefik_ratelimit
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/bypass"
+)
+
+func TestRateLimiter_verifyBypass(t *testing.T) {
+	rl := &RateLimiter{
+		rules: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+	rl.bypassKeys.Store([]bypass.Key{{ID: "static", Secret: []byte("static-secret")}})
+
+	// лимит меньше количества окон, значит в текущем окне нет ни одного разрешения
+	rl.hotReloadLimits(&Limits{
+		Limits: []Limit{
+			{Limit: 1, Rules: []Rule{{URLPathPattern: "/api/v1/**"}}},
+			{Limit: 1, Rules: []Rule{{URLPathPattern: "/api/v2/**"}}},
+		},
+		Deny: []Rule{{URLPathPattern: "/admin"}},
+		Bypass: &Bypass{
+			Header: "X-Loadtest-Token",
+			Keys:   []BypassKey{{ID: "keeper", Secret: "keeper-secret"}},
+			MaxTTL: "1h",
+		},
+	})
+
+	expiresAt := time.Now().Add(time.Minute).Unix()
+
+	sign := func(key bypass.Key, limits ...string) string {
+		token, err := bypass.Sign(key, bypass.Claims{Subject: "test", ExpiresAt: expiresAt, Limits: limits})
+		if err != nil {
+			t.Fatalf("Sign() error: %v", err)
+		}
+
+		return token
+	}
+
+	staticKey := bypass.Key{ID: "static", Secret: []byte("static-secret")}
+	keeperKey := bypass.Key{ID: "keeper", Secret: []byte("keeper-secret")}
+
+	tests := []struct {
+		name      string
+		path      string
+		token     string
+		wantAllow bool
+	}{
+		{name: "no token", path: "/api/v1/users", wantAllow: false},
+		{name: "static key exempts all", path: "/api/v1/users", token: sign(staticKey, "*"), wantAllow: true},
+		{name: "keeper key exempts all", path: "/api/v2/users", token: sign(keeperKey, "*"), wantAllow: true},
+		{name: "exempt listed limit", path: "/api/v1/users", token: sign(keeperKey, "/api/v1/**"), wantAllow: true},
+		{name: "not listed limit applies", path: "/api/v2/users", token: sign(keeperKey, "/api/v1/**"), wantAllow: false},
+		{name: "forged token", path: "/api/v1/users", token: sign(bypass.Key{ID: "keeper", Secret: []byte("x")}, "*"), wantAllow: false},
+		{name: "deny is not bypassed", path: "/admin", token: sign(staticKey, "*"), wantAllow: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://localhost"+tt.path, http.NoBody)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			if tt.token != "" {
+				req.Header.Set("X-Loadtest-Token", tt.token)
+			}
+
+			claims := rl.verifyBypass(req)
+
+			if req.Header.Get("X-Loadtest-Token") != "" {
+				t.Error("bypass token should not be forwarded upstream")
+			}
+
+			if d := rl.decide(req, claims); d.allow != tt.wantAllow {
+				t.Errorf("allow = %v, want %v", d.allow, tt.wantAllow)
+			}
+		})
+	}
+
+	if got := rl.stats.bypassRejected.Load(); got != 1 {
+		t.Errorf("bypassRejected = %d, want 1", got)
+	}
+}
@@ -0,0 +1,519 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/bypass"
+	"github.com/wbpaygate/traefik-ratelimit/internal/clientip"
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
+)
+
+const canaryKeyHeader = "header" // заголовок запроса
+
+// canaryKey ключ клиента, по которому запрос относится к канареечной конфигурации: "ip", "header:<name>" или "claim:<name>"
+type canaryKey struct {
+	source string
+	name   string
+}
+
+func parseCanaryKey(s string) (*canaryKey, error) {
+	if s == "" {
+		s = bucketKeyIP
+	}
+
+	source, name, _ := strings.Cut(s, ":")
+
+	switch source {
+	case bucketKeyIP:
+		if name != "" {
+			return nil, fmt.Errorf("canary key '%s': ip does not take a name", s)
+		}
+
+	case canaryKeyHeader, bucketKeyClaim:
+		if name == "" {
+			return nil, fmt.Errorf("canary key '%s': %s name is empty", s, source)
+		}
+
+	default:
+		return nil, fmt.Errorf("canary key '%s': unknown source '%s'", s, source)
+	}
+
+	return &canaryKey{source: source, name: name}, nil
+}
+
+func (k *canaryKey) String() string {
+	if k.name == "" {
+		return k.source
+	}
+
+	return k.source + ":" + k.name
+}
+
+func (k *canaryKey) value(ri *requestInfo) string {
+	switch k.source {
+	case bucketKeyIP:
+		if ip := ri.clientIP(); ip.IsValid() {
+			return ip.String()
+		}
+
+	case canaryKeyHeader:
+		return ri.req.Header.Get(k.name)
+
+	case bucketKeyClaim:
+		if token := ri.jwtToken(); token != nil {
+			if val, ok := token.Claim(k.name); ok {
+				return val
+			}
+		}
+	}
+
+	return ""
+}
+
+// canaryBucket номер клиента от 0 до 99. Одинаков на всех репликах, при увеличении процента клиенты канарейки не меняются
+func canaryBucket(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	return int(h.Sum32() % 100)
+}
+
+// canarySettings команды канареечного применения из ключа keeperControlKey
+type canarySettings struct {
+	percent int // процент клиентов, к которым применяется новая конфигурация, 0 - новые конфигурации применяются сразу
+	key     *canaryKey
+	promote int64 // mod_revision слоя окружения, который применяется ко всем запросам
+	abort   int64 // mod_revision слоя окружения, который не применяется
+}
+
+func newCanarySettings(control *configControl) (*canarySettings, error) {
+	if control.Canary < 0 || control.Canary > 100 {
+		return nil, fmt.Errorf("canary percent %d must be between 0 and 100", control.Canary)
+	}
+
+	key, err := parseCanaryKey(control.CanaryKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &canarySettings{
+		percent: control.Canary,
+		key:     key,
+		promote: control.Promote,
+		abort:   control.Abort,
+	}, nil
+}
+
+// canaryRollout новая конфигурация слоя окружения, применённая к части клиентов
+type canaryRollout struct {
+	value   *keeper.Value
+	limits  *Limits      // слой окружения
+	limiter *RateLimiter // лимиты объединённой конфигурации с новым слоем окружения
+	percent int          // процент клиентов, с которым поделены лимиты сторон
+	started time.Time
+
+	stable canarySide
+	canary canarySide
+}
+
+// canarySide счётчики запросов одной стороны с момента последнего вывода в лог
+type canarySide struct {
+	requests atomic.Int64
+	rejected atomic.Int64
+}
+
+func (s *canarySide) count(allow bool) {
+	if s == nil {
+		return
+	}
+
+	s.requests.Add(1)
+	if !allow {
+		s.rejected.Add(1)
+	}
+}
+
+// fields выводит счётчики стороны name и обнуляет их
+func (s *canarySide) fields(name string) []string {
+	requests := s.requests.Swap(0)
+	rejected := s.rejected.Swap(0)
+
+	rate := 0.0
+	if requests > 0 {
+		rate = float64(rejected) / float64(requests)
+	}
+
+	return []string{
+		name + "_requests=" + strconv.FormatInt(requests, 10),
+		name + "_rejected=" + strconv.FormatInt(rejected, 10),
+		name + "_rejection_rate=" + strconv.FormatFloat(rate, 'f', 4, 64),
+	}
+}
+
+// limitScale доля лимитов стороны канарейки. Лимиты с теми же id и параметрами бакетов на обеих сторонах
+// используют одни бакеты, остальные делятся между сторонами по проценту клиентов, так что вместе стороны
+// не пропускают больше, чем пропускала бы одна конфигурация
+type limitScale struct {
+	percent int                   // процент клиентов канарейки
+	other   map[string]string     // id лимита другой стороны -> параметры бакетов, см. limitStateKey
+	stable  map[string]*LimitImpl // у канарейки - лимиты прежней конфигурации по id, у прежней стороны nil
+}
+
+// canary сообщает, что это сторона канарейки
+func (s *limitScale) canary() bool {
+	return s != nil && s.stable != nil
+}
+
+// changed сообщает, что лимита нет на другой стороне или у него другие параметры бакетов
+func (s *limitScale) changed(id, stateKey string) bool {
+	if s == nil {
+		return false
+	}
+
+	other, ok := s.other[id]
+
+	return !ok || other != stateKey
+}
+
+// stateKey параметры бакетов лимита с долей стороны, чтобы такие бакеты не переносились в полный лимит
+func (s *limitScale) stateKey(stateKey string) string {
+	side := "stable"
+	if s.canary() {
+		side = "canary"
+	}
+
+	return stateKey + " " + side + " " + strconv.Itoa(s.percent) + "%"
+}
+
+// split доля стороны в значении value: канарейке процент клиентов, прежней стороне остаток. Доля не меньше 1
+func (s *limitScale) split(value int) int {
+	if value <= 0 {
+		return value
+	}
+
+	share := value * s.percent / 100
+	if !s.canary() {
+		share = value - share
+	}
+
+	if share < 1 {
+		share = 1 // 0 означал бы отсутствие лимита
+	}
+
+	return share
+}
+
+// limitKeys параметры бакетов лимитов конфигурации по id
+func limitKeys(limits *Limits) map[string]string {
+	keys := make(map[string]string)
+	for _, limit := range limits.Limits {
+		addLimitKeys(keys, limit, "")
+	}
+
+	return keys
+}
+
+func addLimitKeys(keys map[string]string, limit Limit, parentID string) {
+	id := limit.ID
+	if id == "" {
+		id = limitID(limit, parentID)
+	}
+
+	if _, ok := keys[id]; !ok {
+		keys[id] = limitStateKey(limit)
+	}
+
+	for _, child := range limit.Children {
+		addLimitKeys(keys, child, id)
+	}
+}
+
+// changedSinceLog сообщает, что собственные адаптивные лимиты, лимиты по расписанию или breaker канарейки
+// изменились с прошлого вызова. Общие с прежней конфигурацией лимиты выводит прежняя сторона
+func (c *canaryRollout) changedSinceLog(now time.Time) bool {
+	rules, ok := c.limiter.rules.Load().(*sync.Map)
+	if !ok {
+		return false
+	}
+
+	changed := false
+	rules.Range(func(_, value any) bool {
+		for lim, okLim := value.(*LimitImpl); okLim && lim != nil; lim = lim.parent {
+			if lim.scaled && lim.changedSinceLog(now) {
+				changed = true
+			}
+		}
+
+		return true
+	})
+
+	return changed
+}
+
+// close закрывает бакеты лимитов канарейки. Бакеты, общие с прежней конфигурацией, остаются открытыми
+func (c *canaryRollout) close() {
+	rules, ok := c.limiter.rules.Load().(*sync.Map)
+	if !ok {
+		return
+	}
+
+	rules.Range(func(_, value any) bool {
+		for lim, okLim := value.(*LimitImpl); okLim && lim != nil; lim = lim.parent {
+			if lim.scaled {
+				lim.closeBuckets()
+			}
+		}
+
+		return true
+	})
+}
+
+// route выбирает лимитер запроса и счётчики его стороны, без канарейки счётчиков нет
+func (rl *RateLimiter) route(req *http.Request) (*RateLimiter, *canarySide) {
+	c, _ := rl.canary.Load().(*canaryRollout)
+	if c == nil {
+		return rl, nil
+	}
+
+	settings, _ := rl.canarySettings.Load().(*canarySettings)
+	if settings == nil || c.percent == 0 {
+		return rl, &c.stable
+	}
+
+	resolver, _ := rl.clientIP.Load().(*clientip.Resolver)
+	jwtCfg, _ := rl.jwt.Load().(*jwtSettings)
+
+	key := settings.key.value(&requestInfo{req: req, resolver: resolver, jwt: jwtCfg})
+
+	// запросы без ключа клиента остаются на прежней конфигурации
+	if key == "" || canaryBucket(key) >= c.percent {
+		return rl, &c.stable
+	}
+
+	return c.limiter, &c.canary
+}
+
+// updateCanary сохраняет команды канареечного применения, при ошибке действуют прежние
+func (rl *RateLimiter) updateCanary(control *configControl) error {
+	settings, err := newCanarySettings(control)
+	if err != nil {
+		return err
+	}
+
+	rl.canarySettings.Store(settings)
+
+	return nil
+}
+
+// applyCanary применяет новую конфигурацию слоя окружения к части клиентов по командам keeperControlKey.
+// Сообщает, что конфигурация обработана и обычное применение не нужно. Под updateMu
+func (rl *RateLimiter) applyCanary(ctx context.Context, stable, result *keeper.Value) (bool, error) {
+	settings, _ := rl.canarySettings.Load().(*canarySettings)
+	if settings == nil {
+		settings = &canarySettings{}
+	}
+
+	active, _ := rl.canary.Load().(*canaryRollout)
+
+	switch {
+	case stable.Equal(result):
+		rl.stopCanary(ctx, "source returned to stable configuration")
+		return false, nil
+
+	case settings.abort != 0 && result.ModRevision == settings.abort:
+		if active != nil {
+			rl.stopCanary(ctx, "canary configuration aborted")
+		}
+
+		logger.Debug(ctx, fmt.Sprintf("skip aborted configuration: version: %d, mod_revision: %d", result.Version, result.ModRevision))
+
+		return true, nil
+
+	case settings.promote != 0 && result.ModRevision == settings.promote:
+		if active != nil && active.value.Equal(result) {
+			logger.Info(ctx, "canary configuration promoted", rl.canaryFields(active)...)
+		}
+
+		rl.stopCanary(ctx, "")
+		return false, nil
+
+	case settings.percent > 0:
+		if active != nil && active.value.Equal(result) && active.percent == settings.percent {
+			return true, nil
+		}
+
+		return true, rl.startCanary(ctx, result, settings.percent)
+	}
+
+	rl.stopCanary(ctx, "canary disabled")
+
+	return false, nil
+}
+
+// startCanary применяет конфигурацию слоя окружения к percent процентам клиентов, под updateMu
+func (rl *RateLimiter) startCanary(ctx context.Context, result *keeper.Value, percent int) error {
+	l, err := parseLimits([]byte(result.Value))
+	if err != nil {
+		return fmt.Errorf("failed serialize canary limits: %w", err)
+	}
+
+	c := &canaryRollout{value: result, limits: l, percent: percent, started: time.Now()}
+
+	if active, _ := rl.canary.Load().(*canaryRollout); active != nil && active.value.Equal(result) {
+		c.started = active.started
+	}
+
+	if _, err = rl.canaryLimits(c.limits); err != nil {
+		return err
+	}
+
+	rl.stopCanary(ctx, "replaced by new canary configuration")
+
+	if err = rl.buildCanary(c); err != nil {
+		return err
+	}
+
+	rl.canary.Store(c)
+
+	logger.Info(ctx, "canary configuration started", rl.canaryFields(c)...)
+	logger.Info(ctx, "canary rate limits overview", c.limiter.workingLimits(ctx)...)
+
+	return nil
+}
+
+// canaryLimits объединённая конфигурация текущих слоёв с новым слоем окружения
+func (rl *RateLimiter) canaryLimits(limits *Limits) (*Limits, error) {
+	layers := *rl.layers.Load().(*configLayers)
+	layers.set(layerEnvironment, limits)
+
+	merged, _ := mergeLimits(layers.list())
+
+	if err := merged.validate(); err != nil {
+		return nil, fmt.Errorf("failed validate merged canary limits: %w", err)
+	}
+
+	return merged, nil
+}
+
+// buildCanary делит отличающиеся лимиты прежней конфигурации и конфигурации канарейки между сторонами
+// и создаёт лимитер канарейки, который использует бакеты совпадающих лимитов вместе с прежней конфигурацией
+func (rl *RateLimiter) buildCanary(c *canaryRollout) error {
+	merged, err := rl.canaryLimits(c.limits)
+	if err != nil {
+		return err
+	}
+
+	stable := rl.limits.Load().(*Limits)
+
+	rl.canaryScale.Store(&limitScale{percent: c.percent, other: limitKeys(merged)})
+	rl.hotReloadLimits(stable)
+
+	rl.mu.Lock()
+	stableByID := rl.limitsByID
+	rl.mu.Unlock()
+
+	// собственные бакеты канарейки локальные, без общего хранилища и gossip, но с долей реплики
+	child := &RateLimiter{}
+	child.rules.Store(&sync.Map{})
+
+	if keys, ok := rl.bypassKeys.Load().([]bypass.Key); ok {
+		child.bypassKeys.Store(keys)
+	}
+
+	share, _ := rl.replicas.Load().(*replicaShare)
+	child.replicas.Store(share)
+
+	// запросы канарейки учитываются в requests overview вместе с остальными
+	child.statsTo = rl.counters()
+
+	child.canaryScale.Store(&limitScale{percent: c.percent, other: limitKeys(stable), stable: stableByID})
+	child.limits.Store(merged)
+	child.hotReloadLimits(merged)
+
+	c.limiter = child
+
+	return nil
+}
+
+// reloadCanary пересоздаёт лимиты канарейки после изменения других слоёв или доли реплики, под updateMu
+func (rl *RateLimiter) reloadCanary(ctx context.Context) {
+	active, _ := rl.canary.Load().(*canaryRollout)
+	if active == nil {
+		return
+	}
+
+	c := &canaryRollout{value: active.value, limits: active.limits, percent: active.percent, started: active.started}
+
+	if err := rl.buildCanary(c); err != nil {
+		rl.stopCanary(ctx, fmt.Sprintf("cannot rebuild canary: %v", err))
+		return
+	}
+
+	rl.canary.Store(c)
+	active.close()
+
+	logger.Info(ctx, "canary rate limits overview", c.limiter.workingLimits(ctx)...)
+}
+
+// stopCanary возвращает все запросы на прежнюю конфигурацию, под updateMu
+func (rl *RateLimiter) stopCanary(ctx context.Context, reason string) {
+	active, _ := rl.canary.Load().(*canaryRollout)
+	if active == nil {
+		return
+	}
+
+	rl.canary.Store((*canaryRollout)(nil))
+
+	// прежняя конфигурация снова получает полные лимиты
+	rl.canaryScale.Store((*limitScale)(nil))
+	if limits, ok := rl.limits.Load().(*Limits); ok && limits != nil {
+		rl.hotReloadLimits(limits)
+	}
+
+	active.close()
+
+	if reason != "" {
+		logger.Info(ctx, "canary configuration stopped: "+reason, rl.canaryFields(active)...)
+	}
+}
+
+func (rl *RateLimiter) canaryFields(c *canaryRollout) []string {
+	fields := []string{
+		"version=" + strconv.FormatInt(c.value.Version, 10),
+		"mod_revision=" + strconv.FormatInt(c.value.ModRevision, 10),
+		"started=" + c.started.Format(time.RFC3339),
+	}
+
+	if settings, _ := rl.canarySettings.Load().(*canarySettings); settings != nil && settings.key != nil {
+		fields = append(fields, "percent="+strconv.Itoa(settings.percent), "key="+settings.key.String())
+	}
+
+	return fields
+}
+
+// logCanary выводит долю отклонённых запросов каждой стороны канарейки
+func (rl *RateLimiter) logCanary(ctx context.Context) {
+	c, _ := rl.canary.Load().(*canaryRollout)
+	if c == nil {
+		return
+	}
+
+	fields := rl.canaryFields(c)
+	fields = append(fields, c.stable.fields("stable")...)
+	fields = append(fields, c.canary.fields("canary")...)
+
+	logger.Info(ctx, "canary overview", fields...)
+
+	if c.changedSinceLog(time.Now()) {
+		logger.Info(ctx, "canary rate limits overview", c.limiter.workingLimits(ctx)...)
+	}
+}
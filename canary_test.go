@@ -0,0 +1,343 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+)
+
+func TestParseCanaryKey(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "", want: "ip"},
+		{in: "ip", want: "ip"},
+		{in: "header:X-Client-Id", want: "header:X-Client-Id"},
+		{in: "claim:sub", want: "claim:sub"},
+		{in: "ip:x", wantErr: true},
+		{in: "header", wantErr: true},
+		{in: "param:id", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		key, err := parseCanaryKey(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCanaryKey(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+
+		if err == nil && key.String() != tt.want {
+			t.Errorf("parseCanaryKey(%q) = %s, want %s", tt.in, key, tt.want)
+		}
+	}
+}
+
+func TestRateLimiter_canary(t *testing.T) {
+	var mu sync.Mutex
+
+	values := map[string]*keeper.Value{}
+
+	set := func(key string, v *keeper.Value) {
+		mu.Lock()
+		values[key] = v
+		mu.Unlock()
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		value, ok := values[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]
+		mu.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(value)
+	}))
+	defer srv.Close()
+
+	limits := func(revision int64, perDay int) *keeper.Value {
+		return &keeper.Value{
+			Value:       `{"limits": [{"id": "payments", "perday": ` + strconv.Itoa(perDay) + `, "rules": [{"urlpathpattern": "/pay"}]}]}`,
+			Version:     revision,
+			ModRevision: revision,
+		}
+	}
+
+	ctx := context.Background()
+
+	kc := keeper.NewKeeperClient(http.DefaultClient, srv.URL, "", "ratelimits")
+
+	rl := NewRateLimiter(ctx, defaultRateLimitLimits)
+	rl.keeperClient.Store(kc)
+	rl.source.Store(&sourceConfig{name: configSourceKeeper, source: kc, controlKey: "control"})
+
+	if err := rl.loadLimits(ctx, []byte(limits(0, 1).Value)); err != nil {
+		t.Fatalf("loadLimits() error: %v", err)
+	}
+
+	update := func() {
+		t.Helper()
+
+		if err := rl.updateLimits(ctx); err != nil {
+			t.Fatalf("updateLimits() error: %v", err)
+		}
+	}
+
+	// клиенты по обе стороны 50%
+	var stableClient, canaryClient string
+	for i := 0; stableClient == "" || canaryClient == ""; i++ {
+		client := "client-" + strconv.Itoa(i)
+		if canaryBucket(client) < 50 {
+			canaryClient = client
+		} else {
+			stableClient = client
+		}
+	}
+
+	request := func(client string) (bool, bool) {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/pay", http.NoBody)
+		req.Header.Set("X-Client-Id", client)
+
+		limiter, side := rl.route(req)
+
+		d := limiter.decide(req, nil)
+		side.count(d.allow)
+
+		return d.allow, limiter != rl
+	}
+
+	set("control", &keeper.Value{Value: `{}`})
+	set("ratelimits", limits(1, 1))
+	update()
+
+	// с включённой канарейкой ревизия 2 применяется только к клиентам канарейки
+	set("control", &keeper.Value{Value: `{"canary": 50, "canaryKey": "header:X-Client-Id"}`})
+	set("ratelimits", limits(2, 100))
+	update()
+
+	for i := 0; i < 3; i++ {
+		if allow, canary := request(canaryClient); !allow || !canary {
+			t.Errorf("canary client request %d: allow %v, canary %v, want allowed by canary", i, allow, canary)
+		}
+	}
+
+	if allow, canary := request(stableClient); !allow || canary {
+		t.Errorf("stable client first request: allow %v, canary %v, want allowed by stable", allow, canary)
+	}
+
+	if allow, _ := request(stableClient); allow {
+		t.Error("stable client second request should be rejected by perday 1")
+	}
+
+	if allow, canary := request(""); allow || canary {
+		t.Errorf("request without client key: allow %v, canary %v, want stable and rejected", allow, canary)
+	}
+
+	c := rl.canary.Load().(*canaryRollout)
+
+	stable, canary := strings.Join(c.stable.fields("stable"), " "), strings.Join(c.canary.fields("canary"), " ")
+	if stable != "stable_requests=3 stable_rejected=2 stable_rejection_rate=0.6667" {
+		t.Errorf("stable fields = %s", stable)
+	}
+
+	if canary != "canary_requests=3 canary_rejected=0 canary_rejection_rate=0.0000" {
+		t.Errorf("canary fields = %s", canary)
+	}
+
+	// повторный опрос той же ревизии не пересоздаёт канарейку
+	update()
+
+	if rl.canary.Load().(*canaryRollout) != c {
+		t.Error("canary rebuilt for the same revision")
+	}
+
+	if got := rl.keeperSetting.Load().(*keeper.Value).ModRevision; got != 1 {
+		t.Errorf("stable mod_revision = %d, want 1 while canary is active", got)
+	}
+
+	// перевод ревизии 2 на всех клиентов
+	set("control", &keeper.Value{Value: `{"canary": 50, "canaryKey": "header:X-Client-Id", "promote": 2}`})
+	update()
+
+	if rl.canary.Load().(*canaryRollout) != nil {
+		t.Error("canary should be stopped after promote")
+	}
+
+	if allow, canary := request(stableClient); !allow || canary {
+		t.Errorf("stable client after promote: allow %v, canary %v, want allowed by promoted limits", allow, canary)
+	}
+
+	// отмена ревизии 3: канарейка остановлена, действует ревизия 2
+	set("ratelimits", limits(3, 1))
+	update()
+
+	if c = rl.canary.Load().(*canaryRollout); c == nil || c.value.ModRevision != 3 {
+		t.Fatalf("canary = %+v, want revision 3", c)
+	}
+
+	set("control", &keeper.Value{Value: `{"canary": 50, "canaryKey": "header:X-Client-Id", "abort": 3}`})
+	update()
+	update()
+
+	if rl.canary.Load().(*canaryRollout) != nil {
+		t.Error("canary should be stopped after abort")
+	}
+
+	if got := rl.keeperSetting.Load().(*keeper.Value).ModRevision; got != 2 {
+		t.Errorf("stable mod_revision = %d, want 2 after abort", got)
+	}
+
+	if lim, ok := findPattern(c.limiter.rules.Load().(*sync.Map), "/pay"); !ok || !lim.IsClosed() {
+		t.Error("aborted canary buckets should be closed")
+	}
+}
+
+func TestRateLimiter_canaryCombinedLimits(t *testing.T) {
+	ctx := context.Background()
+
+	rl := NewRateLimiter(ctx, defaultRateLimitLimits)
+
+	stable := `{"limits": [
+		{"id": "payments", "perday": 10, "rules": [{"urlpathpattern": "/pay"}]},
+		{"id": "orders", "perday": 10, "rules": [{"urlpathpattern": "/orders"}]}
+	]}`
+
+	if err := rl.loadLimits(ctx, []byte(stable)); err != nil {
+		t.Fatalf("loadLimits() error: %v", err)
+	}
+
+	if err := rl.updateCanary(&configControl{Canary: 50, CanaryKey: "header:X-Client-Id"}); err != nil {
+		t.Fatalf("updateCanary() error: %v", err)
+	}
+
+	// payments меняется, orders остаётся прежним
+	canaryValue := &keeper.Value{
+		Value: `{"limits": [
+			{"id": "payments", "perday": 20, "rules": [{"urlpathpattern": "/pay"}]},
+			{"id": "orders", "perday": 10, "rules": [{"urlpathpattern": "/orders"}]}
+		]}`,
+		Version:     1,
+		ModRevision: 1,
+	}
+
+	rl.updateMu.Lock()
+	err := rl.startCanary(ctx, canaryValue, 50)
+	rl.updateMu.Unlock()
+
+	if err != nil {
+		t.Fatalf("startCanary() error: %v", err)
+	}
+
+	var stableClient, canaryClient string
+	for i := 0; stableClient == "" || canaryClient == ""; i++ {
+		client := "client-" + strconv.Itoa(i)
+		if canaryBucket(client) < 50 {
+			canaryClient = client
+		} else {
+			stableClient = client
+		}
+	}
+
+	serve := func(client, path string, n int) int {
+		allowed := 0
+
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+path, http.NoBody)
+			req.Header.Set("X-Client-Id", client)
+
+			limiter, _ := rl.route(req)
+			if limiter.decide(req, nil).allow {
+				allowed++
+			}
+		}
+
+		return allowed
+	}
+
+	// изменённый лимит делится по проценту: прежней стороне половина от 10, канарейке половина от 20
+	if got := serve(stableClient, "/pay", 30); got != 5 {
+		t.Errorf("stable side allowed %d on changed limit, want 5", got)
+	}
+
+	if got := serve(canaryClient, "/pay", 30); got != 10 {
+		t.Errorf("canary side allowed %d on changed limit, want 10", got)
+	}
+
+	// совпадающий лимит считается одним бакетом на обе стороны
+	if got := serve(stableClient, "/orders", 6) + serve(canaryClient, "/orders", 30); got != 10 {
+		t.Errorf("both sides allowed %d on unchanged limit, want 10 in total", got)
+	}
+
+	rl.updateMu.Lock()
+	rl.stopCanary(ctx, "")
+	rl.updateMu.Unlock()
+
+	// после остановки прежняя конфигурация получает полный лимит, общий бакет не закрыт и сохраняет расход
+	if got := serve(stableClient, "/orders", 5); got != 0 {
+		t.Errorf("stable side allowed %d on unchanged limit after stop, want 0", got)
+	}
+
+	if got := serve(stableClient, "/pay", 30); got != 10 {
+		t.Errorf("stable side allowed %d on changed limit after stop, want full 10", got)
+	}
+}
+
+func TestRateLimiter_canaryStats(t *testing.T) {
+	ctx := context.Background()
+
+	rl := NewRateLimiter(ctx, defaultRateLimitLimits)
+
+	if err := rl.loadLimits(ctx, []byte(`{"limits": [{"id": "payments", "perday": 10, "rules": [{"urlpathpattern": "/pay"}]}]}`)); err != nil {
+		t.Fatalf("loadLimits() error: %v", err)
+	}
+
+	if err := rl.updateCanary(&configControl{Canary: 100, CanaryKey: "header:X-Client-Id"}); err != nil {
+		t.Fatalf("updateCanary() error: %v", err)
+	}
+
+	canaryValue := &keeper.Value{
+		Value:       `{"limits": [{"id": "payments", "perday": 1, "rules": [{"urlpathpattern": "/pay"}]}]}`,
+		Version:     1,
+		ModRevision: 1,
+	}
+
+	rl.updateMu.Lock()
+	err := rl.startCanary(ctx, canaryValue, 100)
+	rl.updateMu.Unlock()
+
+	if err != nil {
+		t.Fatalf("startCanary() error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/pay", http.NoBody)
+		req.Header.Set("X-Client-Id", "client")
+
+		limiter, _ := rl.route(req)
+		if limiter == rl {
+			t.Fatal("request should be routed to the canary")
+		}
+
+		limiter.decide(req, nil)
+	}
+
+	// отказ на стороне канарейки попадает в requests overview основного лимитера
+	if got := rl.stats.limited.Load(); got != 1 {
+		t.Errorf("stats.limited = %d, want 1 from the canary side", got)
+	}
+
+	if got := rl.stats.swapLimitedByID(); len(got) != 1 || got[0] != `limited{id="payments"}=1` {
+		t.Errorf("limited by id = %v, want payments=1", got)
+	}
+}
@@ -0,0 +1,229 @@
+package traefik_ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// costImpl скомпилированный Cost
+type costImpl struct {
+	value  int
+	header string // ключ в каноническом виде
+	query  string
+	min    int
+	max    int
+
+	clamped int // ёмкость окна, которой ограничена стоимость, 0 - не ограничена
+}
+
+// compile проверяет и компилирует стоимость, используется и в validate, и при загрузке лимитов
+func (c *Cost) compile() (*costImpl, error) {
+	ci := &costImpl{
+		value:  c.Value,
+		header: http.CanonicalHeaderKey(c.Header),
+		query:  c.Query,
+		min:    c.Min,
+		max:    c.Max,
+	}
+
+	if c.Header == "" && c.Query == "" {
+		if c.Min != 0 || c.Max != 0 {
+			return nil, fmt.Errorf("min and max require header or query")
+		}
+
+		if c.Value <= 0 {
+			return nil, fmt.Errorf("value must be greater than 0")
+		}
+
+		return ci, nil
+	}
+
+	if c.Header != "" && c.Query != "" {
+		return nil, fmt.Errorf("only one of header and query may be specified")
+	}
+
+	if ci.min == 0 {
+		ci.min = 1
+	}
+
+	if ci.min < 0 {
+		return nil, fmt.Errorf("min must be greater than 0")
+	}
+
+	if ci.max < ci.min {
+		return nil, fmt.Errorf("max must be specified and not less than min %d", ci.min)
+	}
+
+	if ci.value == 0 {
+		ci.value = ci.min
+	}
+
+	if ci.value < ci.min || ci.value > ci.max {
+		return nil, fmt.Errorf("value %d is out of [%d, %d]", ci.value, ci.min, ci.max)
+	}
+
+	return ci, nil
+}
+
+// maxCost наибольшая стоимость запроса правила, 1 без стоимости, 0 для некорректной стоимости (ошибка уже в validate)
+func (c *Cost) maxCost() int {
+	if c == nil {
+		return 1
+	}
+
+	ci, err := c.compile()
+	if err != nil {
+		return 0
+	}
+
+	if ci.header == "" && ci.query == "" {
+		return ci.value
+	}
+
+	return ci.max
+}
+
+// minCapacity наименьшая ёмкость окна лимита при любом тарифе, расписании и адаптивном значении,
+// 0 - окна не ограничены, например у лимита только с breaker
+func (l *Limit) minCapacity() int {
+	capacity := minPositive(minPositive(l.rps(), l.PerMinute), l.PerDay)
+
+	if l.Tiers != nil {
+		for _, value := range l.Tiers.Limits {
+			capacity = minPositive(capacity, value)
+		}
+	}
+
+	if l.Adaptive != nil {
+		adaptiveMin := l.Adaptive.Min
+		if adaptiveMin == 0 {
+			adaptiveMin = 1
+		}
+
+		capacity = minPositive(capacity, adaptiveMin)
+	}
+
+	if l.Schedule != nil {
+		for _, p := range l.Schedule.Periods {
+			capacity = minPositive(capacity, p.Limit)
+		}
+	}
+
+	return capacity
+}
+
+// minPositive меньшее из положительных значений, 0 - если оба не положительны
+func minPositive(a, b int) int {
+	if a <= 0 {
+		if b < 0 {
+			return 0
+		}
+
+		return b
+	}
+
+	if b > 0 && b < a {
+		return b
+	}
+
+	return a
+}
+
+// cost возвращает стоимость запроса, некорректные значения заменяются на value,
+// выходящие за границы - на ближайшую границу
+func (ci *costImpl) cost(req *http.Request) int {
+	var raw string
+
+	switch {
+	case ci.header != "":
+		if values := req.Header[ci.header]; len(values) > 0 {
+			raw = values[0]
+		}
+
+	case ci.query != "":
+		raw = queryValue(req.URL.RawQuery, ci.query)
+
+	default:
+		return ci.value
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil {
+		return ci.value
+	}
+
+	if n < ci.min {
+		return ci.min
+	}
+
+	if n > ci.max {
+		return ci.max
+	}
+
+	return n
+}
+
+// clamp ограничивает стоимость ёмкостью окна capacity. Доля реплики или стороны канарейки меньше лимита
+// из конфигурации, проверенного в validate, и запрос дороже доли отклонялся бы всегда
+func (ci *costImpl) clamp(capacity int) {
+	if capacity <= 0 || (ci.value <= capacity && ci.max <= capacity) {
+		return
+	}
+
+	if ci.value > capacity {
+		ci.value = capacity
+	}
+
+	if ci.min > capacity {
+		ci.min = capacity
+	}
+
+	if ci.max > capacity {
+		ci.max = capacity
+	}
+
+	ci.clamped = capacity
+}
+
+func (ci *costImpl) String() string {
+	str := strconv.Itoa(ci.value)
+
+	switch {
+	case ci.header != "":
+		str = "header " + ci.header + " [" + strconv.Itoa(ci.min) + ", " + strconv.Itoa(ci.max) + "]"
+	case ci.query != "":
+		str = "query " + ci.query + " [" + strconv.Itoa(ci.min) + ", " + strconv.Itoa(ci.max) + "]"
+	}
+
+	if ci.clamped > 0 {
+		str += " (clamped to window " + strconv.Itoa(ci.clamped) + ")"
+	}
+
+	return str
+}
+
+// queryValue возвращает первое значение параметра без разбора всей строки запроса,
+// в отличие от url.Values не аллоцирует. Имя и значение не декодируются
+func queryValue(rawQuery, name string) string {
+	for rawQuery != "" {
+		var pair string
+		pair, rawQuery, _ = strings.Cut(rawQuery, "&")
+
+		if key, val, _ := strings.Cut(pair, "="); key == name {
+			return val
+		}
+	}
+
+	return ""
+}
+
+// ruleCost возвращает стоимость запроса для правила
+func ruleCost(rule *RuleImpl, ri *requestInfo) int {
+	if rule.Cost == nil {
+		return 1
+	}
+
+	return rule.Cost.cost(ri.req)
+}
@@ -0,0 +1,173 @@
+package traefik_ratelimit
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCost_compile(t *testing.T) {
+	tests := []struct {
+		name    string
+		cost    Cost
+		wantErr string
+	}{
+		{name: "fixed", cost: Cost{Value: 10}},
+		{name: "header", cost: Cost{Header: "X-Batch-Size", Max: 100}},
+		{name: "query with default", cost: Cost{Query: "count", Value: 5, Min: 1, Max: 100}},
+		{name: "empty", cost: Cost{}, wantErr: "value must be greater than 0"},
+		{name: "bounds without source", cost: Cost{Value: 1, Max: 10}, wantErr: "require header or query"},
+		{name: "header and query", cost: Cost{Header: "X-Batch-Size", Query: "count", Max: 10}, wantErr: "only one of header and query"},
+		{name: "no max", cost: Cost{Header: "X-Batch-Size"}, wantErr: "max must be specified"},
+		{name: "max less than min", cost: Cost{Query: "count", Min: 10, Max: 5}, wantErr: "not less than min"},
+		{name: "default out of bounds", cost: Cost{Query: "count", Value: 50, Max: 10}, wantErr: "out of [1, 10]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.cost.compile()
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("compile() unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("compile() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLimits_validateCostCapacity(t *testing.T) {
+	batch := func(max int) []Rule {
+		return []Rule{{URLPathPattern: "/batch", Cost: &Cost{Header: "X-Batch-Size", Max: max}}}
+	}
+
+	tests := []struct {
+		name    string
+		limit   Limit
+		wantErr string
+	}{
+		{name: "fits", limit: Limit{Limit: 100, PerMinute: 1000, Rules: batch(100)}},
+		{name: "above rps", limit: Limit{Limit: 10, Rules: batch(100)}, wantErr: "[limit 0, rule 0]: max cost 100 exceeds the smallest window capacity 10"},
+		{name: "above perminute", limit: Limit{Limit: 100, PerMinute: 50, Rules: batch(100)}, wantErr: "capacity 50"},
+		{name: "fixed value", limit: Limit{Limit: 5, Rules: []Rule{{URLPathPattern: "/export", Cost: &Cost{Value: 10}}}}, wantErr: "max cost 10"},
+		{name: "smallest tier", limit: Limit{Tiers: &Tiers{Key: "header:X-Tier", Default: "free", Limits: map[string]int{"free": 20, "pro": 1000}}, Rules: batch(100)}, wantErr: "capacity 20"},
+		{name: "adaptive min", limit: Limit{Adaptive: &Adaptive{Min: 30, Max: 1000}, Rules: batch(100)}, wantErr: "capacity 30"},
+		{name: "parent window", limit: Limit{Limit: 50, Children: []Limit{{Limit: 1000, Rules: batch(100)}}}, wantErr: "[limit 0, child 0, rule 0]: max cost 100 exceeds the smallest window capacity 50"},
+		{name: "breaker only", limit: Limit{Breaker: &Breaker{ConsecutiveFailures: 5}, Rules: batch(100)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&Limits{Limits: []Limit{tt.limit}}).validate()
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCostImpl_cost(t *testing.T) {
+	header, err := (&Cost{Header: "x-batch-size", Value: 3, Min: 2, Max: 100}).compile()
+	if err != nil {
+		t.Fatalf("compile() error: %v", err)
+	}
+
+	query, err := (&Cost{Query: "count", Max: 100}).compile()
+	if err != nil {
+		t.Fatalf("compile() error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		cost *costImpl
+		url  string
+		size string
+		want int
+	}{
+		{name: "header", cost: header, url: "/", size: "10", want: 10},
+		{name: "header missing", cost: header, url: "/", want: 3},
+		{name: "header invalid", cost: header, url: "/", size: "ten", want: 3},
+		{name: "header below min", cost: header, url: "/", size: "0", want: 2},
+		{name: "header above max", cost: header, url: "/", size: "1000", want: 100},
+		{name: "query", cost: query, url: "/export?format=csv&count=25", want: 25},
+		{name: "query prefix name", cost: query, url: "/export?counter=25", want: 1},
+		{name: "query missing", cost: query, url: "/export", want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://localhost"+tt.url, http.NoBody)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			if tt.size != "" {
+				req.Header.Set("X-Batch-Size", tt.size)
+			}
+
+			if got := tt.cost.cost(req); got != tt.want {
+				t.Errorf("cost() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Allow_Cost(t *testing.T) {
+	rl := &RateLimiter{
+		rules: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+
+	rl.hotReloadLimits(&Limits{
+		Limits: []Limit{
+			{
+				PerMinute: 10,
+				Rules: []Rule{
+					{URLPathPattern: "/export", Cost: &Cost{Value: 4}},
+					{URLPathPattern: "/payments/batch", Cost: &Cost{Header: "X-Batch-Size", Max: 10}},
+				},
+			},
+		},
+	})
+
+	allow := func(path, size string) bool {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost"+path, http.NoBody)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		if size != "" {
+			req.Header.Set("X-Batch-Size", size)
+		}
+
+		return rl.Allow(req)
+	}
+
+	if !allow("/export", "") || !allow("/export", "") {
+		t.Fatal("two exports of cost 4 should fit into 10")
+	}
+
+	if allow("/payments/batch", "3") {
+		t.Error("batch of 3 should not fit into remaining 2")
+	}
+
+	if !allow("/payments/batch", "2") {
+		t.Error("batch of 2 should fit into remaining 2, rejected batch must not be debited")
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/wbpaygate/traefik-ratelimit/internal/bypass"
+	"github.com/wbpaygate/traefik-ratelimit/internal/clientip"
 	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
-	"github.com/wbpaygate/traefik-ratelimit/internal/limiter"
 	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
 )
 
@@ -45,12 +48,43 @@ func init() {
 }
 
 type RateLimiter struct {
-	limits        atomic.Value // *Limits
-	keeperSetting atomic.Value // *keeper.Value
+	limits         atomic.Value // *Limits, объединённая конфигурация слоёв
+	layers         atomic.Value // *configLayers
+	keeperSetting  atomic.Value // *keeper.Value, версия слоя окружения
+	serviceSetting atomic.Value // *keeper.Value, версия слоя сервиса
 
-	rules atomic.Value // *sync.Map
+	rules      atomic.Value // *sync.Map
+	clientIP   atomic.Value // *clientip.Resolver
+	access     atomic.Value // *accessRules
+	bypass     atomic.Value // *bypassSettings
+	jwt        atomic.Value // *jwtSettings
+	headers    atomic.Bool  // заголовки X-RateLimit-* в ответе
+	matchFirst atomic.Bool  // matchpolicy "first": проверяется только первый совпавший лимит
 
-	mu sync.Mutex // нужен для релоада
+	bypassKeys atomic.Value // []bypass.Key, ключи из конфигурации middleware
+	shared     atomic.Value // *sharedStore, общее хранилище счётчиков реплик, nil - лимиты локальные
+
+	replicaSource atomic.Value // *replicaConfig
+	replicas      atomic.Value // *replicaShare, доля этой реплики в лимитах
+	gossip        atomic.Value // *gossip, обмен расходом лимитов с пирами, nil - выключен
+
+	stats   requestStats
+	statsTo *requestStats // счётчики, в которые пишет лимитер канарейки, nil - собственные stats
+
+	mu         sync.Mutex            // нужен для релоада
+	limitsEnv  limitsEnv             // параметры бакетов текущих лимитов, под mu
+	limitsByID map[string]*LimitImpl // текущие лимиты по id, под mu
+	updateMu   sync.Mutex            // применение конфигурации из источника
+
+	history atomic.Value // *configHistory, последние принятые конфигурации
+	pin     atomic.Value // *configPin, nil - конфигурация не закреплена
+
+	canary         atomic.Value // *canaryRollout, nil - все запросы на действующей конфигурации
+	canarySettings atomic.Value // *canarySettings
+	canaryScale    atomic.Value // *limitScale, доля лимитов этой стороны канарейки, nil - канарейки нет
+
+	source      atomic.Value // *sourceConfig
+	watchCancel atomic.Value // context.CancelFunc, останавливает watch источника
 
 	keeperClient atomic.Value // *keeper.KeeperClient
 	ticker       atomic.Value // *time.Ticker
@@ -58,12 +92,34 @@ type RateLimiter struct {
 
 func NewRateLimiter(ctx context.Context, rateLimitLimits string) *RateLimiter {
 	rl := &RateLimiter{
-		limits:        atomic.Value{},
-		keeperSetting: atomic.Value{},
+		limits:         atomic.Value{},
+		layers:         atomic.Value{},
+		keeperSetting:  atomic.Value{},
+		serviceSetting: atomic.Value{},
+
+		rules:    atomic.Value{},
+		clientIP: atomic.Value{},
+		access:   atomic.Value{},
+		bypass:   atomic.Value{},
+		jwt:      atomic.Value{},
 
-		rules: atomic.Value{},
+		bypassKeys: atomic.Value{},
+		shared:     atomic.Value{},
+
+		replicaSource: atomic.Value{},
+		replicas:      atomic.Value{},
+		gossip:        atomic.Value{},
+
+		history: atomic.Value{},
+		pin:     atomic.Value{},
+
+		canary:         atomic.Value{},
+		canarySettings: atomic.Value{},
+		canaryScale:    atomic.Value{},
 
 		keeperClient: atomic.Value{},
+		source:       atomic.Value{},
+		watchCancel:  atomic.Value{},
 		ticker:       atomic.Value{},
 	}
 
@@ -73,9 +129,28 @@ func NewRateLimiter(ctx context.Context, rateLimitLimits string) *RateLimiter {
 		ModRevision: 0,
 	})
 
+	rl.layers.Store(&configLayers{})
+	rl.serviceSetting.Store(&keeper.Value{})
+	rl.history.Store(newConfigHistory(defaultConfigHistorySize, ""))
+	rl.pin.Store((*configPin)(nil))
+	rl.canary.Store((*canaryRollout)(nil))
+	rl.canarySettings.Store(&canarySettings{})
+	rl.canaryScale.Store((*limitScale)(nil))
+
 	rl.rules.Store(&sync.Map{})
+	rl.clientIP.Store((*clientip.Resolver)(nil)) // адрес клиента берётся из RemoteAddr
+	rl.access.Store(&accessRules{denyStatus: http.StatusForbidden})
+	rl.bypass.Store(&bypassSettings{header: defaultBypassHeader})
+	rl.bypassKeys.Store([]bypass.Key(nil))
+	rl.shared.Store((*sharedStore)(nil))
+	rl.replicaSource.Store(&replicaConfig{})
+	rl.replicas.Store((*replicaShare)(nil)) // лимиты не делятся между репликами
+	rl.gossip.Store((*gossip)(nil))
+	rl.jwt.Store(newJWTSettings(nil))
 
 	rl.keeperClient.Store((*keeper.KeeperClient)(nil)) // не инициализирован
+	rl.source.Store(&sourceConfig{})
+	rl.watchCancel.Store(context.CancelFunc(func() {}))
 
 	rl.ticker.Store(&time.Ticker{})
 
@@ -102,6 +177,21 @@ func (rl *RateLimiter) startBackgroundLimitsUpdater(ctx context.Context, tickerP
 					logger.Error(tickerCtx, fmt.Sprintf("cannot update limits, error: %v", err))
 				}
 
+				if rl.updateReplicas(tickerCtx) {
+					if limits, ok := rl.limits.Load().(*Limits); ok && limits != nil {
+						rl.hotReloadLimits(limits)
+						rl.logWorkingLimits(tickerCtx)
+					}
+
+					rl.updateMu.Lock()
+					rl.reloadCanary(tickerCtx)
+					rl.updateMu.Unlock()
+				}
+
+				rl.logStats(tickerCtx)
+				rl.logCanary(tickerCtx)
+				rl.logLimitChanges(tickerCtx)
+
 				cancel()
 			}
 		}
@@ -122,28 +212,112 @@ func (rl *RateLimiter) Configure(ctx context.Context, cfg *Config, kc *keeper.Ke
 		keeperClientTimeout = du
 	}
 
-	if kc == nil {
-		cl := &http.Client{
-			Timeout: keeperClientTimeout,
-		}
+	cl := &http.Client{
+		Timeout: keeperClientTimeout,
+	}
 
+	if kc == nil {
 		kc = keeper.NewKeeperClient(cl, cfg.KeeperURL, cfg.KeeperSettingsEndpoint, cfg.KeeperRateLimitKey)
 	}
 
 	rl.keeperClient.Store(kc)
 
+	src, err := newConfigSource(cfg, cl, kc)
+	if err != nil {
+		logger.Error(ctx, fmt.Sprintf("cannot create config source, use keeper, error: %v", err))
+		src = &sourceConfig{name: configSourceKeeper, source: kc}
+	}
+
+	src.serviceKey = cfg.KeeperServiceKey
+	src.controlKey = cfg.KeeperControlKey
+	src.pin = cfg.ConfigPin
+
+	rl.source.Store(src)
+
+	history := newConfigHistory(cfg.ConfigHistorySize, cfg.ConfigHistoryFile)
+	if cfg.ConfigHistoryFile != "" {
+		if err = history.load(); err != nil {
+			logger.Error(ctx, fmt.Sprintf("cannot load config history, error: %v", err))
+		}
+	}
+
+	oldHistory, _ := rl.history.Load().(*configHistory)
+	history.inherit(oldHistory)
+
+	rl.history.Store(history)
+
+	bypassKeys, err := bypass.ParseKeys(cfg.BypassKeys)
+	if err != nil {
+		logger.Error(ctx, fmt.Sprintf("cannot parse bypass keys from config, error: %v", err))
+	}
+
+	rl.bypassKeys.Store(bypassKeys)
+
+	var store *sharedStore
+	if cfg.RedisAddr != "" {
+		redisTimeout, _ := time.ParseDuration(cfg.RedisTimeout)
+		store = newSharedStore(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, redisTimeout)
+	}
+
+	if oldStore, ok := rl.shared.Swap(store).(*sharedStore); ok && oldStore != nil {
+		oldStore.Close()
+	}
+
+	rc := &replicaConfig{}
+	if cfg.ReplicaCount != "" {
+		host, _ := os.Hostname()
+
+		rc.source, err = parseReplicaSource(cfg.ReplicaCount, host, func() *keeper.KeeperClient {
+			kc, _ := rl.keeperClient.Load().(*keeper.KeeperClient)
+			return kc
+		})
+		if err != nil {
+			logger.Error(ctx, fmt.Sprintf("cannot use replica count from config, limits are not split, error: %v", err))
+		}
+	}
+
+	rl.replicaSource.Store(rc)
+	rl.replicas.Store((*replicaShare)(nil))
+
+	replicasCtx, cancel := context.WithTimeout(ctx, keeperClientTimeout)
+	rl.updateReplicas(replicasCtx)
+	cancel()
+
+	// порт освобождается до запуска нового gossip
+	if oldGossip, ok := rl.gossip.Swap((*gossip)(nil)).(*gossip); ok && oldGossip != nil {
+		oldGossip.Close()
+	}
+
+	if cfg.GossipAddr != "" {
+		gossipInterval, _ := time.ParseDuration(cfg.GossipInterval)
+
+		g, errGossip := newGossip(ctx, cfg.GossipAddr, cfg.GossipPeers, cfg.GossipSecret, gossipInterval)
+		if errGossip != nil {
+			logger.Error(ctx, fmt.Sprintf("cannot start gossip, error: %v", errGossip))
+		} else {
+			rl.gossip.Store(g)
+		}
+	}
+
 	tickerPeriod := defaultTickerPeriod
 	if du, err := time.ParseDuration(cfg.KeeperReloadInterval); err == nil {
 		tickerPeriod = du
 	}
 
-	if err := rl.loadLimits([]byte(cfg.RatelimitData)); err != nil {
+	if err := rl.loadLimits(ctx, []byte(cfg.RatelimitData)); err != nil {
 		logger.Error(ctx, fmt.Sprintf("cannot load limits from config, error: %v", err))
 
 	} else {
 		logger.Info(ctx, "update limits from config")
 	}
 
+	// ratelimitData заменяет закреплённую конфигурацию, закрепление из configPin применяется заново
+	rl.pin.Store((*configPin)(nil))
+
+	if err := rl.pinConfig(ctx, cfg.ConfigPin); err != nil {
+		logger.Error(ctx, fmt.Sprintf("cannot pin configuration from config, error: %v", err))
+	}
+
 	if oldTicker, ok := rl.ticker.Load().(*time.Ticker); ok {
 		oldTicker.Stop()
 		select {
@@ -154,18 +328,32 @@ func (rl *RateLimiter) Configure(ctx context.Context, cfg *Config, kc *keeper.Ke
 
 	rl.startBackgroundLimitsUpdater(ctx, tickerPeriod)
 
+	rl.watchCancel.Load().(context.CancelFunc)()
+
+	if w, ok := src.source.(configWatcher); ok {
+		watchCtx, cancelWatch := context.WithCancel(ctx)
+		rl.watchCancel.Store(cancelWatch)
+
+		go rl.watchLimits(watchCtx, src.name, w)
+	}
+
 	logger.Debug(ctx, "configure global rate limiter")
 	rl.logWorkingLimits(ctx)
 }
 
 func (rl *RateLimiter) logWorkingLimits(ctx context.Context) {
+	logger.Info(ctx, "current rate limits overview", rl.workingLimits(ctx)...)
+}
+
+// workingLimits описание рабочих лимитов и правил доступа для лога
+func (rl *RateLimiter) workingLimits(ctx context.Context) []string {
 	var rulesData []string
 
 	if rules, ok := rl.rules.Load().(*sync.Map); ok {
 		rules.Range(func(key, value any) bool {
 			if rule, okRule := key.(RuleImpl); okRule {
-				if lim, okLim := value.(*limiter.Limiter); okLim {
-					rulesData = append(rulesData, "[ limit: "+strconv.Itoa(lim.Limit())+", rules: "+rule.String()+" ]")
+				if lim, okLim := value.(*LimitImpl); okLim {
+					rulesData = append(rulesData, "[ "+lim.String()+", rules: "+rule.String()+" ]")
 				}
 			}
 
@@ -176,5 +364,120 @@ func (rl *RateLimiter) logWorkingLimits(ctx context.Context) {
 		logger.Error(ctx, "rules is nil")
 	}
 
-	logger.Info(ctx, "current rate limits overview", rulesData...)
+	if access, ok := rl.access.Load().(*accessRules); ok {
+		for _, rule := range access.deny {
+			rulesData = append(rulesData, "[ deny: "+strconv.Itoa(access.denyStatus)+", rules: "+rule.String()+" ]")
+		}
+
+		for _, rule := range access.allow {
+			rulesData = append(rulesData, "[ allow, rules: "+rule.String()+" ]")
+		}
+	}
+
+	return rulesData
+}
+
+// requestStats счётчики запросов с момента последнего вывода в лог
+type requestStats struct {
+	allowlisted atomic.Int64 // пропущены по allow
+	denied      atomic.Int64 // отклонены по deny
+	limited     atomic.Int64 // отклонены лимитом
+	circuitOpen atomic.Int64 // отклонены разомкнутым circuit breaker
+
+	bypassed       atomic.Int64 // с действительным токеном обхода лимитов
+	bypassRejected atomic.Int64 // с недействительным токеном обхода лимитов
+
+	limitedByID sync.Map // id лимита -> *atomic.Int64, отклонённые этим лимитом
+}
+
+// counters счётчики запросов лимитера, лимитер канарейки пишет в счётчики основного
+func (rl *RateLimiter) counters() *requestStats {
+	if rl.statsTo != nil {
+		return rl.statsTo
+	}
+
+	return &rl.stats
+}
+
+func (s *requestStats) limitedBy(id string) {
+	counter, ok := s.limitedByID.Load(id)
+	if !ok {
+		counter, _ = s.limitedByID.LoadOrStore(id, new(atomic.Int64))
+	}
+
+	counter.(*atomic.Int64).Add(1)
+}
+
+// swapLimitedByID возвращает счётчики отклонённых по id лимитов в виде limited{id="<id>"}=<n>, отсортированные по id.
+// Счётчики без отказов удаляются, чтобы id удалённых лимитов не накапливались
+func (s *requestStats) swapLimitedByID() []string {
+	var fields []string
+
+	s.limitedByID.Range(func(key, value any) bool {
+		n := value.(*atomic.Int64).Swap(0)
+		if n == 0 {
+			s.limitedByID.Delete(key)
+			return true
+		}
+
+		fields = append(fields, fmt.Sprintf("limited{id=%q}=%d", key, n))
+
+		return true
+	})
+
+	sort.Strings(fields)
+
+	return fields
+}
+
+func (rl *RateLimiter) logStats(ctx context.Context) {
+	allowlisted := rl.stats.allowlisted.Swap(0)
+	denied := rl.stats.denied.Swap(0)
+	limited := rl.stats.limited.Swap(0)
+	circuitOpen := rl.stats.circuitOpen.Swap(0)
+	bypassed := rl.stats.bypassed.Swap(0)
+	bypassRejected := rl.stats.bypassRejected.Swap(0)
+
+	limitedByID := rl.stats.swapLimitedByID()
+
+	if allowlisted == 0 && denied == 0 && limited == 0 && circuitOpen == 0 && bypassed == 0 && bypassRejected == 0 {
+		return
+	}
+
+	fields := []string{
+		"allowlisted=" + strconv.FormatInt(allowlisted, 10),
+		"denied=" + strconv.FormatInt(denied, 10),
+		"limited=" + strconv.FormatInt(limited, 10),
+		"circuit_open=" + strconv.FormatInt(circuitOpen, 10),
+		"bypassed=" + strconv.FormatInt(bypassed, 10),
+		"bypass_rejected=" + strconv.FormatInt(bypassRejected, 10),
+	}
+
+	logger.Info(ctx, "requests overview", append(fields, limitedByID...)...)
+}
+
+// logLimitChanges выводит рабочие лимиты, если эффективное значение адаптивного лимита или лимита по расписанию
+// либо состояние circuit breaker изменилось с прошлого вывода. Лимиты по расписанию при этом переключаются и без запросов
+func (rl *RateLimiter) logLimitChanges(ctx context.Context) {
+	rules, ok := rl.rules.Load().(*sync.Map)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+
+	changed := false
+	rules.Range(func(_, value any) bool {
+		for lim, okLim := value.(*LimitImpl); okLim && lim != nil; lim = lim.parent {
+			if lim.changedSinceLog(now) {
+				changed = true
+			}
+		}
+
+		return true
+	})
+
+	if changed {
+		rl.logWorkingLimits(ctx)
+	}
 }
@@ -0,0 +1,410 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
+)
+
+const (
+	defaultGossipInterval = time.Second
+
+	// gossipTTL сколько интервалов отчёт пира учитывается без обновления
+	gossipTTL = 3
+
+	gossipMaxPacket = 65000
+)
+
+// gossipUsage расход лимита репликой для рассылки пирам
+type gossipUsage struct {
+	rps     atomic.Int64 // списано с прошлой рассылки
+	windows []*windowUsage
+}
+
+// windowUsage расход в текущем окне минуты или суток
+type windowUsage struct {
+	period time.Duration
+	limit  int // значение лимита из конфигурации, от него отнимается расход пиров
+
+	mu    sync.Mutex
+	start int64 // unix начала окна
+	used  int
+}
+
+func newGossipUsage(li *LimitImpl) *gossipUsage {
+	gu := &gossipUsage{}
+	for _, w := range li.windows {
+		gu.windows = append(gu.windows, &windowUsage{period: w.Period(), limit: w.Limit()})
+	}
+
+	return gu
+}
+
+// add учитывает n списанных разрешений, отрицательное n - возврат
+func (gu *gossipUsage) add(n int, now time.Time) {
+	gu.rps.Add(int64(n))
+
+	for _, w := range gu.windows {
+		start := now.Truncate(w.period).Unix()
+
+		w.mu.Lock()
+		if w.start != start {
+			w.start, w.used = start, 0
+		}
+		w.used += n
+		w.mu.Unlock()
+	}
+}
+
+// gossipMessage отчёт реплики о расходе лимитов
+type gossipMessage struct {
+	From   string                 `json:"from"`
+	At     int64                  `json:"at"` // unix nano отправки
+	Limits map[string]limitReport `json:"limits"`
+}
+
+type limitReport struct {
+	RPS     float64        `json:"rps"`
+	Windows []windowReport `json:"windows,omitempty"`
+}
+
+type windowReport struct {
+	Period int64 `json:"period"` // секунды
+	Start  int64 `json:"start"`  // unix начала окна
+	Used   int   `json:"used"`
+}
+
+// gossip обмен расходом лимитов между репликами без общего хранилища.
+// Каждый interval реплика рассылает пирам свой расход по UDP, подписанный HMAC-SHA256 общим секретом,
+// и уменьшает свои лимиты на расход пиров, поэтому сумма по всем репликам приближается к лимиту.
+// Учитываются только лимиты без bucketkey и tiers
+type gossip struct {
+	conn     net.PacketConn
+	self     string
+	secret   []byte
+	interval time.Duration
+	peers    atomic.Value // peersFunc
+
+	limits   atomic.Value // []*LimitImpl
+	lastSent atomic.Int64 // unix nano прошлой рассылки
+
+	mu      sync.Mutex
+	reports map[string]*gossipMessage // последний отчёт каждого пира
+
+	done chan struct{}
+}
+
+// newGossip слушает addr и рассылает расход пирам: "host:port,host:port" или "dns:<name>:<port>"
+func newGossip(ctx context.Context, addr, peers, secret string, interval time.Duration) (*gossip, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("gossip secret is required")
+	}
+
+	if interval <= 0 {
+		interval = defaultGossipInterval
+	}
+
+	peersFn, err := parseGossipPeers(peers)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("gossip listen %s: %w", addr, err)
+	}
+
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	g := &gossip{
+		conn:     conn,
+		self:     hex.EncodeToString(id),
+		secret:   []byte(secret),
+		interval: interval,
+		reports:  make(map[string]*gossipMessage),
+		done:     make(chan struct{}),
+	}
+
+	g.peers.Store(peersFn)
+	g.limits.Store([]*LimitImpl(nil))
+	g.lastSent.Store(time.Now().UnixNano())
+
+	go g.receive(ctx)
+	go g.run(ctx)
+
+	return g, nil
+}
+
+// peersFunc возвращает адреса пиров, для DNS - при каждой рассылке
+type peersFunc func(ctx context.Context) ([]string, error)
+
+func parseGossipPeers(s string) (peersFunc, error) {
+	if rest, ok := strings.CutPrefix(s, "dns:"); ok {
+		host, port, err := net.SplitHostPort(rest)
+		if err != nil {
+			return nil, fmt.Errorf("gossip peers '%s': %w", s, err)
+		}
+
+		return func(ctx context.Context) ([]string, error) {
+			addrs, errLookup := net.DefaultResolver.LookupHost(ctx, host)
+			if errLookup != nil {
+				return nil, errLookup
+			}
+
+			for i, a := range addrs {
+				addrs[i] = net.JoinHostPort(a, port)
+			}
+
+			return addrs, nil
+		}, nil
+	}
+
+	var static []string
+	for _, peer := range strings.Split(s, ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return nil, fmt.Errorf("gossip peer '%s': %w", peer, err)
+		}
+
+		static = append(static, peer)
+	}
+
+	return func(context.Context) ([]string, error) {
+		return static, nil
+	}, nil
+}
+
+func (g *gossip) Addr() string {
+	return g.conn.LocalAddr().String()
+}
+
+func (g *gossip) Close() {
+	close(g.done)
+	_ = g.conn.Close()
+}
+
+// setLimits заменяет лимиты, расход которых рассылается, вызывается при загрузке конфигурации
+func (g *gossip) setLimits(rules *sync.Map) {
+	var limits []*LimitImpl
+	seen := make(map[*LimitImpl]bool)
+
+	rules.Range(func(_, v any) bool {
+		for lim, ok := v.(*LimitImpl); ok && lim != nil; lim = lim.parent {
+			if !seen[lim] && lim.gossip != nil {
+				seen[lim] = true
+				limits = append(limits, lim)
+			}
+		}
+
+		return true
+	})
+
+	g.limits.Store(limits)
+}
+
+func (g *gossip) run(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.done:
+			return
+
+		case now := <-ticker.C:
+			g.broadcast(ctx, now)
+			g.apply(now)
+		}
+	}
+}
+
+// broadcast рассылает расход лимитов всем пирам
+func (g *gossip) broadcast(ctx context.Context, now time.Time) {
+	limits, _ := g.limits.Load().([]*LimitImpl)
+
+	elapsed := time.Duration(now.UnixNano() - g.lastSent.Swap(now.UnixNano())).Seconds()
+
+	msg := &gossipMessage{From: g.self, At: now.UnixNano(), Limits: make(map[string]limitReport, len(limits))}
+
+	for _, lim := range limits {
+		report := limitReport{RPS: float64(lim.gossip.rps.Swap(0)) / elapsed}
+
+		for _, w := range lim.gossip.windows {
+			w.mu.Lock()
+			if w.start == now.Truncate(w.period).Unix() {
+				report.Windows = append(report.Windows, windowReport{Period: int64(w.period / time.Second), Start: w.start, Used: w.used})
+			}
+			w.mu.Unlock()
+		}
+
+		msg.Limits[lim.id] = report
+	}
+
+	packet, err := g.sign(msg)
+	if err != nil {
+		logger.Error(ctx, fmt.Sprintf("gossip: cannot encode message, error: %v", err))
+		return
+	}
+
+	peers, err := g.peers.Load().(peersFunc)(ctx)
+	if err != nil {
+		logger.Error(ctx, fmt.Sprintf("gossip: cannot resolve peers, error: %v", err))
+		return
+	}
+
+	for _, peer := range peers {
+		addr, errResolve := net.ResolveUDPAddr("udp", peer)
+		if errResolve != nil {
+			continue
+		}
+
+		_, _ = g.conn.WriteTo(packet, addr)
+	}
+}
+
+// apply уменьшает лимиты на расход пиров по их свежим отчётам
+func (g *gossip) apply(now time.Time) {
+	limits, _ := g.limits.Load().([]*LimitImpl)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for from, msg := range g.reports {
+		if now.UnixNano()-msg.At > int64(gossipTTL*g.interval) {
+			delete(g.reports, from)
+		}
+	}
+
+	for _, lim := range limits {
+		var peerRPS float64
+		peerUsed := make([]int, len(lim.gossip.windows))
+
+		for _, msg := range g.reports {
+			report, ok := msg.Limits[lim.id]
+			if !ok {
+				continue
+			}
+
+			peerRPS += report.RPS
+
+			for i, w := range lim.gossip.windows {
+				for _, wr := range report.Windows {
+					if wr.Period == int64(w.period/time.Second) && wr.Start == now.Truncate(w.period).Unix() {
+						peerUsed[i] += wr.Used
+					}
+				}
+			}
+		}
+
+		lim.applyPeerUsage(peerRPS, peerUsed)
+	}
+}
+
+// receive принимает отчёты пиров, пакеты с неверной подписью или устаревшие отбрасываются
+func (g *gossip) receive(ctx context.Context) {
+	buf := make([]byte, gossipMaxPacket)
+
+	for {
+		n, from, err := g.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-g.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		msg, err := g.verify(buf[:n], time.Now())
+		if err != nil {
+			logger.Debug(ctx, "gossip: message rejected", "from="+from.String(), "error="+err.Error())
+			continue
+		}
+
+		if msg.From == g.self {
+			continue
+		}
+
+		g.mu.Lock()
+		if prev, ok := g.reports[msg.From]; !ok || prev.At < msg.At {
+			g.reports[msg.From] = msg
+		}
+		g.mu.Unlock()
+	}
+}
+
+// sign кодирует сообщение: HMAC-SHA256 (32 байта) и JSON
+func (g *gossip) sign(msg *gossipMessage) ([]byte, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body)+sha256.Size > gossipMaxPacket {
+		return nil, fmt.Errorf("message size %d exceeds %d", len(body), gossipMaxPacket)
+	}
+
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(body)
+
+	return append(mac.Sum(nil), body...), nil
+}
+
+func (g *gossip) verify(packet []byte, now time.Time) (*gossipMessage, error) {
+	if len(packet) <= sha256.Size {
+		return nil, fmt.Errorf("packet too short")
+	}
+
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(packet[sha256.Size:])
+
+	if !hmac.Equal(mac.Sum(nil), packet[:sha256.Size]) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	msg := &gossipMessage{}
+	if err := json.Unmarshal(packet[sha256.Size:], msg); err != nil {
+		return nil, err
+	}
+
+	// повтор перехваченного пакета позже времени жизни отчёта бесполезен
+	if age := now.UnixNano() - msg.At; age > int64(gossipTTL*g.interval) || age < -int64(g.interval) {
+		return nil, fmt.Errorf("message is stale, age %s", time.Duration(age))
+	}
+
+	return msg, nil
+}
+
+// applyPeerUsage уменьшает бакеты лимита на расход пиров, лимит не опускается ниже 1
+func (li *LimitImpl) applyPeerUsage(peerRPS float64, peerUsed []int) {
+	if li.limiter != nil {
+		li.limiter.SetLimit(atLeastOne(li.Limit() - int(peerRPS+0.5)))
+	}
+
+	for i, w := range li.gossip.windows {
+		li.windows[i].SetLimit(atLeastOne(w.limit - peerUsed[i]))
+	}
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+
+	return n
+}
@@ -0,0 +1,209 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newGossipReplica(t *testing.T, limits *Limits, share *replicaShare) (*RateLimiter, *gossip) {
+	t.Helper()
+
+	g, err := newGossip(context.Background(), "127.0.0.1:0", "", "secret", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("newGossip() error: %v", err)
+	}
+
+	rl := &RateLimiter{
+		rules:    atomic.Value{},
+		gossip:   atomic.Value{},
+		replicas: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+	rl.gossip.Store(g)
+	rl.replicas.Store(share)
+	rl.hotReloadLimits(limits)
+
+	return rl, g
+}
+
+func TestGossip_Convergence(t *testing.T) {
+	// с replicaCount лимиты не делятся между репликами, иначе расход пиров вычитался бы из уже уменьшенной доли
+	for _, replicaCount := range []int{0, 3} {
+		t.Run("replicaCount="+strconv.Itoa(replicaCount), func(t *testing.T) {
+			testGossipConvergence(t, replicaCount)
+		})
+	}
+}
+
+func testGossipConvergence(t *testing.T, replicaCount int) {
+	limits := &Limits{
+		Limits: []Limit{
+			{PerMinute: 90, Rules: []Rule{{URLPathPattern: "/api/**"}}},
+		},
+	}
+
+	// окно не должно смениться посреди теста
+	if time.Now().Second() >= 55 {
+		time.Sleep(6 * time.Second)
+	}
+
+	var replicas []*RateLimiter
+	var peers []string
+	var gossips []*gossip
+
+	for i := 0; i < 3; i++ {
+		var share *replicaShare
+		if replicaCount > 0 {
+			share = &replicaShare{count: replicaCount, index: i}
+		}
+
+		rl, g := newGossipReplica(t, limits, share)
+		defer g.Close()
+
+		replicas = append(replicas, rl)
+		gossips = append(gossips, g)
+		peers = append(peers, g.Addr())
+	}
+
+	for _, g := range gossips {
+		g.peers.Store(peersFunc(func(context.Context) ([]string, error) { return peers, nil }))
+	}
+
+	serve := func(rl *RateLimiter, n int) int {
+		allowed := 0
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/api/payments", http.NoBody)
+			if rl.decide(req, nil).allow {
+				allowed++
+			}
+		}
+
+		return allowed
+	}
+
+	if got := serve(replicas[0], 60); got != 60 {
+		t.Fatalf("replica 0 allowed %d, want 60 before peers exchange usage", got)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if got := serve(replicas[1], 100); got != 30 {
+		t.Errorf("replica 1 allowed %d, want 30 left after peer usage", got)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if got := serve(replicas[0], 10); got != 0 {
+		t.Errorf("replica 0 allowed %d more, want 0: cluster limit is used up", got)
+	}
+
+	// лимит реплики не опускается ниже 1
+	if got := serve(replicas[2], 10); got > 1 {
+		t.Errorf("replica 2 allowed %d, want at most 1", got)
+	}
+}
+
+func TestGossip_verify(t *testing.T) {
+	g := &gossip{secret: []byte("secret"), interval: time.Second}
+	other := &gossip{secret: []byte("other"), interval: time.Second}
+
+	now := time.Now()
+	msg := &gossipMessage{From: "a", At: now.UnixNano(), Limits: map[string]limitReport{"x": {RPS: 5}}}
+
+	packet, err := g.sign(msg)
+	if err != nil {
+		t.Fatalf("sign() error: %v", err)
+	}
+
+	if got, errVerify := g.verify(packet, now); errVerify != nil || got.Limits["x"].RPS != 5 {
+		t.Errorf("verify() = %v, %v, want message", got, errVerify)
+	}
+
+	if _, err = other.verify(packet, now); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("verify() with other secret error = %v, want invalid signature", err)
+	}
+
+	tampered := append([]byte(nil), packet...)
+	tampered[len(tampered)-3] ^= 1
+
+	if _, err = g.verify(tampered, now); err == nil {
+		t.Error("verify() should reject tampered message")
+	}
+
+	if _, err = g.verify(packet, now.Add(gossipTTL*time.Second+time.Millisecond)); err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Errorf("verify() of replayed message error = %v, want stale", err)
+	}
+}
+
+func TestLimitImpl_applyPeerUsage(t *testing.T) {
+	li := newLimitImpl(Limit{Limit: 100, PerDay: 1000}, nil)
+	defer li.Close()
+
+	li.gossip = newGossipUsage(li)
+
+	li.applyPeerUsage(30.4, []int{400})
+
+	if got := li.limiter.Limit(); got != 70 {
+		t.Errorf("limiter.Limit() = %d, want 70", got)
+	}
+
+	if got := li.windows[0].Limit(); got != 600 {
+		t.Errorf("perday Limit() = %d, want 600", got)
+	}
+
+	li.applyPeerUsage(0, []int{0})
+
+	if got := li.limiter.Limit(); got != 100 {
+		t.Errorf("limiter.Limit() = %d, want 100 when peers are idle", got)
+	}
+}
+
+func TestGossip_skipsAdaptiveAndSchedule(t *testing.T) {
+	limits := &Limits{
+		Limits: []Limit{
+			{Limit: 10, Rules: []Rule{{URLPathPattern: "/plain"}}},
+			{Adaptive: &Adaptive{Min: 10, Max: 100}, Rules: []Rule{{URLPathPattern: "/adaptive"}}},
+			{Schedule: &Schedule{Periods: []SchedulePeriod{{Limit: 100}}}, Rules: []Rule{{URLPathPattern: "/schedule"}}},
+		},
+	}
+
+	rl, g := newGossipReplica(t, limits, &replicaShare{count: 2, index: 0})
+	defer g.Close()
+
+	rules := rl.rules.Load().(*sync.Map)
+
+	for _, tt := range []struct {
+		pattern string
+		gossip  bool
+	}{{"/plain", true}, {"/adaptive", false}, {"/schedule", false}} {
+		lim, ok := findPattern(rules, tt.pattern)
+		if !ok {
+			t.Fatalf("limit %s not found", tt.pattern)
+		}
+
+		if (lim.gossip != nil) != tt.gossip {
+			t.Errorf("%s gossip = %v, want %v", tt.pattern, lim.gossip != nil, tt.gossip)
+		}
+	}
+
+	// лимит с gossip не делится между репликами, остальные делятся
+	if lim, _ := findPattern(rules, "/plain"); lim.Limit() != 10 {
+		t.Errorf("/plain Limit() = %d, want full 10 with gossip", lim.Limit())
+	}
+
+	if lim, _ := findPattern(rules, "/adaptive"); lim.adaptive.min != 5 || lim.adaptive.max != 50 {
+		t.Errorf("/adaptive = %s, want [5, 50] split between 2 replicas", lim.adaptive)
+	}
+
+	if lim, _ := findPattern(rules, "/schedule"); lim.Limit() != 50 {
+		t.Errorf("/schedule Limit() = %d, want 50 split between 2 replicas", lim.Limit())
+	}
+}
@@ -0,0 +1,326 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
+)
+
+const (
+	defaultConfigHistorySize = 10
+
+	configPinCurrent = "current" // закрепить действующую конфигурацию
+)
+
+// configVersion принятая конфигурация: исходные значения всех слоёв
+type configVersion struct {
+	Base        string        `json:"base"`
+	Environment *keeper.Value `json:"environment"`
+	Service     *keeper.Value `json:"service"`
+	AppliedAt   time.Time     `json:"applied_at"`
+}
+
+func (v *configVersion) String() string {
+	return fmt.Sprintf("version: %d, mod_revision: %d, service version: %d, service mod_revision: %d, applied at: %s",
+		v.Environment.Version, v.Environment.ModRevision, v.Service.Version, v.Service.ModRevision, v.AppliedAt.Format(time.RFC3339))
+}
+
+// same сообщает, что конфигурации совпадают без учёта времени применения
+func (v *configVersion) same(v2 *configVersion) bool {
+	return v.Base == v2.Base && v.Environment.Equal(v2.Environment) && v.Service.Equal(v2.Service)
+}
+
+// configHistory последние принятые конфигурации, от старых к новым
+type configHistory struct {
+	mu       sync.Mutex
+	size     int
+	file     string // файл истории, сохраняется между перезапусками, "" - история только в памяти
+	versions []*configVersion
+}
+
+func newConfigHistory(size int, file string) *configHistory {
+	if size <= 0 {
+		size = defaultConfigHistorySize
+	}
+
+	return &configHistory{size: size, file: file}
+}
+
+// load читает историю из файла, отсутствие файла не ошибка
+func (h *configHistory) load() error {
+	b, err := os.ReadFile(h.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("read config history: %w", err)
+	}
+
+	var versions []*configVersion
+	if err = json.Unmarshal(b, &versions); err != nil {
+		return fmt.Errorf("unmarshal config history: %w", err)
+	}
+
+	for _, v := range versions {
+		if v.Environment == nil {
+			v.Environment = &keeper.Value{}
+		}
+
+		if v.Service == nil {
+			v.Service = &keeper.Value{}
+		}
+	}
+
+	h.mu.Lock()
+	h.setVersions(versions)
+	h.mu.Unlock()
+
+	return nil
+}
+
+// inherit переносит конфигурации прежней истории, если у новой нет файла
+func (h *configHistory) inherit(old *configHistory) {
+	if h.file != "" || old == nil {
+		return
+	}
+
+	old.mu.Lock()
+	versions := old.versions
+	old.mu.Unlock()
+
+	h.mu.Lock()
+	h.setVersions(versions)
+	h.mu.Unlock()
+}
+
+// setVersions заменяет историю, оставляя последние size конфигураций, под mu
+func (h *configHistory) setVersions(versions []*configVersion) {
+	if len(versions) > h.size {
+		versions = versions[len(versions)-h.size:]
+	}
+
+	h.versions = append([]*configVersion(nil), versions...)
+}
+
+// add добавляет конфигурацию в историю и сохраняет её в файл, если он задан
+func (h *configHistory) add(v *configVersion) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if n := len(h.versions); n > 0 && h.versions[n-1].same(v) {
+		return nil
+	}
+
+	h.setVersions(append(h.versions, v))
+
+	if h.file == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(h.versions)
+	if err != nil {
+		return fmt.Errorf("marshal config history: %w", err)
+	}
+
+	// запись через временный файл, чтобы при сбое не потерять прежнюю историю
+	tmp := h.file + ".tmp"
+	if err = os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("write config history: %w", err)
+	}
+
+	if err = os.Rename(tmp, h.file); err != nil {
+		return fmt.Errorf("rename config history: %w", err)
+	}
+
+	return nil
+}
+
+// find возвращает последнюю конфигурацию с mod_revision слоя окружения, nil - такой нет в истории
+func (h *configHistory) find(modRevision int64) *configVersion {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := len(h.versions) - 1; i >= 0; i-- {
+		if h.versions[i].Environment.ModRevision == modRevision {
+			return h.versions[i]
+		}
+	}
+
+	return nil
+}
+
+// configPin закреплённая конфигурация, пока она задана, обновления из источников не применяются
+type configPin struct {
+	spec    string // configPinCurrent или mod_revision слоя окружения
+	version *configVersion
+}
+
+// configControl значение ключа keeper keeperControlKey
+type configControl struct {
+	// Pin закрепляет конфигурацию: "current" или mod_revision слоя окружения из истории, "" - снимает закрепление
+	Pin string `json:"pin"`
+	// Canary процент клиентов, к которым применяется новая конфигурация слоя окружения, 0 - применяется ко всем сразу
+	Canary int `json:"canary"`
+	// CanaryKey ключ клиента: "ip" (по умолчанию), "header:<name>" или "claim:<name>"
+	CanaryKey string `json:"canaryKey"`
+	// Promote mod_revision канареечной конфигурации, которая применяется ко всем клиентам
+	Promote int64 `json:"promote"`
+	// Abort mod_revision канареечной конфигурации, которая отменяется и не применяется
+	Abort int64 `json:"abort"`
+}
+
+// currentVersion действующая конфигурация, под updateMu
+func (rl *RateLimiter) currentVersion() *configVersion {
+	layers := rl.layers.Load().(*configLayers)
+
+	return &configVersion{
+		Base:        layers.baseData,
+		Environment: rl.keeperSetting.Load().(*keeper.Value),
+		Service:     rl.serviceSetting.Load().(*keeper.Value),
+		AppliedAt:   time.Now(),
+	}
+}
+
+// recordVersion добавляет действующую конфигурацию в историю, под updateMu
+func (rl *RateLimiter) recordVersion(ctx context.Context) {
+	h := rl.history.Load().(*configHistory)
+
+	if err := h.add(rl.currentVersion()); err != nil {
+		logger.Error(ctx, fmt.Sprintf("cannot save config history, error: %v", err))
+	}
+}
+
+// pinned закреплённая конфигурация, nil - не закреплена
+func (rl *RateLimiter) pinned() *configPin {
+	pin, _ := rl.pin.Load().(*configPin)
+	return pin
+}
+
+// updateControl применяет команды ключа keeperControlKey. Если в нём закрепление не задано, действует configPin
+func (rl *RateLimiter) updateControl(ctx context.Context, src *sourceConfig) error {
+	var control configControl
+
+	if src.controlKey != "" {
+		kc, _ := rl.keeperClient.Load().(*keeper.KeeperClient)
+		if kc == nil {
+			return fmt.Errorf("keeper client not init, try reconfigure")
+		}
+
+		result, err := kc.GetValue(ctx, src.controlKey)
+		if err != nil {
+			return fmt.Errorf("failed to get control key from keeper, keep pin state, error: %w", err)
+		}
+
+		if result.Value != "" {
+			if err = json.Unmarshal([]byte(result.Value), &control); err != nil {
+				return fmt.Errorf("failed unmarshal control key, keep pin state, error: %w", err)
+			}
+		}
+
+	}
+
+	if control.Pin == "" {
+		control.Pin = src.pin
+	}
+
+	return errors.Join(rl.pinConfig(ctx, control.Pin), rl.updateCanary(&control))
+}
+
+// pinConfig закрепляет конфигурацию, откатываясь к ней при необходимости, пустой spec снимает закрепление
+func (rl *RateLimiter) pinConfig(ctx context.Context, spec string) error {
+	rl.updateMu.Lock()
+	defer rl.updateMu.Unlock()
+
+	current := rl.pinned()
+
+	if spec == "" {
+		if current != nil {
+			rl.pin.Store((*configPin)(nil))
+			logger.Info(ctx, "configuration pin released, updates resumed", current.version.String())
+		}
+
+		return nil
+	}
+
+	if current != nil && current.spec == spec {
+		return nil
+	}
+
+	rl.stopCanary(ctx, "configuration pinned")
+
+	var version *configVersion
+
+	if spec == configPinCurrent {
+		version = rl.currentVersion()
+
+	} else {
+		modRevision, err := strconv.ParseInt(spec, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid config pin '%s', want '%s' or mod_revision", spec, configPinCurrent)
+		}
+
+		version = rl.history.Load().(*configHistory).find(modRevision)
+		if version == nil {
+			return fmt.Errorf("mod_revision %d not found in config history", modRevision)
+		}
+
+		if err = rl.restoreVersion(ctx, version); err != nil {
+			return fmt.Errorf("cannot roll back to mod_revision %d: %w", modRevision, err)
+		}
+	}
+
+	rl.pin.Store(&configPin{spec: spec, version: version})
+
+	logger.Info(ctx, "configuration pinned, updates suspended", version.String())
+
+	return nil
+}
+
+// restoreVersion применяет конфигурацию из истории, под updateMu
+func (rl *RateLimiter) restoreVersion(ctx context.Context, v *configVersion) error {
+	layers := &configLayers{baseData: v.Base}
+
+	raw := []struct {
+		name  string
+		value string
+	}{
+		{name: layerBase, value: v.Base},
+		{name: layerEnvironment, value: v.Environment.Value},
+		{name: layerService, value: v.Service.Value},
+	}
+
+	for _, layer := range raw {
+		if layer.value == "" {
+			continue
+		}
+
+		l, err := parseLimits([]byte(layer.value))
+		if err != nil {
+			return fmt.Errorf("failed serialize %s limits: %w", layer.name, err)
+		}
+
+		layers.set(layer.name, l)
+	}
+
+	if err := rl.storeLayers(ctx, layers); err != nil {
+		return err
+	}
+
+	rl.keeperSetting.Store(v.Environment)
+	rl.serviceSetting.Store(v.Service)
+
+	logger.Info(ctx, "configuration rolled back", v.String())
+
+	rl.logWorkingLimits(ctx)
+
+	return nil
+}
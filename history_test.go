@@ -0,0 +1,205 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+)
+
+func TestConfigHistory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.json")
+
+	h := newConfigHistory(2, file)
+
+	version := func(modRevision int64, value string) *configVersion {
+		return &configVersion{
+			Environment: &keeper.Value{Value: value, Version: 1, ModRevision: modRevision},
+			Service:     &keeper.Value{},
+		}
+	}
+
+	for _, v := range []*configVersion{version(1, "a"), version(2, "b"), version(2, "b"), version(3, "c")} {
+		if err := h.add(v); err != nil {
+			t.Fatalf("add() error: %v", err)
+		}
+	}
+
+	if h.find(1) != nil {
+		t.Error("find(1) should be trimmed from history of size 2")
+	}
+
+	if v := h.find(2); v == nil || v.Environment.Value != "b" {
+		t.Errorf("find(2) = %+v, want b", v)
+	}
+
+	loaded := newConfigHistory(2, file)
+	if err := loaded.load(); err != nil {
+		t.Fatalf("load() error: %v", err)
+	}
+
+	if len(loaded.versions) != 2 || loaded.find(3) == nil {
+		t.Errorf("loaded history = %+v, want versions 2 and 3", loaded.versions)
+	}
+
+	if err := newConfigHistory(2, filepath.Join(t.TempDir(), "missing.json")).load(); err != nil {
+		t.Errorf("load() of missing file error: %v", err)
+	}
+}
+
+func TestRateLimiter_pinConfig(t *testing.T) {
+	var mu sync.Mutex
+
+	values := map[string]*keeper.Value{}
+
+	set := func(key string, v *keeper.Value) {
+		mu.Lock()
+		values[key] = v
+		mu.Unlock()
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		value, ok := values[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]
+		mu.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(value)
+	}))
+	defer srv.Close()
+
+	limits := func(limit int) *keeper.Value {
+		return &keeper.Value{
+			Value:       `{"limits": [{"id": "payments", "limit": ` + strconv.Itoa(limit) + `, "rules": [{"urlpathpattern": "/payments"}]}]}`,
+			Version:     int64(limit),
+			ModRevision: int64(limit),
+		}
+	}
+
+	ctx := context.Background()
+
+	kc := keeper.NewKeeperClient(http.DefaultClient, srv.URL, "", "ratelimits")
+
+	rl := NewRateLimiter(ctx, defaultRateLimitLimits)
+	rl.keeperClient.Store(kc)
+	rl.source.Store(&sourceConfig{name: configSourceKeeper, source: kc, controlKey: "control"})
+
+	if err := rl.loadLimits(ctx, []byte(limits(5).Value)); err != nil {
+		t.Fatalf("loadLimits() error: %v", err)
+	}
+
+	limit := func() int {
+		t.Helper()
+
+		l := rl.limits.Load().(*Limits)
+		if len(l.Limits) != 1 {
+			t.Fatalf("limits = %+v, want one limit", l.Limits)
+		}
+
+		return l.Limits[0].Limit
+	}
+
+	update := func() {
+		t.Helper()
+
+		if err := rl.updateLimits(ctx); err != nil {
+			t.Fatalf("updateLimits() error: %v", err)
+		}
+	}
+
+	set("control", &keeper.Value{Value: `{}`})
+
+	set("ratelimits", limits(1))
+	update()
+
+	set("ratelimits", limits(2))
+	update()
+
+	if got := limit(); got != 2 {
+		t.Fatalf("limit = %d, want 2", got)
+	}
+
+	// откат к версии 1, обновления из keeper не применяются
+	set("control", &keeper.Value{Value: `{"pin": "1"}`})
+	set("ratelimits", limits(3))
+	update()
+
+	if got := limit(); got != 1 {
+		t.Errorf("limit after rollback = %d, want 1", got)
+	}
+
+	// watch тоже не применяется
+	if err := rl.applyLimits(ctx, limits(4)); err != nil || limit() != 1 {
+		t.Errorf("applyLimits() while pinned = %v, limit %d, want 1", err, limit())
+	}
+
+	update()
+
+	if got := limit(); got != 1 {
+		t.Errorf("limit while pinned = %d, want 1", got)
+	}
+
+	set("control", &keeper.Value{Value: `{"pin": "9"}`})
+
+	if err := rl.updateLimits(ctx); err == nil || !strings.Contains(err.Error(), "mod_revision 9 not found") {
+		t.Errorf("updateLimits() error = %v, want unknown mod_revision", err)
+	}
+
+	if got := limit(); got != 1 || rl.pinned() == nil {
+		t.Errorf("limit after unknown pin = %d, pinned %v, want 1 and still pinned", got, rl.pinned())
+	}
+
+	// снятие закрепления возобновляет обновления
+	set("control", &keeper.Value{Value: `{"pin": ""}`})
+	update()
+
+	if got := limit(); got != 3 {
+		t.Errorf("limit after release = %d, want 3", got)
+	}
+
+	if rl.pinned() != nil {
+		t.Error("configuration should not be pinned after release")
+	}
+}
+
+func TestRateLimiter_ConfigurePinFromHistoryFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.json")
+
+	h := newConfigHistory(0, file)
+
+	err := h.add(&configVersion{
+		Base:        defaultRateLimitLimits,
+		Environment: &keeper.Value{Value: `{"limits": [{"limit": 7, "rules": [{"urlpathpattern": "/orders"}]}]}`, Version: 1, ModRevision: 42},
+		Service:     &keeper.Value{},
+	})
+	if err != nil {
+		t.Fatalf("add() error: %v", err)
+	}
+
+	ctx := context.Background()
+
+	rl := NewRateLimiter(ctx, defaultRateLimitLimits)
+	rl.Configure(ctx, &Config{KeeperReloadInterval: "1h", ConfigHistoryFile: file, ConfigPin: "42"}, nil)
+	defer rl.ticker.Load().(*time.Ticker).Stop()
+
+	l := rl.limits.Load().(*Limits)
+	if len(l.Limits) != 1 || l.Limits[0].Limit != 7 {
+		t.Errorf("limits = %+v, want pinned mod_revision 42", l.Limits)
+	}
+
+	if pin := rl.pinned(); pin == nil || pin.version.Environment.ModRevision != 42 {
+		t.Errorf("pinned = %+v, want mod_revision 42", pin)
+	}
+}
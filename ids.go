@@ -0,0 +1,108 @@
+package traefik_ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+)
+
+// idRe допустимые id: попадают в заголовки ответа, логи и ключи общего хранилища
+var idRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// validateIDs проверяет формат и уникальность заданных id лимитов и правил во всей конфигурации
+func (l *Limits) validateIDs() []string {
+	var errorMessages []string
+
+	seen := make(map[string]string) // "<kind>:<id>" -> где задан
+
+	check := func(prefix, kind, id string) {
+		if id == "" {
+			return
+		}
+
+		if !idRe.MatchString(id) {
+			errorMessages = append(errorMessages, fmt.Sprintf("%s: %s id '%s' must be 1-64 letters, digits, '.', '_' or '-'", prefix, kind, id))
+			return
+		}
+
+		if where, ok := seen[kind+":"+id]; ok {
+			errorMessages = append(errorMessages, fmt.Sprintf("%s: duplicate %s id '%s', already used in %s", prefix, kind, id, where))
+			return
+		}
+
+		seen[kind+":"+id] = prefix
+	}
+
+	var walk func(lim *Limit, prefix string)
+	walk = func(lim *Limit, prefix string) {
+		check("["+prefix+"]", "limit", lim.ID)
+
+		for j := range lim.Rules {
+			check(fmt.Sprintf("[%s, rule %d]", prefix, j), "rule", lim.Rules[j].ID)
+		}
+
+		for j := range lim.Children {
+			walk(&lim.Children[j], fmt.Sprintf("%s, child %d", prefix, j))
+		}
+	}
+
+	for i := range l.Limits {
+		walk(&l.Limits[i], fmt.Sprintf("limit %d", i))
+	}
+
+	for i := range l.Allow {
+		check(fmt.Sprintf("[allow, rule %d]", i), "rule", l.Allow[i].ID)
+	}
+
+	for i := range l.Deny {
+		check(fmt.Sprintf("[deny, rule %d]", i), "rule", l.Deny[i].ID)
+	}
+
+	return errorMessages
+}
+
+// ruleID идентификатор правила по умолчанию: хеш правила без описания и scope - id лимита, "allow" или "deny"
+func ruleID(rule Rule, scope string) string {
+	if rule.ID != "" {
+		return rule.ID
+	}
+
+	rule.Description = ""
+
+	b, _ := json.Marshal(rule)
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(scope))
+	_, _ = h.Write(b)
+
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+func withoutDescriptions(rules []Rule) []Rule {
+	if len(rules) == 0 {
+		return rules
+	}
+
+	out := make([]Rule, len(rules))
+	for i, rule := range rules {
+		rule.Description = ""
+		out[i] = rule
+	}
+
+	return out
+}
+
+// limitStateKey параметры бакетов лимита без id, описания, правил и дочерних лимитов.
+// Лимит с тем же id и теми же параметрами при перезагрузке получает состояние бакетов прошлой загрузки
+func limitStateKey(limit Limit) string {
+	limit.ID = ""
+	limit.Description = ""
+	limit.Rules = nil
+	limit.Children = nil
+
+	b, _ := json.Marshal(limit)
+
+	return string(b)
+}
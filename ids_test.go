@@ -0,0 +1,261 @@
+package traefik_ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLimits_validateIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  Limits
+		wantErr string
+	}{
+		{
+			name: "unique",
+			limits: Limits{
+				Limits: []Limit{
+					{ID: "payments", Limit: 1, Rules: []Rule{{ID: "pay", URLPathPattern: "/pay"}}, Children: []Limit{
+						{ID: "refunds", Limit: 1, Rules: []Rule{{ID: "refund", URLPathPattern: "/pay/refund"}}},
+					}},
+				},
+				Deny: []Rule{{ID: "admin", URLPathPattern: "/admin"}},
+			},
+		},
+		{
+			name: "duplicate child limit id",
+			limits: Limits{
+				Limits: []Limit{
+					{ID: "payments", Limit: 1, Children: []Limit{
+						{ID: "payments", Limit: 1, Rules: []Rule{{URLPathPattern: "/pay"}}},
+					}},
+				},
+			},
+			wantErr: "[limit 0, child 0]: duplicate limit id 'payments', already used in [limit 0]",
+		},
+		{
+			name: "duplicate rule id in deny",
+			limits: Limits{
+				Limits: []Limit{{Limit: 1, Rules: []Rule{{ID: "admin", URLPathPattern: "/admin"}}}},
+				Deny:   []Rule{{ID: "admin", URLPathPattern: "/admin"}},
+			},
+			wantErr: "[deny, rule 0]: duplicate rule id 'admin', already used in [limit 0, rule 0]",
+		},
+		{
+			name: "limit and rule may share id",
+			limits: Limits{
+				Limits: []Limit{{ID: "pay", Limit: 1, Rules: []Rule{{ID: "pay", URLPathPattern: "/pay"}}}},
+			},
+		},
+		{
+			name: "invalid id",
+			limits: Limits{
+				Limits: []Limit{{ID: "pay ments", Limit: 1, Rules: []Rule{{URLPathPattern: "/pay"}}}},
+			},
+			wantErr: "[limit 0]: limit id 'pay ments' must be 1-64 letters, digits, '.', '_' or '-'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.validate()
+
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("validate() unexpected error: %v", err)
+			}
+
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("validate() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMergeLimits_duplicateIDInLayer(t *testing.T) {
+	merged, _ := mergeLimits((&configLayers{
+		base: &Limits{Limits: []Limit{{ID: "payments", Limit: 1, Rules: []Rule{{URLPathPattern: "/pay"}}}}},
+		service: &Limits{Limits: []Limit{
+			{ID: "payments", Limit: 2, Rules: []Rule{{URLPathPattern: "/pay"}}},
+			{ID: "payments", Limit: 3, Rules: []Rule{{URLPathPattern: "/pay"}}},
+		}},
+	}).list())
+
+	if err := merged.validate(); err == nil || !strings.Contains(err.Error(), "duplicate limit id 'payments'") {
+		t.Errorf("validate() error = %v, want duplicate id within the service layer", err)
+	}
+}
+
+func TestRateLimiter_hotReloadLimits_preservesState(t *testing.T) {
+	rl := &RateLimiter{
+		rules: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+
+	decide := func(path string) decision {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+path, http.NoBody)
+		return rl.decide(req, nil)
+	}
+
+	limitFor := func(path string) *LimitImpl {
+		lim, ok := findPattern(rl.rules.Load().(*sync.Map), path)
+		if !ok {
+			t.Fatalf("no limit for %s", path)
+		}
+
+		return lim
+	}
+
+	rl.hotReloadLimits(&Limits{Limits: []Limit{
+		{ID: "payments", Description: "платежи", PerDay: 1, Rules: []Rule{{URLPathPattern: "/pay"}}},
+		{PerDay: 1, Rules: []Rule{{URLPathPattern: "/orders"}}},
+	}})
+
+	if d := decide("/pay"); !d.allow || d.rate.id != "payments" {
+		t.Fatalf("first payment: %+v, want allowed by limit payments", d)
+	}
+
+	if !decide("/orders").allow {
+		t.Fatal("first order should be allowed")
+	}
+
+	payments := limitFor("/pay")
+	if !strings.HasPrefix(payments.String(), "id: payments (платежи), limit: 0") {
+		t.Errorf("String() = %q, want id and description", payments.String())
+	}
+
+	// у лимита с id меняются правила и описание, у лимита без id ничего не меняется
+	rl.hotReloadLimits(&Limits{Limits: []Limit{
+		{PerDay: 1, Rules: []Rule{{URLPathPattern: "/orders"}}},
+		{ID: "payments", PerDay: 1, Rules: []Rule{{URLPathPattern: "/pay"}, {URLPathPattern: "/payments"}}},
+	}})
+
+	if decide("/payments").allow {
+		t.Error("limit payments should keep its exhausted bucket after reload")
+	}
+
+	if decide("/orders").allow {
+		t.Error("unchanged limit without id should keep its exhausted bucket after reload")
+	}
+
+	if payments.IsClosed() {
+		t.Error("bucket carried over to the new limit was closed")
+	}
+
+	// изменение параметров бакета создаёт новый бакет, старый закрывается
+	rl.hotReloadLimits(&Limits{Limits: []Limit{
+		{ID: "payments", PerDay: 2, Rules: []Rule{{URLPathPattern: "/pay"}}},
+	}})
+
+	if !decide("/pay").allow {
+		t.Error("limit payments with new perday should start with a fresh bucket")
+	}
+
+	if !payments.IsClosed() {
+		t.Error("replaced bucket should be closed")
+	}
+}
+
+func TestRateLimiter_hotReloadLimits_duplicatesWithoutID(t *testing.T) {
+	rl := &RateLimiter{
+		rules: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+
+	// у родителей без правил одинаковый хеш, дочерние лимиты различаются
+	limits := &Limits{Limits: []Limit{
+		{PerDay: 1, Children: []Limit{{PerDay: 5, Rules: []Rule{{URLPathPattern: "/a"}}}}},
+		{PerDay: 1, Children: []Limit{{PerDay: 5, Rules: []Rule{{URLPathPattern: "/b"}}}}},
+	}}
+
+	decide := func(path string) bool {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost"+path, http.NoBody)
+		return rl.decide(req, nil).allow
+	}
+
+	rl.hotReloadLimits(limits)
+
+	if !decide("/a") {
+		t.Fatal("first request to /a should be allowed")
+	}
+
+	for i := 0; i < 2; i++ {
+		rl.hotReloadLimits(limits)
+
+		if decide("/a") {
+			t.Errorf("reload %d: first duplicate should keep its exhausted parent bucket", i+1)
+		}
+	}
+}
+
+func TestRateLimiter_limitIDInHeadersAndStats(t *testing.T) {
+	rl := &RateLimiter{
+		rules: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+
+	rl.hotReloadLimits(&Limits{
+		Headers: true,
+		Limits: []Limit{
+			{ID: "payments", PerDay: 1, Rules: []Rule{{ID: "pay", URLPathPattern: "/pay"}}},
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/pay", http.NoBody)
+
+		d := rl.decide(req, nil)
+
+		h := http.Header{}
+		d.writeHeaders(h)
+
+		if got := h.Get("X-RateLimit-Id"); got != "payments" {
+			t.Errorf("request %d: X-RateLimit-Id = %q, want payments", i, got)
+		}
+	}
+
+	fields := rl.stats.swapLimitedByID()
+	if len(fields) != 1 || fields[0] != `limited{id="payments"}=2` {
+		t.Errorf("limited by id = %v, want payments=2", fields)
+	}
+
+	if fields = rl.stats.swapLimitedByID(); len(fields) != 0 {
+		t.Errorf("limited by id after swap = %v, want empty", fields)
+	}
+
+	var rule RuleImpl
+	rl.rules.Load().(*sync.Map).Range(func(k, _ any) bool {
+		rule = k.(RuleImpl)
+		return false
+	})
+
+	if got := rule.String(); got != "[id: pay, /pay]" {
+		t.Errorf("rule String() = %q, want id and path", got)
+	}
+}
+
+func TestRuleID(t *testing.T) {
+	rule := Rule{URLPathPattern: "/pay"}
+
+	if ruleID(rule, "a") == ruleID(rule, "b") {
+		t.Error("ruleID() should depend on scope")
+	}
+
+	described := rule
+	described.Description = "платежи"
+
+	if ruleID(rule, "a") != ruleID(described, "a") {
+		t.Error("ruleID() should not depend on description")
+	}
+
+	rule.ID = "pay"
+	if ruleID(rule, "a") != "pay" {
+		t.Error("ruleID() should return explicit id")
+	}
+}
@@ -0,0 +1,186 @@
+package bypass
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ExemptAll значение в Claims.Limits, освобождающее от всех лимитов
+const ExemptAll = "*"
+
+var (
+	ErrMalformed  = errors.New("malformed bypass token")
+	ErrUnknownKey = errors.New("unknown bypass key")
+	ErrSignature  = errors.New("invalid bypass token signature")
+	ErrExpired    = errors.New("bypass token expired")
+	ErrTTL        = errors.New("bypass token lifetime exceeds max ttl")
+)
+
+// Key ключ подписи, ID передаётся в токене, чтобы при ротации
+// одновременно принимались токены, подписанные несколькими ключами
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Claims содержимое токена
+type Claims struct {
+	// Subject кто и зачем выпустил токен, для логов
+	Subject string `json:"sub"`
+	// ExpiresAt unix время окончания действия токена, обязательно
+	ExpiresAt int64 `json:"exp"`
+	// Limits от каких лимитов освобождает токен: "*" - от всех,
+	// иначе паттерны путей правил (urlpathpattern или urlpathregex)
+	Limits []string `json:"limits"`
+}
+
+// ExemptsAll сообщает, что токен освобождает от всех лимитов
+func (c *Claims) ExemptsAll() bool {
+	for _, l := range c.Limits {
+		if l == ExemptAll {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Exempts сообщает, что токен освобождает от лимита с указанным селектором
+func (c *Claims) Exempts(selector string) bool {
+	for _, l := range c.Limits {
+		if l == ExemptAll || l == selector {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sign выпускает токен вида <key id>.<base64url(claims)>.<base64url(hmac-sha256)>
+func Sign(key Key, claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("marshal claims: %w", err)
+	}
+
+	signed := key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(key.Secret, signed)), nil
+}
+
+func sign(secret []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+
+	return mac.Sum(nil)
+}
+
+// Verifier проверяет токены набором активных ключей
+type Verifier struct {
+	keys   map[string][]byte
+	maxTTL time.Duration
+}
+
+// NewVerifier создаёт проверяющего, maxTTL > 0 ограничивает срок, на который может быть выпущен токен
+func NewVerifier(keys []Key, maxTTL time.Duration) (*Verifier, error) {
+	v := &Verifier{
+		keys:   make(map[string][]byte, len(keys)),
+		maxTTL: maxTTL,
+	}
+
+	for _, key := range keys {
+		if key.ID == "" || strings.Contains(key.ID, ".") {
+			return nil, fmt.Errorf("invalid key id '%s'", key.ID)
+		}
+
+		if len(key.Secret) == 0 {
+			return nil, fmt.Errorf("key '%s': empty secret", key.ID)
+		}
+
+		if _, ok := v.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id '%s'", key.ID)
+		}
+
+		v.keys[key.ID] = key.Secret
+	}
+
+	return v, nil
+}
+
+func (v *Verifier) Len() int {
+	return len(v.keys)
+}
+
+func (v *Verifier) Verify(token string, now time.Time) (*Claims, error) {
+	keyID, rest, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	secret, ok := v.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownKey, keyID)
+	}
+
+	gotSignature, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	if !hmac.Equal(gotSignature, sign(secret, keyID+"."+payload)) {
+		return nil, ErrSignature
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	claims := new(Claims)
+	if err = json.Unmarshal(rawClaims, claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if claims.ExpiresAt == 0 || !now.Before(expiresAt) {
+		return nil, ErrExpired
+	}
+
+	if v.maxTTL > 0 && expiresAt.Sub(now) > v.maxTTL {
+		return nil, ErrTTL
+	}
+
+	return claims, nil
+}
+
+// ParseKeys разбирает ключи из строки вида "id1:secret1,id2:secret2"
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(part, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid key, expected 'id:secret'")
+		}
+
+		keys = append(keys, Key{ID: id, Secret: []byte(secret)})
+	}
+
+	return keys, nil
+}
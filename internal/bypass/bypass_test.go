@@ -0,0 +1,143 @@
+package bypass
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifier_Verify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	oldKey := Key{ID: "k1", Secret: []byte("old-secret")}
+	newKey := Key{ID: "k2", Secret: []byte("new-secret")}
+
+	v, err := NewVerifier([]Key{oldKey, newKey}, time.Hour)
+	if err != nil {
+		t.Fatalf("NewVerifier() error: %v", err)
+	}
+
+	mustSign := func(key Key, claims Claims) string {
+		token, err := Sign(key, claims)
+		if err != nil {
+			t.Fatalf("Sign() error: %v", err)
+		}
+
+		return token
+	}
+
+	valid := Claims{Subject: "loadtest", ExpiresAt: now.Add(time.Minute).Unix(), Limits: []string{"*"}}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "old key during rotation", token: mustSign(oldKey, valid)},
+		{name: "new key during rotation", token: mustSign(newKey, valid)},
+		{
+			name:    "unknown key",
+			token:   mustSign(Key{ID: "k3", Secret: []byte("old-secret")}, valid),
+			wantErr: ErrUnknownKey,
+		},
+		{
+			name:    "forged with another secret",
+			token:   mustSign(Key{ID: "k1", Secret: []byte("guess")}, valid),
+			wantErr: ErrSignature,
+		},
+		{
+			name: "tampered claims",
+			token: func() string {
+				token := mustSign(oldKey, Claims{ExpiresAt: valid.ExpiresAt, Limits: []string{"/api"}})
+				forged := mustSign(oldKey, valid)
+				parts, forgedParts := strings.Split(token, "."), strings.Split(forged, ".")
+
+				return parts[0] + "." + forgedParts[1] + "." + parts[2]
+			}(),
+			wantErr: ErrSignature,
+		},
+		{
+			name:    "expired",
+			token:   mustSign(oldKey, Claims{ExpiresAt: now.Add(-time.Second).Unix(), Limits: []string{"*"}}),
+			wantErr: ErrExpired,
+		},
+		{
+			name:    "no expiration",
+			token:   mustSign(oldKey, Claims{Limits: []string{"*"}}),
+			wantErr: ErrExpired,
+		},
+		{
+			name:    "lifetime exceeds max ttl",
+			token:   mustSign(oldKey, Claims{ExpiresAt: now.Add(2 * time.Hour).Unix(), Limits: []string{"*"}}),
+			wantErr: ErrTTL,
+		},
+		{name: "malformed", token: "garbage", wantErr: ErrMalformed},
+		{name: "bad signature encoding", token: "k1.e30.!!!", wantErr: ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.Verify(tt.token, now)
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Verify() unexpected error: %v", err)
+			}
+
+			if claims.Subject != "loadtest" || !claims.ExemptsAll() {
+				t.Errorf("Verify() claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestClaims_Exempts(t *testing.T) {
+	c := &Claims{Limits: []string{"/api/v1/**"}}
+
+	if c.ExemptsAll() {
+		t.Error("ExemptsAll() = true, want false")
+	}
+
+	if !c.Exempts("/api/v1/**") {
+		t.Error("Exempts(listed) = false, want true")
+	}
+
+	if c.Exempts("/api/v2/**") {
+		t.Error("Exempts(not listed) = true, want false")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("k1:secret1, k2:sec:ret2")
+	if err != nil {
+		t.Fatalf("ParseKeys() error: %v", err)
+	}
+
+	if len(keys) != 2 || keys[0].ID != "k1" || string(keys[1].Secret) != "sec:ret2" {
+		t.Errorf("ParseKeys() = %+v", keys)
+	}
+
+	if _, err = ParseKeys("k1"); err == nil {
+		t.Error("ParseKeys() error = nil, want error")
+	}
+}
+
+func TestNewVerifier_Errors(t *testing.T) {
+	for _, keys := range [][]Key{
+		{{ID: "", Secret: []byte("s")}},
+		{{ID: "a.b", Secret: []byte("s")}},
+		{{ID: "k", Secret: nil}},
+		{{ID: "k", Secret: []byte("s")}, {ID: "k", Secret: []byte("s2")}},
+	} {
+		if _, err := NewVerifier(keys, 0); err == nil {
+			t.Errorf("NewVerifier(%+v) error = nil, want error", keys)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	headerXForwardedFor = "X-Forwarded-For"
+	headerXRealIP       = "X-Real-Ip"
+)
+
+// Set набор подсетей, отдельный адрес без маски считается подсетью из одного адреса
+type Set struct {
+	prefixes []netip.Prefix
+}
+
+func ParseSet(cidrs []string) (*Set, error) {
+	s := &Set{
+		prefixes: make([]netip.Prefix, 0, len(cidrs)),
+	}
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address '%s': %w", cidr, err)
+			}
+
+			s.prefixes = append(s.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %w", cidr, err)
+		}
+
+		s.prefixes = append(s.prefixes, prefix.Masked())
+	}
+
+	return s, nil
+}
+
+func (s *Set) Contains(addr netip.Addr) bool {
+	if s == nil || !addr.IsValid() {
+		return false
+	}
+
+	addr = addr.Unmap()
+	for _, prefix := range s.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Set) String() string {
+	parts := make([]string, 0, len(s.prefixes))
+	for _, prefix := range s.prefixes {
+		parts = append(parts, prefix.String())
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// Resolver определяет адрес клиента.
+// Заголовкам X-Forwarded-For и X-Real-IP верим только если запрос пришёл от доверенного прокси,
+// иначе клиент мог бы подставить в них любой адрес
+type Resolver struct {
+	trusted *Set
+	depth   int
+}
+
+// NewResolver создаёт резолвер.
+// depth > 0 - адрес клиента берётся на depth позиции с конца X-Forwarded-For (как ipStrategy.depth в traefik),
+// depth = 0 - X-Forwarded-For просматривается с конца, пропуская адреса доверенных прокси
+func NewResolver(trustedProxies []string, depth int) (*Resolver, error) {
+	if depth < 0 {
+		return nil, fmt.Errorf("depth must be >= 0, got %d", depth)
+	}
+
+	trusted, err := ParseSet(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+
+	return &Resolver{
+		trusted: trusted,
+		depth:   depth,
+	}, nil
+}
+
+// ClientIP возвращает адрес клиента или невалидный адрес, если его не удалось определить
+func (r *Resolver) ClientIP(req *http.Request) netip.Addr {
+	remote := parseAddr(req.RemoteAddr)
+
+	if r == nil || !r.trusted.Contains(remote) {
+		return remote
+	}
+
+	if xff := req.Header.Values(headerXForwardedFor); len(xff) > 0 {
+		if addr := r.fromForwardedFor(xff); addr.IsValid() {
+			return addr
+		}
+	}
+
+	if addr := parseAddr(req.Header.Get(headerXRealIP)); addr.IsValid() {
+		return addr
+	}
+
+	return remote
+}
+
+// fromForwardedFor разбирает X-Forwarded-For справа налево,
+// заголовок может быть передан несколько раз, каждый со списком адресов через запятую
+func (r *Resolver) fromForwardedFor(values []string) netip.Addr {
+	var last netip.Addr
+	hop := 0
+
+	for i := len(values) - 1; i >= 0; i-- {
+		v := values[i]
+
+		for v != "" {
+			var entry string
+
+			if idx := strings.LastIndexByte(v, ','); idx >= 0 {
+				entry, v = v[idx+1:], v[:idx]
+			} else {
+				entry, v = v, ""
+			}
+
+			addr := parseAddr(strings.TrimSpace(entry))
+			if !addr.IsValid() {
+				// мусор в цепочке, дальше доверять ей нельзя
+				return last
+			}
+
+			hop++
+			last = addr
+
+			if r.depth > 0 {
+				if hop == r.depth {
+					return addr
+				}
+
+				continue
+			}
+
+			if !r.trusted.Contains(addr) {
+				return addr
+			}
+		}
+	}
+
+	if r.depth > 0 {
+		// цепочка короче depth
+		return netip.Addr{}
+	}
+
+	// все адреса цепочки доверенные, клиентом считается самый левый
+	return last
+}
+
+// parseAddr разбирает адрес вида "ip", "ip:port" или "[ipv6]:port"
+func parseAddr(s string) netip.Addr {
+	if s == "" {
+		return netip.Addr{}
+	}
+
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap()
+	}
+
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	return addr.Unmap()
+}
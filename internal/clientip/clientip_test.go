@@ -0,0 +1,160 @@
+package clientip
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestSet_Contains(t *testing.T) {
+	s, err := ParseSet([]string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("ParseSet() error: %v", err)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "10.1.2.3", want: true},
+		{addr: "11.1.2.3", want: false},
+		{addr: "192.168.1.10", want: true},
+		{addr: "192.168.1.11", want: false},
+		{addr: "::ffff:10.1.2.3", want: true},
+		{addr: "2001:db8::1", want: true},
+		{addr: "2001:db9::1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := s.Contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSet_Errors(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0/8"} {
+		if _, err := ParseSet([]string{cidr}); err == nil {
+			t.Errorf("ParseSet(%q) error = nil, want error", cidr)
+		}
+	}
+}
+
+func TestResolver_ClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    []string
+		depth      int
+		remoteAddr string
+		xff        []string
+		xRealIP    string
+		want       string
+	}{
+		{
+			name:       "no proxies configured uses remote addr",
+			remoteAddr: "1.2.3.4:5555",
+			xff:        []string{"6.6.6.6"},
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "untrusted remote cannot spoof",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "1.2.3.4:5555",
+			xff:        []string{"6.6.6.6"},
+			xRealIP:    "7.7.7.7",
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "trusted remote uses forwarded for",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:5555",
+			xff:        []string{"1.2.3.4"},
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "spoofed left entries are skipped",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:5555",
+			xff:        []string{"6.6.6.6, 1.2.3.4, 10.0.0.2"},
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "several header lines",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:5555",
+			xff:        []string{"6.6.6.6, 1.2.3.4", "10.0.0.2"},
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "all trusted returns leftmost",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:5555",
+			xff:        []string{"10.0.0.3, 10.0.0.2"},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "garbage stops the chain",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:5555",
+			xff:        []string{"1.2.3.4, garbage, 10.0.0.2"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "depth",
+			trusted:    []string{"10.0.0.0/8"},
+			depth:      2,
+			remoteAddr: "10.0.0.1:5555",
+			xff:        []string{"6.6.6.6, 1.2.3.4, 5.5.5.5"},
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "depth longer than chain falls back to remote",
+			trusted:    []string{"10.0.0.0/8"},
+			depth:      5,
+			remoteAddr: "10.0.0.1:5555",
+			xff:        []string{"1.2.3.4"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "x-real-ip from trusted remote",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:5555",
+			xRealIP:    "1.2.3.4",
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "ipv6 remote",
+			remoteAddr: "[2001:db8::1]:443",
+			want:       "2001:db8::1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewResolver(tt.trusted, tt.depth)
+			if err != nil {
+				t.Fatalf("NewResolver() error: %v", err)
+			}
+
+			req, err := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			req.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+
+			if tt.xRealIP != "" {
+				req.Header.Set("X-Real-IP", tt.xRealIP)
+			}
+
+			if got := r.ClientIP(req); got.String() != tt.want {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
+)
+
+// defaultWait время ожидания изменения в блокирующем запросе, максимум consul - 10m
+const defaultWait = 5 * time.Minute
+
+var (
+	badStatusErr = errors.New("bad response status from consul")
+	notFoundErr  = errors.New("key not found")
+)
+
+// Client клиент consul KV (/v1/kv/<key>), изменения отслеживаются блокирующими запросами по X-Consul-Index
+type Client struct {
+	client      *http.Client
+	watchClient *http.Client // без таймаута, блокирующий запрос ждёт до wait
+	url         string
+	key         string
+	token       string
+	wait        time.Duration
+}
+
+func NewClient(cl *http.Client, url, key, token string) *Client {
+	return &Client{
+		client:      cl,
+		watchClient: &http.Client{Transport: cl.Transport},
+		url:         strings.TrimSuffix(url, "/"),
+		key:         strings.TrimPrefix(key, "/"),
+		token:       token,
+		wait:        defaultWait,
+	}
+}
+
+type kvPair struct {
+	Key         string `json:"Key"`
+	Value       []byte `json:"Value"` // base64
+	CreateIndex int64  `json:"CreateIndex"`
+	ModifyIndex int64  `json:"ModifyIndex"`
+}
+
+// value CreateIndex меняется при пересоздании ключа, ModifyIndex - при каждой записи, поэтому Value.Equal работает без изменений
+func (kv *kvPair) value() *keeper.Value {
+	return &keeper.Value{
+		Value:       string(kv.Value),
+		Version:     kv.CreateIndex,
+		ModRevision: kv.ModifyIndex,
+	}
+}
+
+// GetRateLimits возвращает текущее значение ключа
+func (c *Client) GetRateLimits(ctx context.Context) (*keeper.Value, error) {
+	kv, _, err := c.get(ctx, c.client, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return kv.value(), nil
+}
+
+// get возвращает значение ключа и X-Consul-Index. При index > 0 запрос блокируется,
+// пока индекс ключа не станет больше index или не истечёт wait
+func (c *Client) get(ctx context.Context, cl *http.Client, index int64) (*kvPair, int64, error) {
+	reqURL := c.url + "/v1/kv/" + c.key
+	if index > 0 {
+		reqURL += "?" + url.Values{
+			"index": {strconv.FormatInt(index, 10)},
+			"wait":  {c.wait.String()},
+		}.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	resp, err := cl.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("http client do fail: %w", err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	newIndex, _ := strconv.ParseInt(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, newIndex, fmt.Errorf("%w: %s", notFoundErr, c.key)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%w: status %d", badStatusErr, resp.StatusCode)
+	}
+
+	var kvs []kvPair
+	if err = json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+		return nil, 0, fmt.Errorf("cannot decode consul response: %w", err)
+	}
+
+	if len(kvs) == 0 {
+		return nil, newIndex, fmt.Errorf("%w: %s", notFoundErr, c.key)
+	}
+
+	return &kvs[0], newIndex, nil
+}
+
+// Watch передаёт в fn текущее значение и вызывает fn на каждое изменение ключа.
+// Блокируется, пока ctx не отменён или запрос не завершился ошибкой. Удаление ключа пропускается, лимиты остаются прежними
+func (c *Client) Watch(ctx context.Context, fn func(*keeper.Value)) error {
+	var index, modifyIndex int64
+
+	for {
+		kv, newIndex, err := c.get(ctx, c.watchClient, index)
+
+		switch {
+		case errors.Is(err, notFoundErr):
+			if modifyIndex != 0 {
+				logger.Warn(ctx, "consul key "+c.key+" deleted, keep current limits")
+				modifyIndex = 0
+			}
+
+		case err != nil:
+			return err
+
+		case kv.ModifyIndex != modifyIndex:
+			modifyIndex = kv.ModifyIndex
+			fn(kv.value())
+		}
+
+		switch {
+		case newIndex < index:
+			// индекс уменьшился после восстановления consul из снимка, значение перечитывается без ожидания
+			index = 0
+		case newIndex <= 0:
+			index = 1
+		default:
+			index = newIndex
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+)
+
+func TestClient_GetRateLimits(t *testing.T) {
+	srv := NewTestServer()
+	srv.Token = "secret"
+	defer srv.Close()
+
+	c := NewClient(http.DefaultClient, srv.URL, "traefik/ratelimits", "secret")
+
+	if _, err := c.GetRateLimits(context.Background()); !errors.Is(err, notFoundErr) {
+		t.Errorf("GetRateLimits() error = %v, want not found", err)
+	}
+
+	srv.Put("traefik/ratelimits", `{"limits": []}`)
+	srv.Put("other", "x")
+	srv.Put("traefik/ratelimits", `{"limits": [{}]}`)
+
+	value, err := c.GetRateLimits(context.Background())
+	if err != nil {
+		t.Fatalf("GetRateLimits() error: %v", err)
+	}
+
+	want := &keeper.Value{Value: `{"limits": [{}]}`, Version: 2, ModRevision: 4}
+	if *value != *want {
+		t.Errorf("GetRateLimits() = %+v, want %+v", value, want)
+	}
+
+	noToken := NewClient(http.DefaultClient, srv.URL, "traefik/ratelimits", "")
+	if _, err = noToken.GetRateLimits(context.Background()); !errors.Is(err, badStatusErr) {
+		t.Errorf("GetRateLimits() without token error = %v, want bad status", err)
+	}
+}
+
+func TestClient_Watch(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	srv.Put("ratelimits", "v1")
+
+	c := NewClient(http.DefaultClient, srv.URL, "ratelimits", "")
+	c.wait = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	values := make(chan *keeper.Value, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.Watch(ctx, func(v *keeper.Value) { values <- v })
+	}()
+
+	expect := func(want string) {
+		t.Helper()
+
+		select {
+		case v := <-values:
+			if v.Value != want {
+				t.Fatalf("watch value = %+v, want %s", v, want)
+			}
+
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no watch value %s", want)
+		}
+	}
+
+	expect("v1")
+
+	// истёкшее ожидание и изменение другого ключа не вызывают fn
+	time.Sleep(300 * time.Millisecond)
+	srv.Put("other", "x")
+	srv.Put("ratelimits", "v2")
+
+	expect("v2")
+
+	srv.Delete("ratelimits")
+	srv.Put("ratelimits", "v3")
+
+	expect("v3")
+
+	select {
+	case v := <-values:
+		t.Fatalf("unexpected watch value %+v", v)
+	default:
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watch() should return after context cancel")
+	}
+}
@@ -0,0 +1,127 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TestServer заглушка consul KV с блокирующими запросами и проверкой ACL токена
+type TestServer struct {
+	*httptest.Server
+
+	Token string // если задан, запросы без X-Consul-Token отклоняются с 403
+
+	mu       sync.Mutex
+	index    int64
+	kvs      map[string]*kvPair
+	watchers []chan struct{}
+}
+
+func NewTestServer() *TestServer {
+	s := &TestServer{index: 1, kvs: make(map[string]*kvPair)}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handleKV))
+
+	return s
+}
+
+// Put записывает значение ключа и будит блокирующие запросы
+func (s *TestServer) Put(key, value string) {
+	s.update(func() {
+		kv, ok := s.kvs[key]
+		if !ok {
+			kv = &kvPair{Key: key, CreateIndex: s.index}
+			s.kvs[key] = kv
+		}
+
+		kv.Value = []byte(value)
+		kv.ModifyIndex = s.index
+	})
+}
+
+// Delete удаляет ключ
+func (s *TestServer) Delete(key string) {
+	s.update(func() {
+		delete(s.kvs, key)
+	})
+}
+
+func (s *TestServer) update(fn func()) {
+	s.mu.Lock()
+
+	s.index++
+	fn()
+
+	watchers := s.watchers
+	s.watchers = nil
+
+	s.mu.Unlock()
+
+	for _, w := range watchers {
+		close(w)
+	}
+}
+
+func (s *TestServer) handleKV(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutPrefix(r.URL.Path, "/v1/kv/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if s.Token != "" && r.Header.Get("X-Consul-Token") != s.Token {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	index, _ := strconv.ParseInt(r.URL.Query().Get("index"), 10, 64)
+
+	wait := 5 * time.Minute
+	if du, err := time.ParseDuration(r.URL.Query().Get("wait")); err == nil {
+		wait = du
+	}
+
+	timeout := time.After(wait)
+
+	for {
+		s.mu.Lock()
+
+		if s.index > index {
+			kv, found := s.kvs[key]
+
+			var body []byte
+			if found {
+				body, _ = json.Marshal([]*kvPair{kv})
+			}
+
+			w.Header().Set("X-Consul-Index", strconv.FormatInt(s.index, 10))
+			s.mu.Unlock()
+
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			_, _ = w.Write(body)
+
+			return
+		}
+
+		changed := make(chan struct{})
+		s.watchers = append(s.watchers, changed)
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout:
+			index = 0 // по истечении wait consul отвечает текущим значением
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
+)
+
+var badStatusErr = errors.New("bad response status from etcd")
+
+// Client клиент etcd v3 через JSON gateway (/v3/kv/range, /v3/watch).
+// Реализован свой клиент, так как yaegi не может загрузить grpc клиент etcd
+type Client struct {
+	client      *http.Client
+	watchClient *http.Client // без таймаута, поток watch открыт долго
+	url         string
+	key         string
+}
+
+func NewClient(cl *http.Client, url, key string) *Client {
+	return &Client{
+		client:      cl,
+		watchClient: &http.Client{Transport: cl.Transport},
+		url:         strings.TrimSuffix(url, "/"),
+		key:         key,
+	}
+}
+
+// revision int64 gateway передаёт строкой
+type revision int64
+
+func (r *revision) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid revision %s: %w", string(b), err)
+	}
+
+	*r = revision(n)
+
+	return nil
+}
+
+type responseHeader struct {
+	Revision revision `json:"revision"`
+}
+
+type keyValue struct {
+	Key         []byte   `json:"key"`   // base64
+	Value       []byte   `json:"value"` // base64
+	Version     revision `json:"version"`
+	ModRevision revision `json:"mod_revision"`
+}
+
+// value Version и ModRevision keeper берёт из etcd, поэтому Value.Equal работает без изменений
+func (kv *keyValue) value() *keeper.Value {
+	return &keeper.Value{
+		Value:       string(kv.Value),
+		Version:     int64(kv.Version),
+		ModRevision: int64(kv.ModRevision),
+	}
+}
+
+type rangeResponse struct {
+	Header responseHeader `json:"header"`
+	Kvs    []keyValue     `json:"kvs"`
+}
+
+type watchResponse struct {
+	Result struct {
+		Header          responseHeader `json:"header"`
+		Created         bool           `json:"created"`
+		Canceled        bool           `json:"canceled"`
+		CancelReason    string         `json:"cancel_reason"`
+		CompactRevision revision       `json:"compact_revision"`
+		Events          []struct {
+			Type string   `json:"type"` // PUT не передаётся как значение по умолчанию
+			Kv   keyValue `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// GetRateLimits возвращает значение ключа и ревизию хранилища, с которой нужно начинать watch
+func (c *Client) GetRateLimits(ctx context.Context) (*keeper.Value, error) {
+	value, _, err := c.get(ctx)
+	return value, err
+}
+
+func (c *Client) get(ctx context.Context) (*keeper.Value, int64, error) {
+	body, _ := json.Marshal(map[string]any{"key": []byte(c.key)})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("http client do fail: %w", err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%w: status %d", badStatusErr, resp.StatusCode)
+	}
+
+	var rr rangeResponse
+	if err = json.NewDecoder(resp.Body).Decode(&rr); err != nil {
+		return nil, 0, fmt.Errorf("cannot decode etcd response: %w", err)
+	}
+
+	if len(rr.Kvs) == 0 {
+		return nil, int64(rr.Header.Revision), fmt.Errorf("key %s not found", c.key)
+	}
+
+	return rr.Kvs[0].value(), int64(rr.Header.Revision), nil
+}
+
+// Watch читает текущее значение, передаёт его в fn и вызывает fn на каждое изменение ключа.
+// Блокируется, пока ctx не отменён или поток не прервался. Удаление ключа пропускается, лимиты остаются прежними
+func (c *Client) Watch(ctx context.Context, fn func(*keeper.Value)) error {
+	value, rev, err := c.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	fn(value)
+
+	body, _ := json.Marshal(map[string]any{
+		"create_request": map[string]any{
+			"key":            []byte(c.key),
+			"start_revision": strconv.FormatInt(rev+1, 10),
+		},
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.watchClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http client do fail: %w", err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: status %d", badStatusErr, resp.StatusCode)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+
+	for {
+		var wr watchResponse
+		if err = dec.Decode(&wr); err != nil {
+			return fmt.Errorf("watch stream: %w", err)
+		}
+
+		if wr.Error != nil {
+			return fmt.Errorf("watch error: %s", wr.Error.Message)
+		}
+
+		if wr.Result.Canceled {
+			return fmt.Errorf("watch canceled: %s, compact revision %d", wr.Result.CancelReason, wr.Result.CompactRevision)
+		}
+
+		for _, ev := range wr.Result.Events {
+			if ev.Type == "DELETE" {
+				logger.Warn(ctx, "etcd key "+c.key+" deleted, keep current limits")
+				continue
+			}
+
+			fn(ev.Kv.value())
+		}
+	}
+}
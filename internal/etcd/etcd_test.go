@@ -0,0 +1,83 @@
+package etcd
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+)
+
+func TestClient_GetRateLimits(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	c := NewClient(http.DefaultClient, srv.URL, "ratelimits")
+
+	if _, err := c.GetRateLimits(context.Background()); err == nil {
+		t.Error("GetRateLimits() should fail for missing key")
+	}
+
+	srv.Put("other", "x")
+	srv.Put("ratelimits", `{"limits": []}`)
+	srv.Put("ratelimits", `{"limits": [{}]}`)
+
+	value, err := c.GetRateLimits(context.Background())
+	if err != nil {
+		t.Fatalf("GetRateLimits() error: %v", err)
+	}
+
+	want := &keeper.Value{Value: `{"limits": [{}]}`, Version: 2, ModRevision: 3}
+	if *value != *want {
+		t.Errorf("GetRateLimits() = %+v, want %+v", value, want)
+	}
+}
+
+func TestClient_Watch(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	srv.Put("ratelimits", "v1")
+
+	c := NewClient(http.DefaultClient, srv.URL, "ratelimits")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	values := make(chan *keeper.Value, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.Watch(ctx, func(v *keeper.Value) { values <- v })
+	}()
+
+	expect := func(want string, modRevision int64) {
+		t.Helper()
+
+		select {
+		case v := <-values:
+			if v.Value != want || v.ModRevision != modRevision {
+				t.Fatalf("watch value = %+v, want %s at revision %d", v, want, modRevision)
+			}
+
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no watch value %s", want)
+		}
+	}
+
+	expect("v1", 1)
+
+	srv.Put("other", "x")
+	srv.Put("ratelimits", "v2")
+
+	expect("v2", 3)
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watch() should return after context cancel")
+	}
+}
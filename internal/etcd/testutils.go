@@ -0,0 +1,143 @@
+package etcd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+)
+
+// TestServer заглушка JSON gateway etcd v3 с одним пространством ключей
+type TestServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	revision int64
+	kvs      map[string]*testKV
+	watchers []chan struct{}
+}
+
+type testKV struct {
+	value       string
+	version     int64
+	modRevision int64
+}
+
+func NewTestServer() *TestServer {
+	s := &TestServer{kvs: make(map[string]*testKV)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/kv/range", s.handleRange)
+	mux.HandleFunc("/v3/watch", s.handleWatch)
+
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Put записывает значение ключа и оповещает watch
+func (s *TestServer) Put(key, value string) {
+	s.mu.Lock()
+
+	s.revision++
+
+	kv, ok := s.kvs[key]
+	if !ok {
+		kv = &testKV{}
+		s.kvs[key] = kv
+	}
+
+	kv.value = value
+	kv.version++
+	kv.modRevision = s.revision
+
+	watchers := s.watchers
+	s.watchers = nil
+
+	s.mu.Unlock()
+
+	for _, w := range watchers {
+		close(w)
+	}
+}
+
+func (s *TestServer) handleRange(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key []byte `json:"key"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := map[string]any{"header": map[string]any{"revision": strconv.FormatInt(s.revision, 10)}}
+	if kv, ok := s.kvs[string(req.Key)]; ok {
+		resp["kvs"] = []any{kvJSON(string(req.Key), kv)}
+		resp["count"] = "1"
+	}
+
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *TestServer) handleWatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CreateRequest struct {
+			Key           []byte `json:"key"`
+			StartRevision string `json:"start_revision"`
+		} `json:"create_request"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	key := string(req.CreateRequest.Key)
+	next, _ := strconv.ParseInt(req.CreateRequest.StartRevision, 10, 64)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	_ = enc.Encode(map[string]any{"result": map[string]any{"created": true}})
+	flusher.Flush()
+
+	for {
+		s.mu.Lock()
+
+		kv, ok := s.kvs[key]
+		if ok && kv.modRevision >= next {
+			event := map[string]any{"kv": kvJSON(key, kv)}
+			next = kv.modRevision + 1
+			s.mu.Unlock()
+
+			_ = enc.Encode(map[string]any{"result": map[string]any{"events": []any{event}}})
+			flusher.Flush()
+
+			continue
+		}
+
+		changed := make(chan struct{})
+		s.watchers = append(s.watchers, changed)
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func kvJSON(key string, kv *testKV) map[string]any {
+	return map[string]any{
+		"key":          []byte(key),
+		"value":        []byte(kv.value),
+		"version":      strconv.FormatInt(kv.version, 10),
+		"mod_revision": strconv.FormatInt(kv.modRevision, 10),
+	}
+}
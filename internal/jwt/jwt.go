@@ -0,0 +1,296 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+)
+
+var (
+	ErrMalformed   = errors.New("malformed token")
+	ErrAlgorithm   = errors.New("unsupported token algorithm")
+	ErrNoKey       = errors.New("no key to verify token")
+	ErrSignature   = errors.New("invalid token signature")
+	ErrExpired     = errors.New("token expired")
+	ErrNotValidYet = errors.New("token not valid yet")
+)
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Token разобранный JWT. Разбор не проверяет подпись, см. Verifier
+type Token struct {
+	header    header
+	claims    map[string]any
+	signed    string // <header>.<payload>, от чего считается подпись
+	signature []byte
+}
+
+// Parse разбирает токен без проверки подписи
+func Parse(raw string) (*Token, error) {
+	headerPart, rest, ok := strings.Cut(raw, ".")
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	payloadPart, signaturePart, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	t := &Token{
+		signed: raw[:len(headerPart)+1+len(payloadPart)],
+	}
+
+	if err := decodePart(headerPart, &t.header); err != nil {
+		return nil, err
+	}
+
+	if err := decodePart(payloadPart, &t.claims); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(signaturePart)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	t.signature = signature
+
+	return t, nil
+}
+
+func decodePart(part string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	// числа сохраняются как json.Number, чтобы большие id не теряли точность
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	if err = dec.Decode(v); err != nil {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+// claim возвращает значение claim, вложенные объекты адресуются через точку: "org.id"
+func (t *Token) claim(name string) (any, bool) {
+	var cur any = t.claims
+
+	for name != "" {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+
+		var part string
+		part, name, _ = strings.Cut(name, ".")
+
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
+
+// Claim возвращает строковое представление claim: строки, числа и булевы значения
+func (t *Token) Claim(name string) (string, bool) {
+	v, ok := t.claim(name)
+	if !ok {
+		return "", false
+	}
+
+	return scalarString(v)
+}
+
+// ClaimMatches проверяет, что claim равен want или, если claim массив, содержит want
+func (t *Token) ClaimMatches(name, want string) bool {
+	v, ok := t.claim(name)
+	if !ok {
+		return false
+	}
+
+	if values, isArray := v.([]any); isArray {
+		for _, item := range values {
+			if s, okItem := scalarString(item); okItem && s == want {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	s, ok := scalarString(v)
+	return ok && s == want
+}
+
+func scalarString(v any) (string, bool) {
+	switch val := v.(type) {
+	case string:
+		return val, true
+	case json.Number:
+		return val.String(), true
+	case bool:
+		return strconv.FormatBool(val), true
+	}
+
+	return "", false
+}
+
+func (t *Token) numericClaim(name string) (int64, bool) {
+	v, ok := t.claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+
+	if i, err := v.Int64(); err == nil {
+		return i, true
+	}
+
+	f, err := v.Float64()
+	if err != nil {
+		return 0, false
+	}
+
+	return int64(f), true
+}
+
+// Key ключ проверки подписи. Для HS256 задаётся Secret, для RS256 PublicKey.
+// ID, если задан, сравнивается с kid из заголовка токена
+type Key struct {
+	ID        string
+	Alg       string
+	Secret    []byte
+	PublicKey *rsa.PublicKey
+}
+
+type Verifier struct {
+	keys []Key
+}
+
+func NewVerifier(keys []Key) (*Verifier, error) {
+	for _, key := range keys {
+		switch key.Alg {
+		case AlgHS256:
+			if len(key.Secret) == 0 {
+				return nil, fmt.Errorf("key '%s': empty HS256 secret", key.ID)
+			}
+		case AlgRS256:
+			if key.PublicKey == nil {
+				return nil, fmt.Errorf("key '%s': empty RS256 public key", key.ID)
+			}
+		default:
+			return nil, fmt.Errorf("key '%s': %w '%s'", key.ID, ErrAlgorithm, key.Alg)
+		}
+	}
+
+	return &Verifier{
+		keys: keys,
+	}, nil
+}
+
+// Verify проверяет подпись одним из ключей с алгоритмом из заголовка токена, а также exp и nbf.
+// Алгоритм токена должен совпадать с алгоритмом ключа, поэтому "none" и подмена RS256 на HS256 не проходят
+func (v *Verifier) Verify(t *Token, now time.Time) error {
+	if t.header.Alg != AlgHS256 && t.header.Alg != AlgRS256 {
+		return fmt.Errorf("%w '%s'", ErrAlgorithm, t.header.Alg)
+	}
+
+	verified := false
+	tried := false
+
+	for _, key := range v.keys {
+		if key.Alg != t.header.Alg || (key.ID != "" && t.header.Kid != "" && key.ID != t.header.Kid) {
+			continue
+		}
+
+		tried = true
+
+		if key.verify(t) {
+			verified = true
+			break
+		}
+	}
+
+	if !tried {
+		return ErrNoKey
+	}
+
+	if !verified {
+		return ErrSignature
+	}
+
+	if exp, ok := t.numericClaim("exp"); ok && !now.Before(time.Unix(exp, 0)) {
+		return ErrExpired
+	}
+
+	if nbf, ok := t.numericClaim("nbf"); ok && now.Before(time.Unix(nbf, 0)) {
+		return ErrNotValidYet
+	}
+
+	return nil
+}
+
+func (key *Key) verify(t *Token) bool {
+	switch key.Alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write([]byte(t.signed))
+
+		return hmac.Equal(t.signature, mac.Sum(nil))
+
+	case AlgRS256:
+		hash := sha256.Sum256([]byte(t.signed))
+
+		return rsa.VerifyPKCS1v15(key.PublicKey, crypto.SHA256, hash[:], t.signature) == nil
+	}
+
+	return false
+}
+
+// ParseRSAPublicKey разбирает публичный ключ в PEM: "PUBLIC KEY" (PKIX) или "RSA PUBLIC KEY" (PKCS#1)
+func ParseRSAPublicKey(pemData string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemData))
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM")
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %w", err)
+	}
+
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not RSA")
+	}
+
+	return rsaPub, nil
+}
@@ -0,0 +1,175 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+)
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func signHS256(t *testing.T, secret string, kid string, claims map[string]any) string {
+	t.Helper()
+
+	signed := encodeSegment(t, map[string]string{"alg": AlgHS256, "kid": kid}) + "." + encodeSegment(t, claims)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+
+	signed := encodeSegment(t, map[string]string{"alg": AlgRS256}) + "." + encodeSegment(t, claims)
+	hash := sha256.Sum256([]byte(signed))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestToken_Claims(t *testing.T) {
+	raw := signHS256(t, "secret", "", map[string]any{
+		"merchant_id": 9007199254740993, // больше 2^53, не должен терять точность
+		"tier":        "gold",
+		"roles":       []string{"payer", "admin"},
+		"org":         map[string]any{"id": "acme"},
+		"active":      true,
+	})
+
+	token, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		want   string
+		wantOk bool
+	}{
+		{name: "merchant_id", want: "9007199254740993", wantOk: true},
+		{name: "tier", want: "gold", wantOk: true},
+		{name: "org.id", want: "acme", wantOk: true},
+		{name: "active", want: "true", wantOk: true},
+		{name: "roles", wantOk: false},
+		{name: "missing", wantOk: false},
+		{name: "tier.id", wantOk: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := token.Claim(tt.name)
+			if ok != tt.wantOk || got != tt.want {
+				t.Errorf("Claim() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+
+	if !token.ClaimMatches("roles", "admin") {
+		t.Error("ClaimMatches(roles, admin) = false, want true")
+	}
+
+	if token.ClaimMatches("roles", "guest") {
+		t.Error("ClaimMatches(roles, guest) = true, want false")
+	}
+}
+
+func TestParse_Malformed(t *testing.T) {
+	for _, raw := range []string{"", "abc", "a.b", "!!!.e30.sig", "e30.!!!.sig", "e30.e30.!!!", "e30.bm90IGpzb24.sig"} {
+		if _, err := Parse(raw); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Parse(%q) error = %v, want ErrMalformed", raw, err)
+		}
+	}
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+
+	pub, err := ParseRSAPublicKey(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})))
+	if err != nil {
+		t.Fatalf("ParseRSAPublicKey() error: %v", err)
+	}
+
+	v, err := NewVerifier([]Key{
+		{ID: "hs1", Alg: AlgHS256, Secret: []byte("secret")},
+		{Alg: AlgRS256, PublicKey: pub},
+	})
+	if err != nil {
+		t.Fatalf("NewVerifier() error: %v", err)
+	}
+
+	valid := map[string]any{"exp": now.Add(time.Minute).Unix(), "tier": "gold"}
+
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr error
+	}{
+		{name: "hs256", raw: signHS256(t, "secret", "hs1", valid)},
+		{name: "hs256 without kid", raw: signHS256(t, "secret", "", valid)},
+		{name: "rs256", raw: signRS256(t, rsaKey, valid)},
+		{name: "hs256 wrong secret", raw: signHS256(t, "guess", "hs1", valid), wantErr: ErrSignature},
+		{name: "hs256 unknown kid", raw: signHS256(t, "secret", "hs2", valid), wantErr: ErrNoKey},
+		{
+			name:    "expired",
+			raw:     signHS256(t, "secret", "hs1", map[string]any{"exp": now.Add(-time.Second).Unix()}),
+			wantErr: ErrExpired,
+		},
+		{
+			name:    "not valid yet",
+			raw:     signHS256(t, "secret", "hs1", map[string]any{"nbf": now.Add(time.Minute).Unix()}),
+			wantErr: ErrNotValidYet,
+		},
+		{
+			name:    "alg none",
+			raw:     encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, valid) + ".",
+			wantErr: ErrAlgorithm,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := Parse(tt.raw)
+			if err != nil {
+				t.Fatalf("Parse() error: %v", err)
+			}
+
+			if err = v.Verify(token, now); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -53,7 +53,12 @@ func NewKeeperClient(cl *http.Client, url, settingsEndpoint, key string) *Keeper
 }
 
 func (c *KeeperClient) GetRateLimits(ctx context.Context) (*Value, error) {
-	reqURL := fmt.Sprintf("%s/%s/%s", c.url, c.settingsEndpoint, c.key)
+	return c.GetValue(ctx, c.key)
+}
+
+// GetValue возвращает значение произвольного ключа keeper
+func (c *KeeperClient) GetValue(ctx context.Context, key string) (*Value, error) {
+	reqURL := fmt.Sprintf("%s/%s/%s", c.url, c.settingsEndpoint, key)
 
 	logger.Debug(ctx, "get rate limits url: "+reqURL)
 
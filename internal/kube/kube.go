@@ -0,0 +1,302 @@
+package kube
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// watchTimeout время, после которого API закрывает поток watch, поток сразу открывается заново
+	watchTimeout = 5 * time.Minute
+)
+
+var (
+	badStatusErr = errors.New("bad response status from kubernetes api")
+	goneErr      = errors.New("resource version is too old")
+)
+
+// Client клиент API kubernetes, читает ключ ConfigMap и отслеживает изменения watch по resourceVersion.
+// Реализован свой клиент на stdlib, так как yaegi не может загрузить client-go
+type Client struct {
+	client      *http.Client
+	watchClient *http.Client // без таймаута, поток watch открыт до watchTimeout
+	url         string
+	tokenFile   string
+	namespace   string
+	name        string
+	key         string
+
+	mu   sync.Mutex
+	last *keeper.Value // последнее значение ключа, его ревизия не меняется, пока не изменилось значение
+}
+
+// NewClient клиент API по адресу url. Если tokenFile задан, токен читается из файла на каждый запрос, так как kubelet его обновляет
+func NewClient(cl *http.Client, url, tokenFile, namespace, name, key string) *Client {
+	return &Client{
+		client:      cl,
+		watchClient: &http.Client{Transport: cl.Transport},
+		url:         strings.TrimSuffix(url, "/"),
+		tokenFile:   tokenFile,
+		namespace:   namespace,
+		name:        name,
+		key:         key,
+	}
+}
+
+// NewInClusterClient клиент API кластера, в котором запущен под: адрес из KUBERNETES_SERVICE_HOST и KUBERNETES_SERVICE_PORT,
+// токен и CA service account. Если namespace не задан, используется namespace пода
+func NewInClusterClient(timeout time.Duration, namespace, name, key string) (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not in cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read service account CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in service account CA")
+	}
+
+	if namespace == "" {
+		ns, errNs := os.ReadFile(serviceAccountDir + "/namespace")
+		if errNs != nil {
+			return nil, fmt.Errorf("cannot read service account namespace: %w", errNs)
+		}
+
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+
+	cl := &http.Client{Transport: transport, Timeout: timeout}
+
+	return NewClient(cl, "https://"+net.JoinHostPort(host, port), serviceAccountDir+"/token", namespace, name, key), nil
+}
+
+type objectMeta struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type configMap struct {
+	Metadata objectMeta        `json:"metadata"`
+	Data     map[string]string `json:"data"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"` // ADDED, MODIFIED, DELETED, BOOKMARK, ERROR
+	Object json.RawMessage `json:"object"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// revision resourceVersion непрозрачная строка, на практике это ревизия etcd. Если не число - используется хеш
+func revision(rv string) int64 {
+	if n, err := strconv.ParseInt(rv, 10, 64); err == nil {
+		return n
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(rv))
+
+	return int64(h.Sum64() >> 1)
+}
+
+// GetRateLimits возвращает значение ключа ConfigMap
+func (c *Client) GetRateLimits(ctx context.Context) (*keeper.Value, error) {
+	cm, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.value(cm)
+}
+
+// value ключ ConfigMap с ревизией его последнего изменения. resourceVersion меняется при любом изменении ConfigMap,
+// поэтому при неизменном значении ключа возвращается прежняя ревизия и Value.Equal не пересоздаёт лимиты
+func (c *Client) value(cm *configMap) (*keeper.Value, error) {
+	data, ok := cm.Data[c.key]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in configmap %s/%s", c.key, c.namespace, c.name)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last == nil || c.last.Value != data {
+		c.last = &keeper.Value{Value: data, ModRevision: revision(cm.Metadata.ResourceVersion)}
+	}
+
+	return c.last, nil
+}
+
+func (c *Client) get(ctx context.Context) (*configMap, error) {
+	resp, err := c.do(ctx, c.client, fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", c.namespace, c.name))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var cm configMap
+	if err = json.NewDecoder(resp.Body).Decode(&cm); err != nil {
+		return nil, fmt.Errorf("cannot decode configmap: %w", err)
+	}
+
+	return &cm, nil
+}
+
+func (c *Client) do(ctx context.Context, cl *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if c.tokenFile != "" {
+		token, errToken := os.ReadFile(c.tokenFile)
+		if errToken != nil {
+			return nil, fmt.Errorf("cannot read token: %w", errToken)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := cl.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http client do fail: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: status %d", badStatusErr, resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+// Watch передаёт в fn текущее значение и вызывает fn на каждое изменение ключа.
+// Закрытый API поток открывается заново с последней resourceVersion. Возвращает ошибку при отмене ctx,
+// недоступности API или устаревшей resourceVersion (410 Gone). Удаление ConfigMap или ключа пропускается, лимиты остаются прежними
+func (c *Client) Watch(ctx context.Context, fn func(*keeper.Value)) error {
+	cm, err := c.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	current, err := c.value(cm)
+	if err != nil {
+		return err
+	}
+
+	fn(current)
+
+	rv := cm.Metadata.ResourceVersion
+
+	for {
+		rv, err = c.watch(ctx, rv, func(cm *configMap) {
+			value, errValue := c.value(cm)
+			if errValue != nil {
+				logger.Warn(ctx, errValue.Error()+", keep current limits")
+				return
+			}
+
+			if value != current {
+				current = value
+				fn(value)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// watch читает один поток событий и возвращает resourceVersion, с которой нужно продолжить
+func (c *Client) watch(ctx context.Context, rv string, fn func(*configMap)) (string, error) {
+	query := url.Values{
+		"watch":               {"true"},
+		"fieldSelector":       {"metadata.name=" + c.name},
+		"resourceVersion":     {rv},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {strconv.Itoa(int(watchTimeout / time.Second))},
+	}
+
+	resp, err := c.do(ctx, c.watchClient, fmt.Sprintf("/api/v1/namespaces/%s/configmaps?%s", c.namespace, query.Encode()))
+	if err != nil {
+		return rv, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	dec := json.NewDecoder(resp.Body)
+
+	for {
+		var ev watchEvent
+		if err = dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return rv, ctx.Err()
+			}
+
+			// API закрыл поток по timeoutSeconds
+			return rv, nil
+		}
+
+		if ev.Type == "ERROR" {
+			var st status
+			_ = json.Unmarshal(ev.Object, &st)
+
+			if st.Code == http.StatusGone {
+				return rv, fmt.Errorf("%w: %s", goneErr, st.Message)
+			}
+
+			return rv, fmt.Errorf("watch error: %d %s", st.Code, st.Message)
+		}
+
+		var cm configMap
+		if err = json.Unmarshal(ev.Object, &cm); err != nil {
+			return rv, fmt.Errorf("cannot decode watch event: %w", err)
+		}
+
+		rv = cm.Metadata.ResourceVersion
+
+		switch ev.Type {
+		case "BOOKMARK":
+		case "DELETED":
+			logger.Warn(ctx, fmt.Sprintf("configmap %s/%s deleted, keep current limits", c.namespace, c.name))
+		default:
+			fn(&cm)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+)
+
+func TestClient_GetRateLimits(t *testing.T) {
+	srv := NewTestServer()
+	srv.Token = "token"
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(http.DefaultClient, srv.URL, tokenFile, "ingress", "ratelimits", "limits.json")
+
+	if _, err := c.GetRateLimits(context.Background()); !errors.Is(err, badStatusErr) {
+		t.Errorf("GetRateLimits() error = %v, want bad status for missing configmap", err)
+	}
+
+	srv.Set("ratelimits", map[string]string{"limits.json": `{"limits": []}`})
+
+	value, err := c.GetRateLimits(context.Background())
+	if err != nil {
+		t.Fatalf("GetRateLimits() error: %v", err)
+	}
+
+	if want := (keeper.Value{Value: `{"limits": []}`, ModRevision: 1}); *value != want {
+		t.Errorf("GetRateLimits() = %+v, want %+v", value, want)
+	}
+
+	// изменение другого ключа не меняет ревизию
+	srv.Set("ratelimits", map[string]string{"limits.json": `{"limits": []}`, "other": "x"})
+
+	if value, err = c.GetRateLimits(context.Background()); err != nil || value.ModRevision != 1 {
+		t.Errorf("GetRateLimits() = %+v, %v, want mod_revision 1", value, err)
+	}
+
+	srv.Set("ratelimits", map[string]string{"other": "x"})
+
+	if _, err = c.GetRateLimits(context.Background()); err == nil {
+		t.Error("GetRateLimits() should fail for missing key")
+	}
+
+	noToken := NewClient(http.DefaultClient, srv.URL, "", "ingress", "ratelimits", "limits.json")
+	if _, err = noToken.GetRateLimits(context.Background()); !errors.Is(err, badStatusErr) {
+		t.Errorf("GetRateLimits() without token error = %v, want bad status", err)
+	}
+}
+
+func TestClient_Watch(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	srv.Set("ratelimits", map[string]string{"limits.json": "v1"})
+
+	c := NewClient(http.DefaultClient, srv.URL, "", "ingress", "ratelimits", "limits.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	values := make(chan *keeper.Value, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.Watch(ctx, func(v *keeper.Value) { values <- v })
+	}()
+
+	expect := func(want string, modRevision int64) {
+		t.Helper()
+
+		select {
+		case v := <-values:
+			if v.Value != want || v.ModRevision != modRevision {
+				t.Fatalf("watch value = %+v, want %s at revision %d", v, want, modRevision)
+			}
+
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no watch value %s", want)
+		}
+	}
+
+	expect("v1", 1)
+
+	srv.Set("other", map[string]string{"limits.json": "x"})
+	srv.Set("ratelimits", map[string]string{"limits.json": "v1", "other": "x"}) // ключ не изменился
+	srv.Set("ratelimits", map[string]string{"limits.json": "v2"})
+
+	expect("v2", 4)
+
+	srv.Delete("ratelimits")
+	srv.Set("ratelimits", map[string]string{"limits.json": "v3"})
+
+	expect("v3", 6)
+
+	select {
+	case v := <-values:
+		t.Fatalf("unexpected watch value %+v", v)
+	default:
+	}
+
+	srv.Compact()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, goneErr) {
+			t.Errorf("Watch() error = %v, want gone", err)
+		}
+
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watch() should return after compaction")
+	}
+}
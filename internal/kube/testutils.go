@@ -0,0 +1,173 @@
+package kube
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TestServer заглушка API kubernetes с ConfigMap одного namespace: get и watch по resourceVersion
+type TestServer struct {
+	*httptest.Server
+
+	Token string // если задан, запросы без "Authorization: Bearer <Token>" отклоняются с 401
+
+	mu        sync.Mutex
+	revision  int64
+	compacted int64 // watch с resourceVersion меньше получает 410 Gone
+	objects   map[string]*configMap
+	events    []testEvent
+	watchers  []chan struct{}
+}
+
+type testEvent struct {
+	revision int64
+	typ      string
+	object   configMap
+}
+
+func NewTestServer() *TestServer {
+	s := &TestServer{objects: make(map[string]*configMap)}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+// Set создаёт или заменяет данные ConfigMap
+func (s *TestServer) Set(name string, data map[string]string) {
+	s.update(func() {
+		typ := "MODIFIED"
+		if _, ok := s.objects[name]; !ok {
+			typ = "ADDED"
+		}
+
+		cm := &configMap{Metadata: objectMeta{Name: name, ResourceVersion: strconv.FormatInt(s.revision, 10)}, Data: data}
+		s.objects[name] = cm
+		s.events = append(s.events, testEvent{revision: s.revision, typ: typ, object: *cm})
+	})
+}
+
+// Delete удаляет ConfigMap
+func (s *TestServer) Delete(name string) {
+	s.update(func() {
+		cm, ok := s.objects[name]
+		if !ok {
+			return
+		}
+
+		delete(s.objects, name)
+
+		deleted := *cm
+		deleted.Metadata.ResourceVersion = strconv.FormatInt(s.revision, 10)
+		s.events = append(s.events, testEvent{revision: s.revision, typ: "DELETED", object: deleted})
+	})
+}
+
+// Compact удаляет историю событий, открытые watch с прежней resourceVersion получают 410 Gone
+func (s *TestServer) Compact() {
+	s.update(func() {
+		s.compacted = s.revision
+		s.events = nil
+	})
+}
+
+func (s *TestServer) update(fn func()) {
+	s.mu.Lock()
+
+	s.revision++
+	fn()
+
+	watchers := s.watchers
+	s.watchers = nil
+
+	s.mu.Unlock()
+
+	for _, w := range watchers {
+		close(w)
+	}
+}
+
+func (s *TestServer) handle(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	// api/v1/namespaces/<ns>/configmaps[/<name>]
+	if len(path) < 5 || path[0] != "api" || path[1] != "v1" || path[2] != "namespaces" || path[4] != "configmaps" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if len(path) == 6 {
+		s.mu.Lock()
+		cm, ok := s.objects[path[5]]
+		s.mu.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(cm)
+
+		return
+	}
+
+	if r.URL.Query().Get("watch") != "true" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.handleWatch(w, r, strings.TrimPrefix(r.URL.Query().Get("fieldSelector"), "metadata.name="))
+}
+
+func (s *TestServer) handleWatch(w http.ResponseWriter, r *http.Request, name string) {
+	next, _ := strconv.ParseInt(r.URL.Query().Get("resourceVersion"), 10, 64)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	for {
+		s.mu.Lock()
+
+		if next < s.compacted {
+			s.mu.Unlock()
+
+			_ = enc.Encode(map[string]any{"type": "ERROR", "object": status{Code: http.StatusGone, Message: "too old resource version"}})
+			flusher.Flush()
+
+			return
+		}
+
+		var events []testEvent
+		for _, ev := range s.events {
+			if ev.revision > next && ev.object.Metadata.Name == name {
+				events = append(events, ev)
+			}
+		}
+
+		changed := make(chan struct{})
+		s.watchers = append(s.watchers, changed)
+		s.mu.Unlock()
+
+		for _, ev := range events {
+			_ = enc.Encode(map[string]any{"type": ev.typ, "object": ev.object})
+			next = ev.revision
+		}
+
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package limiter
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// KeyedIdleTTL время простоя, после которого бакет ключа удаляется
+	KeyedIdleTTL = time.Minute
+
+	// KeyedMaxKeys наибольшее количество ключей, новые ключи сверх него делят один общий бакет
+	KeyedMaxKeys = 100000
+
+	keyedEvictPeriod = 10 * time.Second
+)
+
+// Keyed набор независимых бакетов с одинаковым лимитом, по одному на ключ
+// (например на мерчанта или клиентский IP).
+// В отличие от Limiter бакеты не имеют собственных горутин:
+// окно сбрасывается лениво при первом обращении в новом окне,
+// поэтому ключей может быть много, но не больше maxKeys: ключ может прийти из запроса,
+// и без ограничения клиент мог бы создать сколько угодно бакетов
+type Keyed struct {
+	limit    atomic.Int32
+	period   uint64       // длина окна в секундах, окна выровнены по unix времени
+	buckets  sync.Map     // string -> *keyedBucket
+	shutdown atomic.Int32 // флаг для остановки фоновой очистки
+
+	keys     atomic.Int64 // количество бакетов в buckets
+	maxKeys  int64
+	overflow keyedBucket // общий бакет ключей сверх maxKeys
+}
+
+// keyedBucket хранит в одном слове номер окна (старшие 32 бита)
+// и количество использованных в нём разрешений (младшие 32 бита),
+// что позволяет сбрасывать окно и списывать разрешения одним CAS
+type keyedBucket struct {
+	state atomic.Uint64
+}
+
+// NewKeyed создаёт бакеты с окном в одну секунду
+func NewKeyed(limit int) *Keyed {
+	return NewKeyedWindow(limit, time.Second)
+}
+
+// NewKeyedWindow создаёт бакеты с окном period (не меньше секунды), например минута или сутки.
+// Суточные окна начинаются в полночь UTC
+func NewKeyedWindow(limit int, period time.Duration) *Keyed {
+	k := &Keyed{
+		limit:    atomic.Int32{},
+		period:   uint64(period / time.Second),
+		shutdown: atomic.Int32{},
+		maxKeys:  KeyedMaxKeys,
+	}
+
+	if k.period == 0 {
+		k.period = 1
+	}
+
+	k.limit.Store(int32(limit))
+
+	go k.backgroundEvict()
+	return k
+}
+
+// backgroundEvict фон горутина для удаления бакетов неактивных ключей
+func (k *Keyed) backgroundEvict() {
+	for k.shutdown.Load() == 0 {
+		time.Sleep(keyedEvictPeriod)
+
+		// бакет удаляется, когда его окно закончилось больше KeyedIdleTTL назад,
+		// его счётчик всё равно был бы сброшен при следующем обращении
+		idleSince := uint64(time.Now().Add(-KeyedIdleTTL).Unix())
+		k.buckets.Range(func(key, value any) bool {
+			if b, ok := value.(*keyedBucket); ok && ((b.state.Load()>>32)+1)*k.period < idleSince {
+				if _, loaded := k.buckets.LoadAndDelete(key); loaded {
+					k.keys.Add(-1)
+				}
+			}
+
+			return true
+		})
+	}
+}
+
+func (k *Keyed) Close() {
+	k.shutdown.Store(1)
+}
+
+func (k *Keyed) IsClosed() bool {
+	return k.shutdown.Load() > 0
+}
+
+func (k *Keyed) Limit() int {
+	return int(k.limit.Load())
+}
+
+// SetLimit меняет лимит на лету, уже использованные в текущем окне разрешения сохраняются
+func (k *Keyed) SetLimit(limit int) {
+	k.limit.Store(int32(limit))
+}
+
+// Len возвращает количество активных ключей, без общего бакета ключей сверх KeyedMaxKeys
+func (k *Keyed) Len() int {
+	return int(k.keys.Load())
+}
+
+// bucket возвращает бакет ключа, создавая его. Если ключей уже maxKeys, новый ключ получает общий бакет
+func (k *Keyed) bucket(key string) *keyedBucket {
+	if v, ok := k.buckets.Load(key); ok {
+		return v.(*keyedBucket)
+	}
+
+	// место резервируется до вставки, чтобы параллельные вставки не превысили maxKeys
+	if k.keys.Add(1) > k.maxKeys {
+		k.keys.Add(-1)
+		return &k.overflow
+	}
+
+	v, loaded := k.buckets.LoadOrStore(key, &keyedBucket{})
+	if loaded {
+		k.keys.Add(-1)
+	}
+
+	return v.(*keyedBucket)
+}
+
+// Period возвращает длину окна
+func (k *Keyed) Period() time.Duration {
+	return time.Duration(k.period) * time.Second
+}
+
+func (k *Keyed) Allow(key string) bool {
+	_, ok := k.Take(key, 1, time.Now())
+	return ok
+}
+
+// window номер окна, в которое попадает now
+func (k *Keyed) window(now time.Time) uint64 {
+	return (uint64(now.Unix()) / k.period) & 0xffffffff
+}
+
+// ResetIn возвращает время до начала следующего окна
+func (k *Keyed) ResetIn(now time.Time) time.Duration {
+	end := time.Unix(int64((uint64(now.Unix())/k.period+1)*k.period), 0)
+	return end.Sub(now)
+}
+
+// Take атомарно списывает n разрешений из бакета ключа в окне now,
+// возвращает количество оставшихся в окне разрешений. При нехватке разрешений бакет не изменяется.
+// При нулевом лимите разрешения не считаются и остаток равен -1
+func (k *Keyed) Take(key string, n int, now time.Time) (int, bool) {
+	limit := k.limit.Load()
+	if limit <= 0 {
+		return -1, true
+	}
+
+	b := k.bucket(key)
+
+	window := k.window(now)
+	for {
+		state := b.state.Load()
+
+		used := state & 0xffffffff
+		if state>>32 != window {
+			used = 0 // новое окно, счётчик сбрасывается
+		}
+
+		remaining := int(limit) - int(used)
+		if remaining < n {
+			if remaining < 0 {
+				remaining = 0 // лимит был уменьшен в текущем окне
+			}
+
+			return remaining, false
+		}
+
+		if b.state.CompareAndSwap(state, window<<32|(used+uint64(n))) {
+			return remaining - n, true
+		}
+	}
+}
+
+// Return возвращает n разрешений, списанных Take с тем же now,
+// например когда запрос отклонён другим окном лимита.
+// Если окно уже сменилось, возвращать нечего
+func (k *Keyed) Return(key string, n int, now time.Time) {
+	// бакеты текущего окна не удаляются, поэтому ключа нет, только если Take списал из общего бакета
+	b := &k.overflow
+	if v, ok := k.buckets.Load(key); ok {
+		b = v.(*keyedBucket)
+	}
+
+	window := k.window(now)
+	for {
+		state := b.state.Load()
+
+		used := state & 0xffffffff
+		if state>>32 != window || used == 0 {
+			return
+		}
+
+		if used > uint64(n) {
+			used = uint64(n)
+		}
+
+		if b.state.CompareAndSwap(state, state-used) {
+			return
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package limiter
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyed_Allow(t *testing.T) {
+	t.Run("zero limit - all requests allow", func(t *testing.T) {
+		k := NewKeyed(0)
+		defer k.Close()
+
+		if !k.Allow("a") {
+			t.Error("Allow() should return true for zero limit")
+		}
+	})
+
+	t.Run("keys are independent", func(t *testing.T) {
+		const limit = 3
+		k := NewKeyed(limit)
+		defer k.Close()
+
+		waitSecondStart()
+
+		for _, key := range []string{"a", "b"} {
+			allowed := 0
+			for i := 0; i < limit*2; i++ {
+				if k.Allow(key) {
+					allowed++
+				}
+			}
+
+			if allowed != limit {
+				t.Errorf("key %q: got %d allowed, want %d", key, allowed, limit)
+			}
+		}
+
+		if k.Len() != 2 {
+			t.Errorf("Len() = %d, want 2", k.Len())
+		}
+	})
+
+	t.Run("window refresh", func(t *testing.T) {
+		k := NewKeyed(1)
+		defer k.Close()
+
+		waitSecondStart()
+
+		if !k.Allow("a") {
+			t.Fatal("first request should be allowed")
+		}
+
+		if k.Allow("a") {
+			t.Fatal("second request in the same second should be denied")
+		}
+
+		time.Sleep(time.Second)
+
+		if !k.Allow("a") {
+			t.Error("request in the next second should be allowed")
+		}
+	})
+}
+
+func TestKeyed_Take(t *testing.T) {
+	k := NewKeyedWindow(2, time.Minute)
+	defer k.Close()
+
+	now := time.Unix(1700000000, 0) // 22:13:20 UTC, до конца минуты 40 секунд
+
+	if remaining, ok := k.Take("a", 1, now); !ok || remaining != 1 {
+		t.Fatalf("Take() = %d, %v, want 1, true", remaining, ok)
+	}
+
+	if remaining, ok := k.Take("a", 1, now.Add(30*time.Second)); !ok || remaining != 0 {
+		t.Fatalf("Take() = %d, %v, want 0, true", remaining, ok)
+	}
+
+	if _, ok := k.Take("a", 1, now.Add(39*time.Second)); ok {
+		t.Fatal("Take() over limit in the same minute should be denied")
+	}
+
+	k.Return("a", 1, now)
+
+	if remaining, ok := k.Take("a", 1, now); !ok || remaining != 0 {
+		t.Fatalf("Take() after Return() = %d, %v, want 0, true", remaining, ok)
+	}
+
+	// возврат в уже закончившееся окно ничего не меняет
+	k.Return("a", 1, now.Add(-time.Minute))
+
+	if _, ok := k.Take("a", 1, now); ok {
+		t.Fatal("Return() for previous window should not free the current one")
+	}
+
+	if remaining, ok := k.Take("a", 1, now.Add(40*time.Second)); !ok || remaining != 1 {
+		t.Errorf("Take() in the next minute = %d, %v, want 1, true", remaining, ok)
+	}
+
+	n := NewKeyedWindow(10, time.Minute)
+	defer n.Close()
+
+	if remaining, ok := n.Take("a", 7, now); !ok || remaining != 3 {
+		t.Fatalf("Take(7) = %d, %v, want 3, true", remaining, ok)
+	}
+
+	if remaining, ok := n.Take("a", 4, now); ok || remaining != 3 {
+		t.Fatalf("Take(4) = %d, %v, want 3, false: partial debit is not allowed", remaining, ok)
+	}
+
+	n.Return("a", 5, now)
+
+	if remaining, ok := n.Take("a", 8, now); !ok || remaining != 0 {
+		t.Errorf("Take(8) after Return(5) = %d, %v, want 0, true", remaining, ok)
+	}
+
+	if got := k.ResetIn(now); got != 40*time.Second {
+		t.Errorf("ResetIn() = %v, want 40s", got)
+	}
+
+	day := NewKeyedWindow(1, 24*time.Hour)
+	defer day.Close()
+
+	if got := day.ResetIn(now); got != 1*time.Hour+46*time.Minute+40*time.Second {
+		t.Errorf("ResetIn() for day window = %v, want 1h46m40s until UTC midnight", got)
+	}
+}
+
+func TestKeyed_Allow_Concurrent(t *testing.T) {
+	const limit = 50
+	const workers = 10
+	const requestsPerWorker = 20
+
+	k := NewKeyed(limit)
+	defer k.Close()
+
+	waitSecondStart()
+
+	var allowed int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			for j := 0; j < requestsPerWorker; j++ {
+				if k.Allow(strconv.Itoa(idx % 2)) {
+					atomic.AddInt32(&allowed, 1)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if allowed > 2*limit {
+		t.Errorf("Allowed %d requests, want no more than %d", allowed, 2*limit)
+	}
+}
+
+// waitSecondStart ждёт начала следующей секунды, чтобы тест не попал на границу окна
+func waitSecondStart() {
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+}
+
+func TestKeyed_MaxKeys(t *testing.T) {
+	k := NewKeyedWindow(5, 24*time.Hour)
+	defer k.Close()
+
+	k.maxKeys = 100
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 1000; i++ {
+				if k.Allow(strconv.Itoa(g*1000 + i)) {
+					allowed.Add(1)
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+
+	stored := 0
+	k.buckets.Range(func(_, _ any) bool {
+		stored++
+		return true
+	})
+
+	if k.Len() != 100 || stored != 100 {
+		t.Errorf("Len() = %d, stored buckets = %d, want 100", k.Len(), stored)
+	}
+
+	// 100 ключей получили свой бакет, остальные 7900 делят общий бакет с тем же лимитом
+	if got := allowed.Load(); got != 100+5 {
+		t.Errorf("allowed = %d, want 105", got)
+	}
+
+	// разрешение, списанное из общего бакета, возвращается в него
+	now := time.Now()
+	if _, ok := k.Take("overflow-key", 1, now); ok {
+		t.Fatal("overflow bucket should be exhausted")
+	}
+
+	k.Return("another-overflow-key", 1, now)
+
+	if _, ok := k.Take("overflow-key", 1, now); !ok {
+		t.Error("returned permit should be available in the overflow bucket")
+	}
+}
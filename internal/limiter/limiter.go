@@ -62,12 +62,71 @@ func (l *Limiter) Limit() int {
 }
 
 func (l *Limiter) Allow() bool {
+	return l.AllowN(1)
+}
+
+// AllowN списывает n разрешений, если в текущем окне их достаточно.
+// Списание атомарно: при нехватке разрешений окно не изменяется
+func (l *Limiter) AllowN(n int) bool {
+	_, ok := l.TakeN(n)
+	return ok
+}
+
+// TakeN списывает n разрешений и возвращает количество оставшихся в текущем окне разрешений.
+// При нулевом лимите разрешения не считаются и остаток равен -1
+func (l *Limiter) TakeN(n int) (int, bool) {
 	if l.limit.Load() <= 0 {
-		return true
+		return -1, true
+	}
+
+	window := &l.windows[time.Now().Second()%WindowCount]
+	for {
+		available := window.Load()
+		if available < int32(n) {
+			return 0, false
+		}
+
+		if window.CompareAndSwap(available, available-int32(n)) {
+			return int(available) - n, true
+		}
+	}
+}
+
+// ReturnN возвращает n разрешений, списанных TakeN, например когда запрос отклонён другим лимитом.
+// Разрешения возвращаются в текущее окно, но не больше лимита
+func (l *Limiter) ReturnN(n int) {
+	limit := l.limit.Load()
+	if limit <= 0 {
+		return
+	}
+
+	window := &l.windows[time.Now().Second()%WindowCount]
+	for {
+		available := window.Load()
+
+		returned := available + int32(n)
+		if returned > limit {
+			returned = limit
+		}
+
+		if returned <= available || window.CompareAndSwap(available, returned) {
+			return
+		}
 	}
+}
 
-	currentWindow := time.Now().Second() % WindowCount
-	// уменьшаем счётчик окна и проверяем результат
-	a := l.windows[currentWindow].Add(-1) >= 0
-	return a
+// SetLimit меняет лимит на лету, например для адаптивных лимитов.
+// Окна, в которых осталось больше разрешений, чем новый лимит, урезаются сразу
+func (l *Limiter) SetLimit(limit int) {
+	limit32 := int32(limit)
+	l.limit.Store(limit32)
+
+	for i := range l.windows {
+		for {
+			available := l.windows[i].Load()
+			if available <= limit32 || l.windows[i].CompareAndSwap(available, limit32) {
+				break
+			}
+		}
+	}
 }
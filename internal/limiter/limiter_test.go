@@ -76,6 +76,60 @@ func TestLimiter_Allow_Negative(t *testing.T) {
 	})
 }
 
+func TestLimiter_AllowN(t *testing.T) {
+	l := NewLimiter(50) // в каждом окне по 10 разрешений
+	defer l.Close()
+
+	waitSecondStart()
+
+	if !l.AllowN(7) {
+		t.Fatal("AllowN(7) should be allowed")
+	}
+
+	if l.AllowN(4) {
+		t.Fatal("AllowN(4) should be denied, only 3 left")
+	}
+
+	// отказ не списывает разрешения частично
+	if !l.AllowN(3) {
+		t.Fatal("AllowN(3) should be allowed after denied AllowN(4)")
+	}
+
+	if l.Allow() {
+		t.Error("Allow() should be denied, window is exhausted")
+	}
+
+	l.ReturnN(4)
+
+	if !l.AllowN(4) {
+		t.Error("AllowN(4) should be allowed after ReturnN(4)")
+	}
+}
+
+func TestLimiter_SetLimit(t *testing.T) {
+	l := NewLimiter(50)
+	defer l.Close()
+
+	waitSecondStart()
+
+	l.SetLimit(3)
+
+	if l.Limit() != 3 {
+		t.Fatalf("Limit() = %d, want 3", l.Limit())
+	}
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if l.Allow() {
+			allowed++
+		}
+	}
+
+	if allowed != 3 {
+		t.Errorf("allowed %d requests after SetLimit(3), want 3", allowed)
+	}
+}
+
 func TestLimiter_Allow_Concurrent(t *testing.T) {
 	const limit = 100
 	const workers = 10
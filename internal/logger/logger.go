@@ -63,6 +63,15 @@ func (l *Logger) SetLevel(level Level) {
 	l.level = level
 }
 
+// Enabled сообщает, будет ли записано сообщение уровня level,
+// позволяет не собирать поля для отключенного уровня
+func (l *Logger) Enabled(level Level) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return level >= l.level
+}
+
 func (l *Logger) log(level Level, msg string, fields ...string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -145,6 +154,10 @@ func SetDebug(ctx context.Context, debug bool) {
 	}
 }
 
+func DebugEnabled(ctx context.Context) bool {
+	return FromCtx(ctx).Enabled(LevelDebug)
+}
+
 func Debug(ctx context.Context, msg string, fields ...string) {
 	FromCtx(ctx).Debug(msg, fields...)
 }
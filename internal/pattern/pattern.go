@@ -2,12 +2,16 @@ package pattern
 
 import (
 	"bytes"
+	"fmt"
 )
 
 const (
 	typeVal = iota
 	typeAny
 	typeEnd
+	typeParam
+	typeAnyMulti
+	typeGlob
 )
 
 type Pattern struct {
@@ -17,18 +21,21 @@ type Pattern struct {
 }
 type patternPart struct {
 	pos   int
-	typ   int8   // typeAny=`*`, typeEnd=`$`, typeVal=все остальное
-	value []byte // `*`, `other$` или часть пути(прим.: otherpart)
+	typ   int8   // typeAny=`*`, typeAnyMulti=`**`, typeGlob=`v*`, typeEnd=`$`, typeParam=`{name}`, typeVal=все остальное
+	value []byte // `*`, `other$`, имя параметра, глоб или часть пути(прим.: otherpart)
 }
 
-func NewPattern(pattern string) *Pattern {
+// NewPattern разбирает паттерн пути.
+// Поддерживаются элементы: литерал, `*` (ровно один элемент пути), `**` (ноль и более элементов),
+// глоб внутри элемента (`v*`, `*.json`), именованный параметр `{name}` и `$` в конце паттерна
+func NewPattern(pattern string) (*Pattern, error) {
 	bytesPattern := []byte(pattern)
 
 	if pattern == "" {
 		return &Pattern{
 			value:  bytesPattern,
 			prefix: bytesPattern,
-		}
+		}, nil
 	}
 
 	patternParts := bytes.Split(bytesPattern, []byte("/"))
@@ -37,14 +44,46 @@ func NewPattern(pattern string) *Pattern {
 	for i, part := range patternParts {
 		var typ int8 = typeVal
 		var newPart = part
-		if bytes.Equal(part, []byte("*")) {
-			typ = typeAny
 
-		} else if bytes.HasSuffix(part, []byte("$")) {
-			newPart = bytes.TrimSuffix(part, []byte("$"))
+		if idx := bytes.IndexByte(part, '$'); idx >= 0 {
+			if i != len(patternParts)-1 || idx != len(part)-1 {
+				return nil, fmt.Errorf("pattern '%s': '$' is allowed only at the end of the pattern", pattern)
+			}
+
+			newPart = part[:idx]
 			typ = typeEnd
 		}
 
+		switch {
+		case bytes.Equal(newPart, []byte("**")):
+			if typ == typeEnd {
+				return nil, fmt.Errorf("pattern '%s': '**' cannot be followed by '$'", pattern)
+			}
+
+			if len(pp) > 0 && pp[len(pp)-1].typ == typeAnyMulti {
+				return nil, fmt.Errorf("pattern '%s': consecutive '**' segments", pattern)
+			}
+
+			typ = typeAnyMulti
+
+		case bytes.Contains(newPart, []byte("**")):
+			return nil, fmt.Errorf("pattern '%s': '**' must be a whole path segment", pattern)
+
+		case bytes.Equal(newPart, []byte("*")):
+			typ = typeAny
+
+		case bytes.ContainsAny(newPart, "{}"):
+			if !isParam(newPart) {
+				return nil, fmt.Errorf("pattern '%s': malformed path param '%s'", pattern, newPart)
+			}
+
+			newPart = newPart[1 : len(newPart)-1]
+			typ = typeParam
+
+		case bytes.IndexByte(newPart, '*') >= 0:
+			typ = typeGlob
+		}
+
 		pp = append(pp, patternPart{
 			pos:   i,
 			typ:   typ,
@@ -52,11 +91,16 @@ func NewPattern(pattern string) *Pattern {
 		})
 	}
 
+	prefix := []byte("/")
+	if pp[0].typ == typeVal {
+		prefix = append(prefix, pp[0].value...)
+	}
+
 	return &Pattern{
 		value:        bytesPattern,
-		prefix:       append([]byte("/"), patternParts[0]...),
+		prefix:       prefix,
 		patternParts: pp,
-	}
+	}, nil
 }
 
 func (p *Pattern) String() string {
@@ -72,35 +116,159 @@ func (p *Pattern) Match(urlPath []byte) bool {
 		return false
 	}
 
-	// ручной перебор, для исключения аллокация
-	partStart := 0
-	partNum := 0
-	for i := 0; i <= len(urlPath); i++ {
-		if i == len(urlPath) || urlPath[i] == '/' {
-			if partNum >= len(p.patternParts) {
-				return false
+	ok, _, _ := p.matchFrom(0, urlPath, 0, -1)
+	return ok
+}
+
+// matchFrom сопоставляет части паттерна начиная с partNum с путём начиная с позиции partStart,
+// partStart > len(urlPath) означает что элементы пути закончились.
+// Для части с индексом capture возвращаются границы совпавшего элемента пути.
+// Ручной перебор без аллокаций, `**` обрабатывается рекурсивно с возвратом
+func (p *Pattern) matchFrom(partNum int, urlPath []byte, partStart int, capture int) (bool, int, int) {
+	capStart, capEnd := -1, -1
+
+	for partNum < len(p.patternParts) {
+		pp := p.patternParts[partNum]
+
+		if partStart > len(urlPath) {
+			if pp.typ == typeAnyMulti {
+				partNum++
+				continue
 			}
 
-			part := urlPath[partStart:i]
-			pp := p.patternParts[partNum]
+			return false, -1, -1
+		}
 
-			switch pp.typ {
-			case typeVal:
-				if !bytes.Equal(part, pp.value) {
-					return false
-				}
-			case typeEnd:
-				if !bytes.Equal(part, pp.value) {
-					return false
+		partEnd := bytes.IndexByte(urlPath[partStart:], '/')
+		if partEnd < 0 {
+			partEnd = len(urlPath)
+		} else {
+			partEnd += partStart
+		}
+
+		if pp.typ == typeAnyMulti {
+			// сначала пробуем `**` как ноль элементов, затем поглощаем очередной элемент пути
+			if ok, s, e := p.matchFrom(partNum+1, urlPath, partStart, capture); ok {
+				if capStart < 0 {
+					capStart, capEnd = s, e
 				}
-			case typeAny:
-				// * matches anything
+
+				return true, capStart, capEnd
 			}
 
-			partNum++
-			partStart = i + 1
+			partStart = partEnd + 1
+			continue
+		}
+
+		if !pp.matchPart(urlPath[partStart:partEnd]) {
+			return false, -1, -1
+		}
+
+		if partNum == capture {
+			capStart, capEnd = partStart, partEnd
+		}
+
+		partNum++
+		partStart = partEnd + 1
+	}
+
+	if partStart <= len(urlPath) {
+		return false, -1, -1
+	}
+
+	return true, capStart, capEnd
+}
+
+func (pp *patternPart) matchPart(part []byte) bool {
+	switch pp.typ {
+	case typeVal, typeEnd:
+		return bytes.Equal(part, pp.value)
+	case typeGlob:
+		return matchGlob(pp.value, part)
+	}
+
+	// * и {name} matches anything
+	return true
+}
+
+// matchGlob сопоставляет элемент пути с глобом, где `*` - любая последовательность символов
+func matchGlob(glob, part []byte) bool {
+	gi, pi := 0, 0
+	starGi, starPi := -1, 0
+
+	for pi < len(part) {
+		switch {
+		case gi < len(glob) && glob[gi] == '*':
+			starGi, starPi = gi, pi
+			gi++
+		case gi < len(glob) && glob[gi] == part[pi]:
+			gi++
+			pi++
+		case starGi >= 0:
+			// откатываемся к последней `*` и поглощаем ею ещё один символ
+			starPi++
+			gi, pi = starGi+1, starPi
+		default:
+			return false
+		}
+	}
+
+	for gi < len(glob) && glob[gi] == '*' {
+		gi++
+	}
+
+	return gi == len(glob)
+}
+
+// isParam проверяет что часть паттерна является именованным параметром вида {name}
+func isParam(part []byte) bool {
+	if len(part) < 3 || part[0] != '{' || part[len(part)-1] != '}' {
+		return false
+	}
+
+	for _, c := range part[1 : len(part)-1] {
+		if !(c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Names возвращает имена параметров паттерна в порядке их следования
+func (p *Pattern) Names() []string {
+	var names []string
+
+	for _, pp := range p.patternParts {
+		if pp.typ == typeParam {
+			names = append(names, string(pp.value))
+		}
+	}
+
+	return names
+}
+
+// Param возвращает значение именованного параметра из пути запроса.
+// Путь должен соответствовать паттерну, см. Match.
+// Возвращаемый срез ссылается на urlPath, аллокаций нет
+func (p *Pattern) Param(urlPath []byte, name string) ([]byte, bool) {
+	capture := -1
+
+	for i, pp := range p.patternParts {
+		if pp.typ == typeParam && string(pp.value) == name {
+			capture = i
+			break
 		}
 	}
 
-	return partNum == len(p.patternParts)
+	if capture < 0 {
+		return nil, false
+	}
+
+	ok, start, end := p.matchFrom(0, urlPath, 0, capture)
+	if !ok || start < 0 {
+		return nil, false
+	}
+
+	return urlPath[start:end], true
 }
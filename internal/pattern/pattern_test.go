@@ -126,10 +126,109 @@ func TestPattern_Match(t *testing.T) {
 			urlPath:    []byte("/merchant/01/user/123456789/transaction/abcd-1234-efjk-5678/payment"),
 			want:       false,
 		},
+		{
+			name:       "contains param:positive",
+			patternStr: "/merchants/{merchantId}/payments",
+			urlPath:    []byte("/merchants/42/payments"),
+			want:       true,
+		},
+		{
+			name:       "contains param:negative",
+			patternStr: "/merchants/{merchantId}/payments",
+			urlPath:    []byte("/merchants/42/refunds"),
+			want:       false,
+		},
+		{
+			name:       "multi any:zero segments",
+			patternStr: "/api/**/payments",
+			urlPath:    []byte("/api/payments"),
+			want:       true,
+		},
+		{
+			name:       "multi any:several segments",
+			patternStr: "/api/**/payments",
+			urlPath:    []byte("/api/v2/merchants/42/payments"),
+			want:       true,
+		},
+		{
+			name:       "multi any:negative",
+			patternStr: "/api/**/payments",
+			urlPath:    []byte("/api/v2/merchants/42/refunds"),
+			want:       false,
+		},
+		{
+			name:       "multi any:trailing",
+			patternStr: "/static/**",
+			urlPath:    []byte("/static/css/app.css"),
+			want:       true,
+		},
+		{
+			name:       "multi any:trailing zero segments",
+			patternStr: "/static/**",
+			urlPath:    []byte("/static"),
+			want:       true,
+		},
+		{
+			name:       "multi any:backtracking",
+			patternStr: "/a/**/b/c",
+			urlPath:    []byte("/a/b/x/b/c"),
+			want:       true,
+		},
+		{
+			name:       "multi any:two wildcards",
+			patternStr: "/**/users/**/pay$",
+			urlPath:    []byte("/v1/users/1/2/pay"),
+			want:       true,
+		},
+		{
+			name:       "glob:prefix positive",
+			patternStr: "/api/v*/users",
+			urlPath:    []byte("/api/v2/users"),
+			want:       true,
+		},
+		{
+			name:       "glob:prefix negative",
+			patternStr: "/api/v*/users",
+			urlPath:    []byte("/api/beta/users"),
+			want:       false,
+		},
+		{
+			name:       "glob:suffix positive",
+			patternStr: "/reports/*.json",
+			urlPath:    []byte("/reports/daily.json"),
+			want:       true,
+		},
+		{
+			name:       "glob:suffix negative",
+			patternStr: "/reports/*.json",
+			urlPath:    []byte("/reports/daily.csv"),
+			want:       false,
+		},
+		{
+			name:       "glob:does not cross segments",
+			patternStr: "/reports/*.json",
+			urlPath:    []byte("/reports/2024/daily.json"),
+			want:       false,
+		},
+		{
+			name:       "glob:middle with end",
+			patternStr: "/files/a*b*c$",
+			urlPath:    []byte("/files/axxbyyc"),
+			want:       true,
+		},
+		{
+			name:       "any and end:positive",
+			patternStr: "/images/*$",
+			urlPath:    []byte("/images/photo.jpg"),
+			want:       true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			p := NewPattern(tt.patternStr)
+			p, err := NewPattern(tt.patternStr)
+			if err != nil {
+				t.Fatalf("NewPattern() error: %v", err)
+			}
 
 			if got := p.Match(tt.urlPath); got != tt.want {
 				t.Errorf("Match() = %v, want %v", got, tt.want)
@@ -138,6 +237,147 @@ func TestPattern_Match(t *testing.T) {
 	}
 }
 
+func TestPattern_Param(t *testing.T) {
+	tests := []struct {
+		name       string
+		patternStr string
+		urlPath    []byte
+		param      string
+		want       string
+		wantOk     bool
+	}{
+		{
+			name:       "single param",
+			patternStr: "/merchants/{merchantId}/payments",
+			urlPath:    []byte("/merchants/42/payments"),
+			param:      "merchantId",
+			want:       "42",
+			wantOk:     true,
+		},
+		{
+			name:       "second param",
+			patternStr: "/merchants/{merchantId}/users/{userId}",
+			urlPath:    []byte("/merchants/42/users/7"),
+			param:      "userId",
+			want:       "7",
+			wantOk:     true,
+		},
+		{
+			name:       "last segment",
+			patternStr: "/users/{userId}",
+			urlPath:    []byte("/users/abc-1"),
+			param:      "userId",
+			want:       "abc-1",
+			wantOk:     true,
+		},
+		{
+			name:       "param after multi any",
+			patternStr: "/api/**/merchants/{merchantId}",
+			urlPath:    []byte("/api/v2/internal/merchants/42"),
+			param:      "merchantId",
+			want:       "42",
+			wantOk:     true,
+		},
+		{
+			name:       "param before multi any",
+			patternStr: "/merchants/{merchantId}/**",
+			urlPath:    []byte("/merchants/42/users/7/payments"),
+			param:      "merchantId",
+			want:       "42",
+			wantOk:     true,
+		},
+		{
+			name:       "path does not match",
+			patternStr: "/merchants/{merchantId}/payments",
+			urlPath:    []byte("/merchants/42/refunds"),
+			param:      "merchantId",
+			wantOk:     false,
+		},
+		{
+			name:       "unknown param",
+			patternStr: "/merchants/{merchantId}",
+			urlPath:    []byte("/merchants/42"),
+			param:      "userId",
+			wantOk:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPattern(tt.patternStr)
+			if err != nil {
+				t.Fatalf("NewPattern() error: %v", err)
+			}
+
+			got, ok := p.Param(tt.urlPath, tt.param)
+			if ok != tt.wantOk {
+				t.Fatalf("Param() ok = %v, want %v", ok, tt.wantOk)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("Param() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPattern_Errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		patternStr string
+	}{
+		{name: "end in the middle", patternStr: "/api$/users"},
+		{name: "end inside segment", patternStr: "/api/us$ers"},
+		{name: "multi any with end", patternStr: "/api/**$"},
+		{name: "consecutive multi any", patternStr: "/api/**/**/users"},
+		{name: "multi any inside segment", patternStr: "/api/v**/users"},
+		{name: "malformed param", patternStr: "/merchants/{merchant id}"},
+		{name: "unclosed param", patternStr: "/merchants/{merchantId"},
+		{name: "param inside segment", patternStr: "/merchants/m{merchantId}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPattern(tt.patternStr); err == nil {
+				t.Errorf("NewPattern(%q) error = nil, want error", tt.patternStr)
+			}
+		})
+	}
+}
+
+func TestPattern_Names(t *testing.T) {
+	p, err := NewPattern("/merchants/{merchantId}/users/*/{userId}")
+	if err != nil {
+		t.Fatalf("NewPattern() error: %v", err)
+	}
+
+	names := p.Names()
+	if len(names) != 2 || names[0] != "merchantId" || names[1] != "userId" {
+		t.Errorf("Names() = %v, want [merchantId userId]", names)
+	}
+}
+
+func TestPattern_MatchNoAllocs(t *testing.T) {
+	literal, _ := NewPattern("/api/v1/merchants/payments")
+	param, _ := NewPattern("/api/v1/merchants/{merchantId}/payments")
+	multi, _ := NewPattern("/api/**/*.json")
+
+	literalPath := []byte("/api/v1/merchants/payments")
+	paramPath := []byte("/api/v1/merchants/42/payments")
+	multiPath := []byte("/api/v1/reports/daily.json")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		literal.Match(literalPath)
+		param.Match(paramPath)
+		param.Param(paramPath, "merchantId")
+		multi.Match(multiPath)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Match allocates %v times, want 0", allocs)
+	}
+}
+
 //go test -bench=. -benchmem ./internal/pattern
 //goos: darwin
 //goarch: arm64
@@ -169,6 +409,8 @@ func BenchmarkPatternMatch(b *testing.B) {
 		{"ComplexPath_Regexp", "^/api/[^/]+/resource/[^/]+$", "/api/v1/resource/123", true},
 		{"EndAnchor_Custom", "/images/*$", "/images/photo.jpg", false},
 		{"EndAnchor_Regexp", "^/images/.+$", "/images/photo.jpg", true},
+		{"MultiAny_Custom", "/api/**/resource/*.json", "/api/v1/internal/resource/123.json", false},
+		{"MultiAny_Regexp", "^/api/(?:[^/]+/)*resource/[^/]*\\.json$", "/api/v1/internal/resource/123.json", true},
 	}
 
 	customPatterns := make(map[string]*Pattern)
@@ -176,7 +418,7 @@ func BenchmarkPatternMatch(b *testing.B) {
 
 	for _, bb := range benchmarks {
 		if !bb.useRegexp {
-			customPatterns[bb.name] = NewPattern(bb.pattern)
+			customPatterns[bb.name], _ = NewPattern(bb.pattern)
 		} else {
 			regexPatterns[bb.name] = regexp.MustCompile(bb.pattern)
 		}
@@ -0,0 +1,267 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const defaultPoolSize = 16
+
+// Error ответ-ошибка сервера, например "ERR unknown command"
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Client минимальный клиент протокола RESP2 (Redis, Valkey, KeyDB).
+// Реализован свой клиент, так как yaegi не может загрузить сторонние клиенты
+type Client struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	pool chan *conn // свободные соединения
+}
+
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+func NewClient(addr, password string, db int, timeout time.Duration) *Client {
+	return &Client{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+		pool:     make(chan *conn, defaultPoolSize),
+	}
+}
+
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Do выполняет команды одним запросом (pipeline) и возвращает ответы в том же порядке.
+// Ответ - string, int64, nil, []any или Error. Ошибка возвращается только при сбое соединения
+func (c *Client) Do(ctx context.Context, cmds ...[]string) ([]any, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	replies, err := cn.do(deadline, cmds)
+	if err != nil {
+		_ = cn.nc.Close()
+		return nil, err
+	}
+
+	c.put(cn)
+
+	return replies, nil
+}
+
+// Close закрывает свободные соединения, занятые закрываются при возврате
+func (c *Client) Close() {
+	for {
+		select {
+		case cn := <-c.pool:
+			_ = cn.nc.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (c *Client) get() (*conn, error) {
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", c.addr, err)
+	}
+
+	cn := &conn{
+		nc: nc,
+		r:  bufio.NewReader(nc),
+		w:  bufio.NewWriter(nc),
+	}
+
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+
+	if len(setup) == 0 {
+		return cn, nil
+	}
+
+	replies, err := cn.do(time.Now().Add(c.timeout), setup)
+	if err == nil {
+		for _, reply := range replies {
+			if e, ok := reply.(Error); ok {
+				err = e
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		_ = nc.Close()
+		return nil, fmt.Errorf("setup connection to %s: %w", c.addr, err)
+	}
+
+	return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+	select {
+	case c.pool <- cn:
+	default:
+		_ = cn.nc.Close()
+	}
+}
+
+func (cn *conn) do(deadline time.Time, cmds [][]string) ([]any, error) {
+	if err := cn.nc.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range cmds {
+		writeCommand(cn.w, cmd)
+	}
+
+	if err := cn.w.Flush(); err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+
+	replies := make([]any, len(cmds))
+	for i := range cmds {
+		reply, err := ReadReply(cn.r)
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		}
+
+		replies[i] = reply
+	}
+
+	return replies, nil
+}
+
+// writeCommand пишет команду массивом bulk-строк
+func writeCommand(w *bufio.Writer, args []string) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(len(args)))
+	w.WriteString("\r\n")
+
+	for _, arg := range args {
+		w.WriteByte('$')
+		w.WriteString(strconv.Itoa(len(arg)))
+		w.WriteString("\r\n")
+		w.WriteString(arg)
+		w.WriteString("\r\n")
+	}
+}
+
+var errProtocol = errors.New("resp: protocol error")
+
+// ReadReply читает один ответ, используется и клиентом, и тестовым сервером для чтения команд
+func ReadReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, errProtocol
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return Error(line[1:]), nil
+
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, errProtocol
+		}
+
+		return n, nil
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, errProtocol
+		}
+
+		if n == -1 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		return string(buf[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, errProtocol
+		}
+
+		if n == -1 {
+			return nil, nil
+		}
+
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = ReadReply(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return items, nil
+	}
+
+	return nil, errProtocol
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errProtocol
+	}
+
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,84 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "simple string", input: "+OK\r\n", want: "string OK"},
+		{name: "error", input: "-ERR wrong type\r\n", want: "resp.Error ERR wrong type"},
+		{name: "integer", input: ":42\r\n", want: "int64 42"},
+		{name: "bulk", input: "$5\r\nhe\r\nl\r\n", want: "string he\r\nl"},
+		{name: "nil bulk", input: "$-1\r\n", want: "<nil> <nil>"},
+		{name: "array", input: "*2\r\n:1\r\n$1\r\na\r\n", want: "[]interface {} [1 a]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := ReadReply(bufio.NewReader(strings.NewReader(tt.input)))
+			if err != nil {
+				t.Fatalf("ReadReply() error: %v", err)
+			}
+
+			got := fmt.Sprintf("%T %v", reply, reply)
+			if got != tt.want {
+				t.Errorf("ReadReply() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	for _, input := range []string{"?x\r\n", ":1\n", "$3\r\nab", ":x\r\n"} {
+		if _, err := ReadReply(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("ReadReply(%q) should fail", input)
+		}
+	}
+}
+
+func TestClient_Do(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.Close()
+
+	c := NewClient(srv.Addr(), "secret", 1, time.Second)
+	defer c.Close()
+
+	ctx := context.Background()
+
+	replies, err := c.Do(ctx,
+		[]string{"INCRBY", "k", "5"},
+		[]string{"PEXPIRE", "k", "1000"},
+		[]string{"INCRBY", "k", "2"},
+		[]string{"NOPE"},
+	)
+	if err != nil {
+		t.Fatalf("Do() error: %v", err)
+	}
+
+	if replies[0] != int64(5) || replies[1] != int64(1) || replies[2] != int64(7) {
+		t.Errorf("Do() = %v, want [5 1 7 ...]", replies)
+	}
+
+	if _, ok := replies[3].(Error); !ok {
+		t.Errorf("unknown command reply = %v, want Error", replies[3])
+	}
+
+	// соединение переиспользуется из пула
+	if replies, err = c.Do(ctx, []string{"GET", "k"}); err != nil || replies[0] != "7" {
+		t.Errorf("Do(GET) = %v, %v, want 7", replies, err)
+	}
+
+	srv.Close()
+
+	if _, err = c.Do(ctx, []string{"PING"}); err == nil {
+		t.Error("Do() should fail when server is down")
+	}
+}
@@ -0,0 +1,193 @@
+package resp
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TestServer хранилище в памяти, понимающее команды, нужные лимитеру
+type TestServer struct {
+	ln net.Listener
+
+	mu     sync.Mutex
+	data   map[string]int64
+	expire map[string]time.Time
+	conns  map[net.Conn]struct{}
+	calls  int
+}
+
+func NewTestServer() *TestServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("resp: test server listen: " + err.Error())
+	}
+
+	s := &TestServer{
+		ln:     ln,
+		data:   make(map[string]int64),
+		expire: make(map[string]time.Time),
+		conns:  make(map[net.Conn]struct{}),
+	}
+
+	go s.serve()
+
+	return s
+}
+
+func (s *TestServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Calls количество выполненных команд
+func (s *TestServer) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls
+}
+
+// Get значение счётчика, 0 если ключа нет
+func (s *TestServer) Get(key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data[key]
+}
+
+// Close останавливает сервер и разрывает соединения
+func (s *TestServer) Close() {
+	_ = s.ln.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+func (s *TestServer) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		go s.handle(c)
+	}
+}
+
+func (s *TestServer) handle(c net.Conn) {
+	defer func() {
+		_ = c.Close()
+
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+
+	for {
+		req, err := ReadReply(r)
+		if err != nil {
+			return
+		}
+
+		items, _ := req.([]any)
+
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+
+		w.WriteString(s.exec(args))
+
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *TestServer) exec(args []string) string {
+	if len(args) == 0 {
+		return "-ERR empty command\r\n"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+		if at, ok := s.expire[key]; ok && !time.Now().Before(at) {
+			delete(s.data, key)
+			delete(s.expire, key)
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+
+	case "INCRBY":
+		if len(args) != 3 {
+			return "-ERR wrong number of arguments\r\n"
+		}
+
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+
+		s.data[key] += n
+
+		return ":" + strconv.FormatInt(s.data[key], 10) + "\r\n"
+
+	case "PEXPIRE":
+		if len(args) != 3 {
+			return "-ERR wrong number of arguments\r\n"
+		}
+
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+
+		if _, ok := s.data[key]; !ok {
+			return ":0\r\n"
+		}
+
+		s.expire[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+
+		return ":1\r\n"
+
+	case "GET":
+		v, ok := s.data[key]
+		if !ok {
+			return "$-1\r\n"
+		}
+
+		str := strconv.FormatInt(v, 10)
+
+		return "$" + strconv.Itoa(len(str)) + "\r\n" + str + "\r\n"
+	}
+
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
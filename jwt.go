@@ -0,0 +1,146 @@
+package traefik_ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/jwt"
+)
+
+const defaultJWTHeader = "Authorization"
+
+// jwtSettings скомпилированные настройки JWT
+type jwtSettings struct {
+	header   string
+	verifier *jwt.Verifier // nil, если проверка подписи выключена
+}
+
+func (j *JWT) verifier() (*jwt.Verifier, error) {
+	if !j.Verify {
+		return nil, nil
+	}
+
+	if len(j.Keys) == 0 {
+		return nil, fmt.Errorf("verify is enabled but no keys specified")
+	}
+
+	keys := make([]jwt.Key, 0, len(j.Keys))
+
+	for i, k := range j.Keys {
+		key := jwt.Key{
+			ID:     k.ID,
+			Alg:    strings.ToUpper(k.Alg),
+			Secret: []byte(k.Secret),
+		}
+
+		if key.Alg == jwt.AlgRS256 {
+			pub, err := jwt.ParseRSAPublicKey(k.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("key %d: %w", i, err)
+			}
+
+			key.PublicKey = pub
+		}
+
+		keys = append(keys, key)
+	}
+
+	return jwt.NewVerifier(keys)
+}
+
+func newJWTSettings(j *JWT) *jwtSettings {
+	settings := &jwtSettings{
+		header: defaultJWTHeader,
+	}
+
+	if j == nil {
+		return settings
+	}
+
+	if j.Header != "" {
+		settings.header = http.CanonicalHeaderKey(j.Header)
+	}
+
+	// ошибки уже проверены в validate
+	settings.verifier, _ = j.verifier()
+
+	return settings
+}
+
+// token разбирает JWT из запроса, nil - токена нет или он не прошёл проверку
+func (s *jwtSettings) token(req *http.Request) *jwt.Token {
+	raw := req.Header.Get(s.header)
+	if raw == "" {
+		return nil
+	}
+
+	if len(raw) > 7 && strings.EqualFold(raw[:7], "bearer ") {
+		raw = strings.TrimSpace(raw[7:])
+	}
+
+	token, err := jwt.Parse(raw)
+	if err != nil {
+		return nil
+	}
+
+	if s.verifier != nil {
+		if err = s.verifier.Verify(token, time.Now()); err != nil {
+			return nil
+		}
+	}
+
+	return token
+}
+
+type claimPair struct {
+	name string
+	val  string
+}
+
+// claimsMatcher условия правила на claims JWT, должны совпасть все
+type claimsMatcher struct {
+	pairs []claimPair
+}
+
+func newClaimsMatcher(claims map[string]string) *claimsMatcher {
+	m := &claimsMatcher{
+		pairs: make([]claimPair, 0, len(claims)),
+	}
+
+	for name, val := range claims {
+		m.pairs = append(m.pairs, claimPair{name: name, val: val})
+	}
+
+	// порядок мапы случайный, сортируем для стабильного вывода в лог
+	sort.Slice(m.pairs, func(i, j int) bool {
+		return m.pairs[i].name < m.pairs[j].name
+	})
+
+	return m
+}
+
+func (m *claimsMatcher) Match(token *jwt.Token) bool {
+	if token == nil {
+		return false
+	}
+
+	for _, p := range m.pairs {
+		if !token.ClaimMatches(p.name, p.val) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *claimsMatcher) String() string {
+	parts := make([]string, 0, len(m.pairs))
+	for _, p := range m.pairs {
+		parts = append(parts, p.name+"="+p.val)
+	}
+
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,144 @@
+package traefik_ratelimit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testJWT(t *testing.T, secret string, claims map[string]any) string {
+	t.Helper()
+
+	segment := func(v any) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+
+	signed := segment(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + segment(claims)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestRateLimiter_Allow_JWT(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+
+	gold := testJWT(t, "secret", map[string]any{"merchant_id": 1, "tier": "gold", "exp": exp})
+	free1 := testJWT(t, "secret", map[string]any{"merchant_id": 1, "tier": "free", "exp": exp})
+	free2 := testJWT(t, "secret", map[string]any{"merchant_id": 2, "tier": "free", "exp": exp})
+	forged := testJWT(t, "guess", map[string]any{"merchant_id": 3, "tier": "free", "exp": exp})
+
+	newRateLimiter := func(jwtCfg *JWT) *RateLimiter {
+		rl := &RateLimiter{
+			rules: atomic.Value{},
+		}
+
+		rl.rules.Store(&sync.Map{})
+
+		rl.hotReloadLimits(&Limits{
+			JWT: jwtCfg,
+			Limits: []Limit{
+				{
+					Limit:     1,
+					BucketKey: "claim:merchant_id",
+					Rules:     []Rule{{URLPathPattern: "/api/**", Claims: map[string]string{"tier": "free"}}},
+				},
+			},
+		})
+
+		return rl
+	}
+
+	allow := func(rl *RateLimiter, token string) bool {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost/api/payments", http.NoBody)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		return rl.Allow(req)
+	}
+
+	t.Run("parse only", func(t *testing.T) {
+		rl := newRateLimiter(nil)
+
+		for i := 0; i < 3; i++ {
+			if !allow(rl, gold) {
+				t.Fatal("gold tier does not match the rule and should not be limited")
+			}
+		}
+
+		if !allow(rl, free1) {
+			t.Error("first request of merchant 1 should be allowed")
+		}
+
+		if allow(rl, free1) {
+			t.Error("second request of merchant 1 should be limited")
+		}
+
+		if !allow(rl, free2) {
+			t.Error("first request of merchant 2 should be allowed")
+		}
+
+		if !allow(rl, forged) {
+			t.Error("first request of merchant 3 should be allowed")
+		}
+
+		if allow(rl, forged) {
+			t.Error("unverified token should still be parsed and limited")
+		}
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		rl := newRateLimiter(&JWT{Verify: true, Keys: []JWTKey{{Alg: "HS256", Secret: "secret"}}})
+
+		if !allow(rl, free1) {
+			t.Error("first request of merchant 1 should be allowed")
+		}
+
+		if allow(rl, free1) {
+			t.Error("second request of merchant 1 should be limited")
+		}
+
+		for i := 0; i < 3; i++ {
+			if !allow(rl, forged) {
+				t.Fatal("forged token should be ignored and the rule should not match")
+			}
+		}
+	})
+}
+
+func TestRequestInfo_jwtTokenCached(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/", http.NoBody)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+testJWT(t, "secret", map[string]any{"tier": "gold"}))
+
+	ri := &requestInfo{req: req, jwt: newJWTSettings(nil)}
+
+	first := ri.jwtToken()
+	if first == nil {
+		t.Fatal("token should be parsed")
+	}
+
+	req.Header.Del("Authorization")
+
+	if ri.jwtToken() != first {
+		t.Error("token should be parsed once per request")
+	}
+}
@@ -0,0 +1,237 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
+)
+
+// слои конфигурации в порядке возрастания приоритета
+const (
+	layerBase        = "base"        // ratelimitData
+	layerEnvironment = "environment" // ключ источника configSource, для keeper - keeperRateLimitKey
+	layerService     = "service"     // ключ keeper keeperServiceKey
+)
+
+// configLayers конфигурации слоёв, nil - слой не загружен
+type configLayers struct {
+	base        *Limits
+	environment *Limits
+	service     *Limits
+
+	baseData string // исходный json базового слоя для истории конфигураций
+}
+
+// list слои в порядке возрастания приоритета
+func (cl *configLayers) list() []configLayer {
+	return []configLayer{
+		{name: layerBase, limits: cl.base},
+		{name: layerEnvironment, limits: cl.environment},
+		{name: layerService, limits: cl.service},
+	}
+}
+
+func (cl *configLayers) set(name string, l *Limits) {
+	switch name {
+	case layerBase:
+		cl.base = l
+	case layerEnvironment:
+		cl.environment = l
+	case layerService:
+		cl.service = l
+	}
+}
+
+type configLayer struct {
+	name   string
+	limits *Limits
+}
+
+// mergeLimits объединяет слои, старший слой имеет приоритет:
+//   - лимит с id заменяет лимит с тем же id младшего слоя на его месте, новые лимиты и лимиты без id добавляются в конец;
+//   - clientip, bypass, jwt, denystatus и matchpolicy берутся из старшего слоя, где они заданы;
+//   - allow и deny всех слоёв объединяются, headers включается любым слоем.
+//
+// Возвращает также происхождение каждого лимита для лога
+func mergeLimits(layers []configLayer) (*Limits, []string) {
+	merged := &Limits{}
+
+	var origins [][]string // слои каждого лимита, первый - действующий
+	index := make(map[string]int)
+
+	for _, layer := range layers {
+		l := layer.limits
+		if l == nil {
+			continue
+		}
+
+		inLayer := make(map[string]bool)
+
+		for _, limit := range l.Limits {
+			// повтор id в одном слое не заменяет лимит, а попадает в объединённую конфигурацию и отклоняется проверкой
+			if i, ok := index[limit.ID]; ok && limit.ID != "" && !inLayer[limit.ID] {
+				merged.Limits[i] = limit
+				origins[i] = append([]string{layer.name}, origins[i]...)
+				inLayer[limit.ID] = true
+
+				continue
+			}
+
+			if limit.ID != "" && !inLayer[limit.ID] {
+				index[limit.ID] = len(merged.Limits)
+				inLayer[limit.ID] = true
+			}
+
+			merged.Limits = append(merged.Limits, limit)
+			origins = append(origins, []string{layer.name})
+		}
+
+		if l.ClientIP != nil {
+			merged.ClientIP = l.ClientIP
+		}
+
+		if l.Bypass != nil {
+			merged.Bypass = l.Bypass
+		}
+
+		if l.JWT != nil {
+			merged.JWT = l.JWT
+		}
+
+		if l.DenyStatus != 0 {
+			merged.DenyStatus = l.DenyStatus
+		}
+
+		if l.MatchPolicy != "" {
+			merged.MatchPolicy = l.MatchPolicy
+		}
+
+		merged.Headers = merged.Headers || l.Headers
+		merged.Allow = append(merged.Allow, l.Allow...)
+		merged.Deny = append(merged.Deny, l.Deny...)
+	}
+
+	provenance := make([]string, len(merged.Limits))
+	for i, limit := range merged.Limits {
+		id := limit.ID
+		if id == "" {
+			id = "-"
+		}
+
+		provenance[i] = fmt.Sprintf("[ limit %d, id: %s, layer: %s", i, id, origins[i][0])
+		if len(origins[i]) > 1 {
+			provenance[i] += ", overrides: " + strings.Join(origins[i][1:], ", ")
+		}
+
+		provenance[i] += " ]"
+	}
+
+	return merged, provenance
+}
+
+// parseLimits разбирает конфигурацию слоя, проверяется только объединённая конфигурация
+func parseLimits(b []byte) (*Limits, error) {
+	var l Limits
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, fmt.Errorf("unmarshal error: %w", err)
+	}
+
+	return &l, nil
+}
+
+// layerSetting версия загруженного значения слоя
+func (rl *RateLimiter) layerSetting(name string) *atomic.Value {
+	if name == layerService {
+		return &rl.serviceSetting
+	}
+
+	return &rl.keeperSetting
+}
+
+// applyLayer загружает конфигурацию слоя, если её версия изменилась, и применяет объединённую конфигурацию
+func (rl *RateLimiter) applyLayer(ctx context.Context, name string, result *keeper.Value) error {
+	if result == nil || result.Value == "" {
+		return fmt.Errorf("empty %s result from config source", name)
+	}
+
+	logDebugJSON(ctx, result.Value)
+
+	// опрос и watch могут применять конфигурацию одновременно
+	rl.updateMu.Lock()
+	defer rl.updateMu.Unlock()
+
+	if pin := rl.pinned(); pin != nil {
+		logger.Debug(ctx, fmt.Sprintf("configuration pinned, skip %s update", name), pin.version.String())
+		return nil
+	}
+
+	setting := rl.layerSetting(name)
+
+	settings, ok := setting.Load().(*keeper.Value)
+	if !ok {
+		return fmt.Errorf("cannot type assert *keeper.Value")
+	}
+	if settings == nil {
+		return fmt.Errorf("settings is nil")
+	}
+
+	if name == layerEnvironment {
+		if handled, err := rl.applyCanary(ctx, settings, result); handled {
+			return err
+		}
+	}
+
+	if settings.Equal(result) {
+		logger.Info(ctx, fmt.Sprintf("no update, use %s configuration: version: %d, mod_revision: %d", name, settings.Version, settings.ModRevision))
+		return nil
+	}
+
+	logger.Debug(ctx, fmt.Sprintf("old %s configuration: version: %d, mod_revision: %d", name, settings.Version, settings.ModRevision))
+
+	l, err := parseLimits([]byte(result.Value))
+	if err != nil {
+		return fmt.Errorf("failed serialize %s limits: %w", name, err)
+	}
+
+	layers := *rl.layers.Load().(*configLayers)
+	layers.set(name, l)
+
+	if err = rl.storeLayers(ctx, &layers); err != nil {
+		return err
+	}
+
+	setting.Store(result)
+
+	logger.Info(ctx, fmt.Sprintf("new %s configuration loaded: version: %d, mod_revision: %d", name, result.Version, result.ModRevision))
+
+	rl.recordVersion(ctx)
+
+	rl.logWorkingLimits(ctx)
+
+	return nil
+}
+
+// storeLayers проверяет объединённую конфигурацию слоёв и применяет её
+func (rl *RateLimiter) storeLayers(ctx context.Context, layers *configLayers) error {
+	merged, provenance := mergeLimits(layers.list())
+
+	if err := merged.validate(); err != nil {
+		return fmt.Errorf("failed validate merged limits: %w", err)
+	}
+
+	rl.layers.Store(layers)
+	rl.limits.Store(merged)
+
+	rl.hotReloadLimits(merged)
+
+	logger.Info(ctx, "merged configuration", provenance...)
+
+	rl.reloadCanary(ctx)
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+)
+
+func TestMergeLimits(t *testing.T) {
+	base := &Limits{
+		Limits: []Limit{
+			{ID: "payments", Limit: 10, Rules: []Rule{{URLPathPattern: "/payments"}}},
+			{Limit: 5, Rules: []Rule{{URLPathPattern: "/health"}}},
+			{ID: "users", Limit: 20, Rules: []Rule{{URLPathPattern: "/users"}}},
+		},
+		DenyStatus: 429,
+		Deny:       []Rule{{URLPathPattern: "/admin"}},
+	}
+
+	environment := &Limits{
+		Limits: []Limit{
+			{ID: "payments", Limit: 100, Rules: []Rule{{URLPathPattern: "/payments"}}},
+			{ID: "orders", Limit: 30, Rules: []Rule{{URLPathPattern: "/orders"}}},
+		},
+		MatchPolicy: matchPolicyFirst,
+	}
+
+	service := &Limits{
+		Limits: []Limit{
+			{ID: "payments", Limit: 1000, Rules: []Rule{{URLPathPattern: "/payments"}}},
+		},
+		Deny:    []Rule{{URLPathPattern: "/debug"}},
+		Headers: true,
+	}
+
+	merged, provenance := mergeLimits((&configLayers{base: base, environment: environment, service: service}).list())
+
+	var got []int
+	for _, limit := range merged.Limits {
+		got = append(got, limit.Limit)
+	}
+
+	if want := []int{1000, 5, 20, 30}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merged limits = %v, want %v", got, want)
+	}
+
+	if merged.DenyStatus != 429 || merged.MatchPolicy != matchPolicyFirst || !merged.Headers || len(merged.Deny) != 2 {
+		t.Errorf("merged settings = denystatus %d, matchpolicy %q, headers %v, deny %d",
+			merged.DenyStatus, merged.MatchPolicy, merged.Headers, len(merged.Deny))
+	}
+
+	wantProvenance := []string{
+		"[ limit 0, id: payments, layer: service, overrides: environment, base ]",
+		"[ limit 1, id: -, layer: base ]",
+		"[ limit 2, id: users, layer: base ]",
+		"[ limit 3, id: orders, layer: environment ]",
+	}
+
+	if !reflect.DeepEqual(provenance, wantProvenance) {
+		t.Errorf("provenance = %v, want %v", provenance, wantProvenance)
+	}
+
+	// слои не меняются при объединении
+	if base.Limits[0].Limit != 10 || len(base.Deny) != 1 {
+		t.Error("base layer modified by merge")
+	}
+}
+
+func TestRateLimiter_updateLimitsLayers(t *testing.T) {
+	values := map[string]*keeper.Value{
+		"ratelimits": {Value: `{"limits": [{"id": "payments", "limit": 100, "rules": [{"urlpathpattern": "/payments"}]}]}`, Version: 1, ModRevision: 1},
+		"service":    {Value: `{"limits": [{"id": "payments", "limit": 1000}]}`, Version: 1, ModRevision: 1},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, ok := values[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(value)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	kc := keeper.NewKeeperClient(http.DefaultClient, srv.URL, "", "ratelimits")
+
+	rl := NewRateLimiter(ctx, defaultRateLimitLimits)
+	rl.keeperClient.Store(kc)
+	rl.source.Store(&sourceConfig{name: configSourceKeeper, source: kc, serviceKey: "service"})
+
+	if err := rl.loadLimits(ctx, []byte(`{"limits": [{"id": "payments", "limit": 10, "rules": [{"urlpathpattern": "/payments"}]}]}`)); err != nil {
+		t.Fatalf("loadLimits() error: %v", err)
+	}
+
+	limit := func() int {
+		t.Helper()
+
+		limits := rl.limits.Load().(*Limits)
+		if len(limits.Limits) != 1 {
+			t.Fatalf("merged limits = %+v, want one limit", limits.Limits)
+		}
+
+		return limits.Limits[0].Limit
+	}
+
+	if got := limit(); got != 10 {
+		t.Errorf("base limit = %d, want 10", got)
+	}
+
+	// лимит сервиса без правил заменяет лимит окружения целиком, объединённая конфигурация не проходит проверку,
+	// применяется только слой окружения
+	err := rl.updateLimits(ctx)
+	if err == nil || !strings.Contains(err.Error(), "failed validate merged limits") {
+		t.Fatalf("updateLimits() error = %v, want merged validation error", err)
+	}
+
+	if got := limit(); got != 100 {
+		t.Errorf("limit after invalid service layer = %d, want environment 100", got)
+	}
+
+	if setting := rl.serviceSetting.Load().(*keeper.Value); setting.ModRevision != 0 {
+		t.Errorf("invalid service layer version stored: %+v", setting)
+	}
+
+	values["service"] = &keeper.Value{Value: `{"limits": [{"id": "payments", "limit": 1000, "rules": [{"urlpathpattern": "/payments"}]}]}`, Version: 2, ModRevision: 2}
+
+	if err = rl.updateLimits(ctx); err != nil {
+		t.Fatalf("updateLimits() error: %v", err)
+	}
+
+	if got := limit(); got != 1000 {
+		t.Errorf("limit with service layer = %d, want 1000", got)
+	}
+
+	// повторный опрос тех же версий не пересоздаёт лимиты
+	merged := rl.limits.Load().(*Limits)
+
+	if err = rl.updateLimits(ctx); err != nil {
+		t.Fatalf("updateLimits() error: %v", err)
+	}
+
+	if rl.limits.Load().(*Limits) != merged {
+		t.Error("limits reloaded for unchanged layers")
+	}
+}
@@ -0,0 +1,528 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/limiter"
+)
+
+const (
+	bucketKeyParam = "param" // параметр пути из urlpathpattern или urlpathregex
+	bucketKeyIP    = "ip"    // адрес клиента, см. ClientIP
+	bucketKeyClaim = "claim" // claim из JWT, см. JWT
+)
+
+// bucketKey описывает откуда брать ключ персонального бакета: "<source>:<name>"
+type bucketKey struct {
+	source string
+	name   string
+}
+
+func parseBucketKey(s string) (*bucketKey, error) {
+	source, name, _ := strings.Cut(s, ":")
+
+	switch source {
+	case bucketKeyParam:
+		if name == "" {
+			return nil, fmt.Errorf("bucket key '%s': path param name is empty", s)
+		}
+
+	case bucketKeyIP:
+		if name != "" {
+			return nil, fmt.Errorf("bucket key '%s': ip does not take a name", s)
+		}
+
+	case bucketKeyClaim:
+		if name == "" {
+			return nil, fmt.Errorf("bucket key '%s': claim name is empty", s)
+		}
+
+	default:
+		return nil, fmt.Errorf("bucket key '%s': unknown source '%s'", s, source)
+	}
+
+	return &bucketKey{
+		source: source,
+		name:   name,
+	}, nil
+}
+
+func (bk *bucketKey) String() string {
+	if bk.name == "" {
+		return bk.source
+	}
+
+	return bk.source + ":" + bk.name
+}
+
+// value возвращает значение ключа для запроса, совпавшего с правилом rule
+func (bk *bucketKey) value(rule *RuleImpl, ri *requestInfo) string {
+	switch bk.source {
+	case bucketKeyParam:
+		if val, ok := rule.param(ri.urlPath, bk.name); ok {
+			return string(val)
+		}
+
+	case bucketKeyIP:
+		if ip := ri.clientIP(); ip.IsValid() {
+			return ip.String()
+		}
+
+	case bucketKeyClaim:
+		if token := ri.jwtToken(); token != nil {
+			if val, ok := token.Claim(bk.name); ok {
+				return val
+			}
+		}
+	}
+
+	return ""
+}
+
+// rateState остаток окна лимита, передаётся в заголовках ответа
+type rateState struct {
+	id        string // id лимита окна
+	limit     int    // 0 - лимит не применялся
+	remaining int
+	reset     time.Duration // время до начала следующего окна
+}
+
+// tighter сообщает, что s ограничивает сильнее other
+func (s rateState) tighter(other rateState) bool {
+	return other.limit == 0 || s.remaining < other.remaining
+}
+
+// LimitImpl скомпилированный Limit, общий для всех его правил
+type LimitImpl struct {
+	limit     int              // rps
+	limiter   *limiter.Limiter // общий rps бакет, если не задан bucketKey
+	windows   []*limiter.Keyed // rps по значению bucketKey, минута и сутки. Без bucketKey используется ключ ""
+	bucketKey *bucketKey
+	tiers     *tiersImpl
+	tierLimit map[string]*LimitImpl // лимиты тарифов, если задан tiers
+	parent    *LimitImpl            // бакет родительского лимита, см. Limit.Children
+	order     int                   // порядковый номер лимита в конфигурации, для matchpolicy "first"
+	adaptive  *adaptiveLimit        // адаптивный лимит бакета rps
+	breaker   *circuitBreaker
+	schedule  *scheduleLimit  // расписание бакета rps
+	id        string          // id из конфигурации или хеш лимита, одинаковый на всех репликах с одной конфигурацией
+	desc      string          // описание из конфигурации
+	stateKey  string          // параметры бакетов, см. limitStateKey
+	shared    []*sharedWindow // окна в общем хранилище: windows, затем limiter
+	gossip    *gossipUsage    // расход для рассылки пирам, лимиты уменьшаются на расход пиров
+	scaled    bool            // бакеты созданы с долей стороны канарейки, см. limitScale
+	capacity  int             // наименьшая ёмкость окон с долей реплики и канарейки, 0 - окна не ограничены
+}
+
+func newLimitImpl(limit Limit, parent *LimitImpl) *LimitImpl {
+	li := &LimitImpl{
+		limit:  limit.rps(),
+		parent: parent,
+	}
+
+	if limit.Tiers != nil {
+		if tiers, err := limit.Tiers.compile(); err == nil {
+			li.tiers = tiers
+			li.limit = tiers.limits[tiers.defaultTier]
+			li.tierLimit = make(map[string]*LimitImpl, len(tiers.limits))
+
+			for name, value := range tiers.limits {
+				li.tierLimit[name] = newLimitImpl(Limit{
+					Limit:     value,
+					BucketKey: limit.BucketKey,
+					PerMinute: limit.PerMinute,
+					PerDay:    limit.PerDay,
+				}, nil)
+			}
+
+			return li
+		}
+	}
+
+	if limit.BucketKey != "" {
+		if bk, err := parseBucketKey(limit.BucketKey); err == nil {
+			li.bucketKey = bk
+		}
+	}
+
+	if limit.Adaptive != nil {
+		if adaptive, err := limit.Adaptive.compile(li.limit); err == nil {
+			li.adaptive = adaptive
+			li.limit = adaptive.Current()
+		}
+	}
+
+	if limit.Schedule != nil {
+		if schedule, err := limit.Schedule.compile(); err == nil {
+			li.schedule = schedule
+			li.limit = schedule.Current()
+		}
+	}
+
+	if li.limit > 0 {
+		if li.bucketKey != nil {
+			li.windows = append(li.windows, limiter.NewKeyed(li.limit))
+
+		} else {
+			li.limiter = limiter.NewLimiter(li.limit)
+		}
+
+		if li.adaptive != nil {
+			li.adaptive.limiter = li.limiter
+			if li.bucketKey != nil {
+				li.adaptive.keyed = li.windows[0]
+			}
+		}
+
+		if li.schedule != nil {
+			li.schedule.limiter = li.limiter
+			if li.bucketKey != nil {
+				li.schedule.keyed = li.windows[0]
+			}
+		}
+	}
+
+	if limit.PerMinute > 0 {
+		li.windows = append(li.windows, limiter.NewKeyedWindow(limit.PerMinute, time.Minute))
+	}
+
+	if limit.PerDay > 0 {
+		li.windows = append(li.windows, limiter.NewKeyedWindow(limit.PerDay, 24*time.Hour))
+	}
+
+	return li
+}
+
+func (li *LimitImpl) Limit() int {
+	if li.adaptive != nil {
+		return li.adaptive.Current()
+	}
+
+	if li.schedule != nil {
+		return li.schedule.Current()
+	}
+
+	return li.limit
+}
+
+// share переносит счёт окон лимита в общее хранилище, локальные бакеты используются, пока хранилище недоступно
+func (li *LimitImpl) share(store *sharedStore, id string) {
+	for name, tl := range li.tierLimit {
+		tl.share(store, id+":"+name)
+	}
+
+	for _, w := range li.windows {
+		li.shared = append(li.shared, newSharedWindow(store, id, w.Period(), w))
+	}
+
+	if li.limiter != nil {
+		li.shared = append(li.shared, newSharedWindow(store, id, time.Second, li.limiter))
+	}
+}
+
+// changedSinceLog переключает лимит по расписанию и сообщает, что эффективное значение или состояние breaker
+// изменилось с прошлого вызова
+func (li *LimitImpl) changedSinceLog(now time.Time) bool {
+	changed := false
+
+	if li.adaptive != nil && li.adaptive.changedSinceLog() {
+		changed = true
+	}
+
+	if li.schedule != nil {
+		li.schedule.update(now)
+
+		if li.schedule.changedSinceLog() {
+			changed = true
+		}
+	}
+
+	if li.breaker != nil && li.breaker.changedSinceLog() {
+		changed = true
+	}
+
+	return changed
+}
+
+// Close закрывает лимит и его родителей, родитель может быть закрыт несколько раз
+func (li *LimitImpl) Close() {
+	if li.parent != nil {
+		li.parent.Close()
+	}
+
+	li.closeBuckets()
+}
+
+// closeBuckets закрывает бакеты лимита без родителей
+func (li *LimitImpl) closeBuckets() {
+	for _, tl := range li.tierLimit {
+		tl.Close()
+	}
+
+	if li.limiter != nil {
+		li.limiter.Close()
+	}
+
+	for _, w := range li.windows {
+		w.Close()
+	}
+}
+
+func (li *LimitImpl) IsClosed() bool {
+	if li.tiers != nil {
+		return li.tierLimit[li.tiers.defaultTier].IsClosed()
+	}
+
+	if li.limiter != nil {
+		return li.limiter.IsClosed()
+	}
+
+	if len(li.windows) > 0 {
+		return li.windows[0].IsClosed()
+	}
+
+	return true
+}
+
+// name id и описание лимита для логов, пустая строка для лимита без id
+func (li *LimitImpl) name() string {
+	switch {
+	case li.id == "":
+		return ""
+	case li.desc == "":
+		return "id: " + li.id + ", "
+	}
+
+	return "id: " + li.id + " (" + li.desc + "), "
+}
+
+func (li *LimitImpl) String() string {
+	if li.tiers != nil {
+		parts := make([]string, 0, len(li.tierLimit))
+		for _, name := range li.tiers.names() {
+			parts = append(parts, name+": {"+li.tierLimit[name].String()+"}")
+		}
+
+		str := li.name() + "tiers: " + li.tiers.key() + ", default: " + li.tiers.defaultTier + ", " + strings.Join(parts, ", ")
+		if li.breaker != nil {
+			str += ", " + li.breaker.String()
+		}
+
+		if li.parent != nil {
+			str += ", parent: {" + li.parent.String() + "}"
+		}
+
+		return str
+	}
+
+	str := li.name() + "limit: " + strconv.Itoa(li.limit)
+	if li.adaptive != nil {
+		str += ", " + li.adaptive.String()
+	}
+
+	if li.schedule != nil {
+		str += ", " + li.schedule.String()
+	}
+
+	for _, w := range li.windows {
+		switch w.Period() {
+		case time.Minute:
+			str += ", perminute: " + strconv.Itoa(w.Limit())
+		case 24 * time.Hour:
+			str += ", perday: " + strconv.Itoa(w.Limit())
+		}
+	}
+
+	if li.bucketKey != nil {
+		str += ", bucketkey: " + li.bucketKey.String()
+		if len(li.windows) > 0 {
+			str += ", buckets: " + strconv.Itoa(li.windows[0].Len())
+		}
+	}
+
+	if li.breaker != nil {
+		str += ", " + li.breaker.String()
+	}
+
+	if len(li.shared) > 0 {
+		str += ", shared"
+	}
+
+	if li.gossip != nil && li.limiter != nil {
+		str += ", gossip: " + strconv.Itoa(li.limiter.Limit())
+	}
+
+	if li.parent != nil {
+		str += ", parent: {" + li.parent.String() + "}"
+	}
+
+	return str
+}
+
+// allow списывает стоимость запроса из бакета лимита и бакетов всех его родителей
+// и возвращает состояние окна с наименьшим остатком.
+// Если какой-либо бакет отклоняет запрос, списанное из остальных возвращается.
+// Бакеты, уже списанные для этого запроса по другому правилу, пропускаются
+func (li *LimitImpl) allow(rule *RuleImpl, ri *requestInfo) (bool, rateState) {
+	n := ruleCost(rule, ri)
+	now := time.Now()
+
+	var state rateState
+
+	debitedBefore := len(ri.debited)
+
+	for lim := li; lim != nil; lim = lim.parent {
+		if ri.isDebited(lim) {
+			continue
+		}
+
+		ok, ws := lim.take(rule, ri, n, now)
+		ws.id = lim.id
+
+		if !ok {
+			ri.refund(debitedBefore)
+			return false, ws
+		}
+
+		ri.debited = append(ri.debited, debit{limit: lim, rule: rule, n: n, at: now})
+
+		if ws.limit > 0 && ws.tighter(state) {
+			state = ws
+		}
+	}
+
+	return true, state
+}
+
+// take списывает n разрешений из всех окон бакета лимита, без учёта родителей
+func (li *LimitImpl) take(rule *RuleImpl, ri *requestInfo, n int, now time.Time) (bool, rateState) {
+	if li.tiers != nil {
+		return li.tierLimit[li.tiers.tier(ri)].take(rule, ri, n, now)
+	}
+
+	if li.schedule != nil {
+		li.schedule.update(now)
+	}
+
+	key := li.key(rule, ri)
+
+	if len(li.shared) > 0 && li.shared[0].store.available(now) {
+		if ok, state, err := li.takeShared(ri.req.Context(), key, n, now); err == nil {
+			return ok, state
+		}
+	}
+
+	var state rateState
+
+	for i, w := range li.windows {
+		remaining, ok := w.Take(key, n, now)
+
+		ws := rateState{limit: w.Limit(), remaining: remaining, reset: w.ResetIn(now)}
+		if !ok {
+			li.returnWindows(key, n, now, i)
+			return false, ws
+		}
+
+		if ws.tighter(state) {
+			state = ws
+		}
+	}
+
+	// общий rps бакет проверяется последним, чтобы при отказе не возвращать в него разрешения
+	if li.limiter != nil {
+		remaining, ok := li.limiter.TakeN(n)
+
+		ws := rateState{limit: li.limiter.Limit(), remaining: remaining, reset: now.Truncate(time.Second).Add(time.Second).Sub(now)}
+		if !ok {
+			li.returnWindows(key, n, now, len(li.windows))
+			return false, ws
+		}
+
+		if ws.tighter(state) {
+			state = ws
+		}
+	}
+
+	if li.gossip != nil {
+		li.gossip.add(n, now)
+	}
+
+	return true, state
+}
+
+// giveBack возвращает n разрешений, списанных take
+func (li *LimitImpl) giveBack(rule *RuleImpl, ri *requestInfo, n int, now time.Time) {
+	if li.tiers != nil {
+		li.tierLimit[li.tiers.tier(ri)].giveBack(rule, ri, n, now)
+		return
+	}
+
+	key := li.key(rule, ri)
+
+	if len(li.shared) > 0 && li.shared[0].store.available(now) {
+		li.returnShared(key, n, now, len(li.shared))
+		return
+	}
+
+	li.returnWindows(key, n, now, len(li.windows))
+
+	if li.limiter != nil {
+		li.limiter.ReturnN(n)
+	}
+
+	if li.gossip != nil {
+		li.gossip.add(-n, now)
+	}
+}
+
+func (li *LimitImpl) key(rule *RuleImpl, ri *requestInfo) string {
+	if li.bucketKey == nil {
+		return ""
+	}
+
+	return li.bucketKey.value(rule, ri)
+}
+
+// returnWindows возвращает n разрешений, списанных из первых count окон
+func (li *LimitImpl) returnWindows(key string, n int, now time.Time, count int) {
+	for _, w := range li.windows[:count] {
+		w.Return(key, n, now)
+	}
+}
+
+// takeShared списывает n разрешений из окон лимита в общем хранилище.
+// При ошибке хранилища списанное возвращается, и запрос проверяется локальными бакетами
+func (li *LimitImpl) takeShared(ctx context.Context, key string, n int, now time.Time) (bool, rateState, error) {
+	var state rateState
+
+	for i, sw := range li.shared {
+		remaining, ok, err := sw.take(ctx, key, n, now)
+		if err != nil {
+			li.returnShared(key, n, now, i)
+			return false, rateState{}, err
+		}
+
+		ws := rateState{limit: sw.local.Limit(), remaining: remaining, reset: sw.resetIn(now)}
+		if !ok {
+			li.returnShared(key, n, now, i)
+			return false, ws, nil
+		}
+
+		if ws.tighter(state) {
+			state = ws
+		}
+	}
+
+	return true, state, nil
+}
+
+// returnShared возвращает n разрешений, списанных из первых count окон общего хранилища
+func (li *LimitImpl) returnShared(key string, n int, now time.Time, count int) {
+	for _, sw := range li.shared[:count] {
+		sw.giveBack(key, n, now)
+	}
+}
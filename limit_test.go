@@ -0,0 +1,175 @@
+package traefik_ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_decide_Windows(t *testing.T) {
+	rl := &RateLimiter{
+		rules: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+
+	rl.hotReloadLimits(&Limits{
+		Headers: true,
+		Limits: []Limit{
+			{RPS: 100, PerMinute: 5, PerDay: 2, BucketKey: "param:id", Rules: []Rule{{URLPathPattern: "/merchants/{id}"}}},
+		},
+	})
+
+	decide := func(id string) decision {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost/merchants/"+id, http.NoBody)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		return rl.decide(req, nil)
+	}
+
+	for i := 0; i < 2; i++ {
+		d := decide("1")
+		if !d.allow {
+			t.Fatalf("request %d should be allowed", i)
+		}
+
+		// самое исчерпанное окно - сутки
+		if d.rate.limit != 2 || d.rate.remaining != 1-i {
+			t.Errorf("request %d: rate = %+v, want limit 2, remaining %d", i, d.rate, 1-i)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if d := decide("1"); d.allow || d.status != http.StatusTooManyRequests || d.rate.remaining != 0 {
+			t.Fatalf("request over daily quota: %+v, want rejected", d)
+		}
+	}
+
+	if !decide("2").allow {
+		t.Error("another merchant should have its own quota")
+	}
+
+	var lim *LimitImpl
+	rl.rules.Load().(*sync.Map).Range(func(_, v any) bool {
+		lim = v.(*LimitImpl)
+		return false
+	})
+
+	// отклонённые суточным окном запросы не должны расходовать rps и минутную квоту
+	now := time.Now()
+	if remaining, ok := lim.windows[1].Take("1", 1, now); !ok || remaining != 2 {
+		t.Errorf("minute window Take() = %d, %v, want 2, true", remaining, ok)
+	}
+}
+
+func TestDecision_writeHeaders(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	d := decision{allow: false, status: http.StatusTooManyRequests, rate: rateState{limit: 3000, remaining: 0, reset: 1500 * time.Millisecond}}
+	d.writeHeaders(rec.Header())
+
+	want := map[string]string{
+		"X-RateLimit-Limit":     "3000",
+		"X-RateLimit-Remaining": "0",
+		"X-RateLimit-Reset":     "2",
+		"Retry-After":           "2",
+	}
+
+	for name, val := range want {
+		if got := rec.Header().Get(name); got != val {
+			t.Errorf("%s = %q, want %q", name, got, val)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+
+	d = decision{allow: true}
+	d.writeHeaders(rec.Header())
+
+	if len(rec.Header()) != 0 {
+		t.Errorf("headers = %v, want none when no limit applied", rec.Header())
+	}
+}
+
+func TestRateLimiter_Allow_Children(t *testing.T) {
+	newRateLimiter := func(parent Limit) *RateLimiter {
+		rl := &RateLimiter{
+			rules: atomic.Value{},
+		}
+
+		rl.rules.Store(&sync.Map{})
+		rl.hotReloadLimits(&Limits{Limits: []Limit{parent}})
+
+		return rl
+	}
+
+	allow := func(rl *RateLimiter, path string) bool {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost"+path, http.NoBody)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		return rl.Allow(req)
+	}
+
+	t.Run("parent rejects and child is refunded", func(t *testing.T) {
+		rl := newRateLimiter(Limit{
+			PerMinute: 3,
+			Children: []Limit{
+				{PerMinute: 2, BucketKey: "param:id", Rules: []Rule{{URLPathPattern: "/merchants/{id}"}}},
+			},
+		})
+
+		if !allow(rl, "/merchants/1") || !allow(rl, "/merchants/1") {
+			t.Fatal("merchant 1 should be allowed twice")
+		}
+
+		if allow(rl, "/merchants/1") {
+			t.Error("third request of merchant 1 should be rejected by the child limit")
+		}
+
+		if !allow(rl, "/merchants/2") {
+			t.Fatal("first request of merchant 2 should be allowed")
+		}
+
+		if allow(rl, "/merchants/2") {
+			t.Error("second request of merchant 2 should be rejected by the parent limit")
+		}
+
+		var child *LimitImpl
+		rl.rules.Load().(*sync.Map).Range(func(_, v any) bool {
+			child = v.(*LimitImpl)
+			return false
+		})
+
+		// разрешение, списанное дочерним лимитом до отказа родителя, возвращено
+		if remaining, ok := child.windows[0].Take("2", 1, time.Now()); !ok || remaining != 0 {
+			t.Errorf("child Take() = %d, %v, want 0, true", remaining, ok)
+		}
+	})
+
+	t.Run("parent rule and child rule debit parent once", func(t *testing.T) {
+		rl := newRateLimiter(Limit{
+			PerMinute: 4,
+			Rules:     []Rule{{URLPathPattern: "/merchants/**"}},
+			Children: []Limit{
+				{PerMinute: 10, Rules: []Rule{{URLPathPattern: "/merchants/{id}"}}},
+			},
+		})
+
+		for i := 0; i < 4; i++ {
+			if !allow(rl, "/merchants/1") {
+				t.Fatalf("request %d should be allowed", i)
+			}
+		}
+
+		if allow(rl, "/merchants/1") {
+			t.Error("fifth request should be rejected by the parent limit")
+		}
+	})
+}
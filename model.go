@@ -2,70 +2,260 @@ package traefik_ratelimit
 
 import (
 	"fmt"
+	"net/http"
+	"regexp"
 	"strings"
 
+	"github.com/wbpaygate/traefik-ratelimit/internal/clientip"
 	"github.com/wbpaygate/traefik-ratelimit/internal/pattern"
 )
 
 type Rule struct {
+	// ID идентификатор правила в логах, по умолчанию хеш содержимого правила
+	ID             string `json:"id"`
+	Description    string `json:"description"`
 	URLPathPattern string `json:"urlpathpattern"`
 	HeaderKey      string `json:"headerkey"`
 	HeaderVal      string `json:"headerval"`
+	// URLPathRegex альтернатива URLPathPattern, регулярное выражение для пути запроса,
+	// именованные группы (?P<name>...) доступны как параметры пути
+	URLPathRegex string `json:"urlpathregex"`
+	// CaseSensitive включает сравнение headerval с учётом регистра,
+	// по умолчанию регистр значения заголовка не учитывается
+	CaseSensitive bool `json:"casesensitive"`
+	// SourceCIDRs подсети или адреса клиента, см. ClientIP
+	SourceCIDRs []string `json:"sourcecidrs"`
+	// Claims значения claims JWT из запроса, должны совпасть все, см. JWT
+	Claims map[string]string `json:"claims"`
+	// Cost стоимость запроса в разрешениях лимита, по умолчанию 1
+	Cost *Cost `json:"cost"`
+}
+
+// Cost стоимость запроса: фиксированная или из заголовка или query параметра в границах [min, max]
+type Cost struct {
+	// Value фиксированная стоимость, а для header и query - стоимость, если значение не передано или некорректно
+	Value  int    `json:"value"`
+	Header string `json:"header"`
+	Query  string `json:"query"`
+	// Min и Max границы стоимости из header или query, min по умолчанию 1, max обязателен
+	Min int `json:"min"`
+	Max int `json:"max"`
 }
 
 type Limit struct {
+	// ID идентификатор лимита в логах, заголовках ответа и общем хранилище, по умолчанию хеш содержимого лимита.
+	// Ключ объединения слоёв конфигурации, состояние лимита с тем же id сохраняется при перезагрузке
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Limit       int    `json:"limit"`
+	Rules       []Rule `json:"rules"`
+	// BucketKey если задан, то лимит считается отдельно для каждого значения ключа,
+	// например "param:merchantId" - по параметру пути из urlpathpattern или urlpathregex
+	BucketKey string `json:"bucketkey"`
+	// Tiers если задан, то значение лимита выбирается по тарифу клиента, limit при этом не указывается
+	Tiers *Tiers `json:"tiers"`
+	// RPS синоним Limit
+	RPS int `json:"rps"`
+	// PerMinute и PerDay квоты на календарную минуту и сутки (UTC) в дополнение к RPS,
+	// запрос пропускается, только если есть место во всех окнах
+	PerMinute int `json:"perminute"`
+	PerDay    int `json:"perday"`
+	// Children дочерние лимиты: запрос, совпавший с правилом дочернего лимита,
+	// должен пройти и его бакет, и бакеты всех родителей. Правила родителя необязательны
+	Children []Limit `json:"children"`
+	// Adaptive если задан, то лимит в секунду подстраивается под задержку и ошибки upstream
+	Adaptive *Adaptive `json:"adaptive"`
+	// Breaker если задан, то при ошибках upstream запросы лимита отклоняются с 503
+	Breaker *Breaker `json:"breaker"`
+	// Schedule если задан, то лимит в секунду переключается по расписанию, limit при этом не указывается
+	Schedule *Schedule `json:"schedule"`
+}
+
+// Schedule расписание лимита в секунду, периоды должны покрывать всю неделю без пересечений
+type Schedule struct {
+	// TimeZone часовой пояс периодов, например "Europe/Moscow", по умолчанию UTC
+	TimeZone string           `json:"timezone"`
+	Periods  []SchedulePeriod `json:"periods"`
+}
+
+// SchedulePeriod значение лимита в дни недели days с from до to.
+// Days - "mon-fri", "sat,sun", по умолчанию каждый день. From и To - "HH:MM", по умолчанию весь день,
+// если to раньше from, период продолжается до to следующего дня
+type SchedulePeriod struct {
+	Days  string `json:"days"`
+	From  string `json:"from"`
+	To    string `json:"to"`
 	Limit int    `json:"limit"`
-	Rules []Rule `json:"rules"`
+}
+
+// Breaker настройки circuit breaker лимита. Breaker размыкается, когда доля ответов 5xx в окне
+// достигает errorrate или подряд приходит consecutivefailures ошибок, и отклоняет запросы
+// в течение opentimeout, после чего пропускает halfopenrequests пробных запросов
+type Breaker struct {
+	ErrorRate           float64 `json:"errorrate"`
+	MinRequests         int     `json:"minrequests"` // минимум ответов в окне для errorrate, по умолчанию 20
+	ConsecutiveFailures int     `json:"consecutivefailures"`
+	Window              string  `json:"window"`           // окно подсчёта errorrate, по умолчанию "10s"
+	OpenTimeout         string  `json:"opentimeout"`      // по умолчанию "30s"
+	HalfOpenRequests    int     `json:"halfopenrequests"` // по умолчанию 1
+}
+
+// Adaptive настройки адаптивного лимита (AIMD): пока upstream здоров, лимит растёт на increase
+// каждый interval, при деградации умножается на decrease. Начальное значение - limit, иначе max
+type Adaptive struct {
+	Min      int     `json:"min"`
+	Max      int     `json:"max"`
+	Increase int     `json:"increase"` // по умолчанию 5% от max, не меньше 1
+	Decrease float64 `json:"decrease"` // по умолчанию 0.5
+	// Latency порог средней задержки ответа, например "300ms", по умолчанию не проверяется
+	Latency string `json:"latency"`
+	// ErrorRate порог доли ответов 5xx, по умолчанию 0.05
+	ErrorRate float64 `json:"errorrate"`
+	// Interval период пересчёта лимита, по умолчанию "1s"
+	Interval string `json:"interval"`
+}
+
+// rps возвращает лимит в секунду, заданный limit или rps
+func (l *Limit) rps() int {
+	if l.RPS != 0 {
+		return l.RPS
+	}
+
+	return l.Limit
+}
+
+// Tiers тарифы лимита, различающиеся только значением
+type Tiers struct {
+	// Key откуда брать тариф клиента: "header:<name>", "claim:<name>" или "ipgroup"
+	Key string `json:"key"`
+	// Default тариф для клиентов, у которых тариф не определён или неизвестен
+	Default string `json:"default"`
+	// Limits значение лимита для каждого тарифа
+	Limits map[string]int `json:"limits"`
+	// IPGroups подсети клиентов по тарифам для key "ipgroup", см. ClientIP
+	IPGroups map[string][]string `json:"ipgroups"`
+}
+
+// ClientIP настройки определения адреса клиента для sourcecidrs и bucketkey "ip"
+type ClientIP struct {
+	// TrustedProxies подсети прокси, которым разрешено передавать адрес клиента в X-Forwarded-For и X-Real-IP
+	TrustedProxies []string `json:"trustedproxies"`
+	// Depth позиция адреса клиента с конца X-Forwarded-For, 0 - первый недоверенный адрес с конца
+	Depth int `json:"depth"`
+}
+
+// BypassKey ключ подписи токенов обхода лимитов
+type BypassKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// Bypass настройки токенов обхода лимитов, см. пакет bypass
+type Bypass struct {
+	// Header заголовок с токеном, по умолчанию X-Ratelimit-Bypass
+	Header string `json:"header"`
+	// Keys активные ключи, при ротации указываются старый и новый ключ
+	Keys []BypassKey `json:"keys"`
+	// MaxTTL максимальный срок действия токена, например "24h", по умолчанию не ограничен
+	MaxTTL string `json:"maxttl"`
+}
+
+// JWTKey ключ проверки подписи JWT: для HS256 задаётся secret, для RS256 publickey в PEM
+type JWTKey struct {
+	ID        string `json:"id"`
+	Alg       string `json:"alg"`
+	Secret    string `json:"secret"`
+	PublicKey string `json:"publickey"`
+}
+
+// JWT настройки разбора JWT для claims в правилах и bucketkey "claim:<name>"
+type JWT struct {
+	// Header заголовок с токеном, по умолчанию Authorization (префикс Bearer отбрасывается)
+	Header string `json:"header"`
+	// Verify включает проверку подписи, exp и nbf. По умолчанию токен только разбирается,
+	// так как проверка выполняется в upstream
+	Verify bool     `json:"verify"`
+	Keys   []JWTKey `json:"keys"`
 }
 
 type Limits struct {
-	Limits []Limit `json:"limits"`
+	Limits   []Limit   `json:"limits"`
+	ClientIP *ClientIP `json:"clientip"`
+	Bypass   *Bypass   `json:"bypass"`
+	JWT      *JWT      `json:"jwt"`
+	// Allow запросы, совпавшие с любым из правил, пропускаются без проверки лимитов
+	Allow []Rule `json:"allow"`
+	// Deny запросы, совпавшие с любым из правил, всегда отклоняются, проверяется до Allow
+	Deny []Rule `json:"deny"`
+	// DenyStatus код ответа для Deny: 403 (по умолчанию) или 429
+	DenyStatus int `json:"denystatus"`
+	// Headers включает заголовки X-RateLimit-* с остатком самого исчерпанного окна лимита
+	Headers bool `json:"headers"`
+	// MatchPolicy какие из совпавших лимитов проверяются: "all" (по умолчанию) - все,
+	// "first" - только первый в порядке конфигурации
+	MatchPolicy string `json:"matchpolicy"`
 }
 
+const (
+	matchPolicyAll   = "all"
+	matchPolicyFirst = "first"
+)
+
 func (l *Limits) validate() error {
 	if l == nil {
 		return fmt.Errorf("limits is nil")
 	}
 
-	if len(l.Limits) == 0 {
+	if len(l.Limits) == 0 && len(l.Allow) == 0 && len(l.Deny) == 0 {
 		return fmt.Errorf("limits are required")
 	}
 
 	var errorMessages []string
 
-	for i, lim := range l.Limits {
-		if lim.Limit <= 0 {
-			errorMessages = append(errorMessages, fmt.Sprintf("[limit %d]: limit value <= 0", i))
+	if l.ClientIP != nil {
+		if _, err := clientip.NewResolver(l.ClientIP.TrustedProxies, l.ClientIP.Depth); err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("[clientip]: %v", err))
 		}
+	}
 
-		if len(lim.Rules) == 0 {
-			errorMessages = append(errorMessages, fmt.Sprintf("[limit %d]: no rules specified", i))
-			continue
+	if l.Bypass != nil {
+		if _, err := l.Bypass.verifier(nil); err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("[bypass]: %v", err))
 		}
+	}
 
-		for j, rule := range lim.Rules {
-			rulePrefix := fmt.Sprintf("[limit %d, rule %d]", i, j)
+	if l.JWT != nil {
+		if _, err := l.JWT.verifier(); err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("[jwt]: %v", err))
+		}
+	}
 
-			if rule.HeaderKey != "" && rule.HeaderVal == "" {
-				errorMessages = append(errorMessages,
-					fmt.Sprintf("%s: header key '%s' provided but header value is empty",
-						rulePrefix, rule.HeaderKey))
-			}
+	if l.DenyStatus != 0 && l.DenyStatus != http.StatusForbidden && l.DenyStatus != http.StatusTooManyRequests {
+		errorMessages = append(errorMessages, fmt.Sprintf("[denystatus]: must be %d or %d, got %d",
+			http.StatusForbidden, http.StatusTooManyRequests, l.DenyStatus))
+	}
 
-			if rule.HeaderVal != "" && rule.HeaderKey == "" {
-				errorMessages = append(errorMessages,
-					fmt.Sprintf("%s: header value provided but header key is empty",
-						rulePrefix))
-			}
+	if l.MatchPolicy != "" && l.MatchPolicy != matchPolicyAll && l.MatchPolicy != matchPolicyFirst {
+		errorMessages = append(errorMessages, fmt.Sprintf("[matchpolicy]: must be '%s' or '%s', got '%s'",
+			matchPolicyAll, matchPolicyFirst, l.MatchPolicy))
+	}
 
-			if rule.HeaderVal == "" && rule.HeaderKey == "" && rule.URLPathPattern == "" {
-				errorMessages = append(errorMessages,
-					fmt.Sprintf("%s: rule is empty - must specify either header or URL pattern",
-						rulePrefix))
-			}
-		}
+	for i, rule := range l.Allow {
+		ruleErrors, _ := rule.validate(fmt.Sprintf("[allow, rule %d]", i))
+		errorMessages = append(errorMessages, ruleErrors...)
+	}
+
+	for i, rule := range l.Deny {
+		ruleErrors, _ := rule.validate(fmt.Sprintf("[deny, rule %d]", i))
+		errorMessages = append(errorMessages, ruleErrors...)
+	}
+
+	for i := range l.Limits {
+		errorMessages = append(errorMessages, l.Limits[i].validate(fmt.Sprintf("limit %d", i), nil, 0)...)
 	}
 
+	errorMessages = append(errorMessages, l.validateIDs()...)
+
 	if len(errorMessages) > 0 {
 		return fmt.Errorf("errors: %s", strings.Join(errorMessages, ", "))
 	}
@@ -73,25 +263,369 @@ func (l *Limits) validate() error {
 	return nil
 }
 
+// validate проверяет лимит и его дочерние лимиты. paramKeys - параметры пути из bucketkey предков,
+// правила дочерних лимитов должны их захватывать, так как ключ бакета предка берётся из правила потомка.
+// capacity - наименьшая ёмкость окна предков, запрос списывает стоимость из окон лимита и всех предков
+func (lim *Limit) validate(prefix string, paramKeys []string, capacity int) []string {
+	var errorMessages []string
+
+	capacity = minPositive(capacity, lim.minCapacity())
+
+	if lim.Limit != 0 && lim.RPS != 0 {
+		errorMessages = append(errorMessages, fmt.Sprintf("[%s]: only one of limit and rps may be specified", prefix))
+	}
+
+	if lim.PerMinute < 0 || lim.PerDay < 0 {
+		errorMessages = append(errorMessages, fmt.Sprintf("[%s]: perminute and perday must not be negative", prefix))
+	}
+
+	if lim.Tiers != nil {
+		if lim.rps() != 0 {
+			errorMessages = append(errorMessages, fmt.Sprintf("[%s]: only one of limit and tiers may be specified", prefix))
+		}
+
+		if _, err := lim.Tiers.compile(); err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("[%s, tiers]: %v", prefix, err))
+		}
+
+	} else if lim.rps() < 0 || (lim.rps() == 0 && lim.PerMinute <= 0 && lim.PerDay <= 0 && lim.Adaptive == nil && lim.Breaker == nil && lim.Schedule == nil) {
+		errorMessages = append(errorMessages, fmt.Sprintf("[%s]: limit value <= 0", prefix))
+	}
+
+	if lim.Adaptive != nil {
+		if lim.Tiers != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("[%s]: only one of tiers and adaptive may be specified", prefix))
+		}
+
+		if _, err := lim.Adaptive.compile(lim.rps()); err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("[%s, adaptive]: %v", prefix, err))
+		}
+	}
+
+	if lim.Schedule != nil {
+		if lim.rps() != 0 || lim.Tiers != nil || lim.Adaptive != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("[%s]: schedule may not be combined with limit, tiers or adaptive", prefix))
+		}
+
+		if _, err := lim.Schedule.compile(); err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("[%s, schedule]: %v", prefix, err))
+		}
+	}
+
+	if lim.Breaker != nil {
+		if _, err := lim.Breaker.compile(lim.ID); err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("[%s, breaker]: %v", prefix, err))
+		}
+	}
+
+	if len(lim.Rules) == 0 && len(lim.Children) == 0 {
+		errorMessages = append(errorMessages, fmt.Sprintf("[%s]: no rules specified", prefix))
+		return errorMessages
+	}
+
+	if lim.BucketKey != "" {
+		bk, err := parseBucketKey(lim.BucketKey)
+		if err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("[%s]: %v", prefix, err))
+
+		} else if bk.source == bucketKeyParam {
+			paramKeys = append(paramKeys[:len(paramKeys):len(paramKeys)], bk.name)
+		}
+	}
+
+	for j, rule := range lim.Rules {
+		rulePrefix := fmt.Sprintf("[%s, rule %d]", prefix, j)
+
+		ruleErrors, names := rule.validate(rulePrefix)
+		errorMessages = append(errorMessages, ruleErrors...)
+
+		// запрос со стоимостью больше окна отклонялся бы всегда
+		if cost := rule.Cost.maxCost(); capacity > 0 && cost > capacity {
+			errorMessages = append(errorMessages,
+				fmt.Sprintf("%s: max cost %d exceeds the smallest window capacity %d of the limit and its parents", rulePrefix, cost, capacity))
+		}
+
+		for _, name := range paramKeys {
+			if !containsString(names, name) {
+				errorMessages = append(errorMessages,
+					fmt.Sprintf("%s: bucket key path param '%s' is not captured by the rule", rulePrefix, name))
+			}
+		}
+	}
+
+	for j := range lim.Children {
+		errorMessages = append(errorMessages, lim.Children[j].validate(fmt.Sprintf("%s, child %d", prefix, j), paramKeys, capacity)...)
+	}
+
+	return errorMessages
+}
+
+// validate проверяет правило, возвращает ошибки и имена параметров пути правила
+func (rule *Rule) validate(rulePrefix string) ([]string, []string) {
+	var errorMessages []string
+
+	if rule.URLPathPattern != "" && rule.URLPathRegex != "" {
+		errorMessages = append(errorMessages,
+			fmt.Sprintf("%s: only one of URL pattern and URL regex may be specified", rulePrefix))
+	}
+
+	var names []string
+	if rule.URLPathRegex != "" {
+		re, err := regexp.Compile(rule.URLPathRegex)
+		if err != nil {
+			errorMessages = append(errorMessages,
+				fmt.Sprintf("%s: invalid URL regex: %v", rulePrefix, err))
+		} else {
+			names = re.SubexpNames()
+		}
+
+	} else {
+		p, err := pattern.NewPattern(rule.URLPathPattern)
+		if err != nil {
+			errorMessages = append(errorMessages,
+				fmt.Sprintf("%s: invalid URL pattern: %v", rulePrefix, err))
+		} else {
+			names = p.Names()
+		}
+	}
+
+	if rule.HeaderKey != "" && rule.HeaderVal == "" {
+		errorMessages = append(errorMessages,
+			fmt.Sprintf("%s: header key '%s' provided but header value is empty",
+				rulePrefix, rule.HeaderKey))
+	}
+
+	if rule.HeaderVal != "" && rule.HeaderKey == "" {
+		errorMessages = append(errorMessages,
+			fmt.Sprintf("%s: header value provided but header key is empty",
+				rulePrefix))
+	}
+
+	if len(rule.SourceCIDRs) > 0 {
+		if _, err := clientip.ParseSet(rule.SourceCIDRs); err != nil {
+			errorMessages = append(errorMessages,
+				fmt.Sprintf("%s: invalid source CIDRs: %v", rulePrefix, err))
+		}
+	}
+
+	for name := range rule.Claims {
+		if name == "" {
+			errorMessages = append(errorMessages, fmt.Sprintf("%s: claim name is empty", rulePrefix))
+		}
+	}
+
+	if rule.Cost != nil {
+		if _, err := rule.Cost.compile(); err != nil {
+			errorMessages = append(errorMessages, fmt.Sprintf("%s: invalid cost: %v", rulePrefix, err))
+		}
+	}
+
+	if rule.HeaderVal == "" && rule.HeaderKey == "" && rule.URLPathPattern == "" && rule.URLPathRegex == "" &&
+		len(rule.SourceCIDRs) == 0 && len(rule.Claims) == 0 {
+		errorMessages = append(errorMessages,
+			fmt.Sprintf("%s: rule is empty - must specify either header, URL pattern, source CIDRs or claims",
+				rulePrefix))
+	}
+
+	return errorMessages, names
+}
+
 type Header struct {
-	key string
-	val string
+	key           string // ключ в каноническом виде, см. http.CanonicalHeaderKey
+	val           string // значение из конфигурации без пробелов по краям
+	caseSensitive bool
+}
+
+// newHeader нормализует ключ и значение один раз при компиляции правила,
+// чтобы на каждом запросе выполнялось только сравнение
+func newHeader(key, val string, caseSensitive bool) *Header {
+	return &Header{
+		key:           http.CanonicalHeaderKey(key),
+		val:           strings.TrimSpace(val),
+		caseSensitive: caseSensitive,
+	}
 }
 
 func (h *Header) String() string {
+	if h.caseSensitive {
+		return h.key + ": " + h.val + " (case sensitive)"
+	}
+
 	return h.key + ": " + h.val
 }
 
+// Match проверяет значения заголовка запроса.
+// Заголовок может встречаться несколько раз и содержать несколько значений через запятую,
+// правило срабатывает, если совпало всё значение целиком либо любой из его элементов
+func (h *Header) Match(header http.Header) bool {
+	for _, v := range header[h.key] {
+		if h.equal(strings.TrimSpace(v)) {
+			return true
+		}
+
+		if strings.IndexByte(v, ',') < 0 {
+			continue
+		}
+
+		// ручной перебор, для исключения аллокаций на strings.Split
+		for v != "" {
+			var entry string
+
+			if i := strings.IndexByte(v, ','); i >= 0 {
+				entry, v = v[:i], v[i+1:]
+			} else {
+				entry, v = v, ""
+			}
+
+			if h.equal(strings.TrimSpace(entry)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (h *Header) equal(v string) bool {
+	if h.caseSensitive {
+		return v == h.val
+	}
+
+	return strings.EqualFold(v, h.val)
+}
+
 type RuleImpl struct {
-	URLPathPattern *pattern.Pattern
+	ID             string
+	Description    string
+	URLPathPattern *pattern.Pattern // nil, если путь в правиле не задан
+	URLPathRegex   *regexp.Regexp   // если задан, то используется вместо URLPathPattern
 	Header         *Header
+	SourceCIDRs    *clientip.Set
+	Claims         *claimsMatcher
+	Cost           *costImpl // nil - стоимость 1
 }
 
 func (ri *RuleImpl) String() string {
+	path := ""
+	if ri.URLPathRegex != nil {
+		path = "regex:" + ri.URLPathRegex.String()
+
+	} else if ri.URLPathPattern != nil {
+		path = ri.URLPathPattern.String()
+	}
+
 	if ri.Header != nil {
-		return "[" + ri.URLPathPattern.String() + ", " + ri.Header.String() + "]"
+		path += ", " + ri.Header.String()
+	}
 
+	if ri.SourceCIDRs != nil {
+		path += ", source: " + ri.SourceCIDRs.String()
+	}
+
+	if ri.Claims != nil {
+		path += ", claims: " + ri.Claims.String()
+	}
+
+	if ri.Cost != nil {
+		path += ", cost: " + ri.Cost.String()
+	}
+
+	if ri.ID == "" {
+		return "[" + path + "]"
+	}
+
+	name := "id: " + ri.ID
+	if ri.Description != "" {
+		name += " (" + ri.Description + ")"
+	}
+
+	if path != "" && !strings.HasPrefix(path, ", ") {
+		name += ", "
+	}
+
+	return "[" + name + path + "]"
+}
+
+// selector возвращает путь правила в том виде, как он задан в конфигурации,
+// используется для ссылок на правило, например в токенах обхода лимитов
+func (ri *RuleImpl) selector() string {
+	if ri.URLPathRegex != nil {
+		return ri.URLPathRegex.String()
+	}
+
+	if ri.URLPathPattern != nil {
+		return ri.URLPathPattern.String()
+	}
+
+	return ""
+}
+
+func (ri *RuleImpl) matchPath(urlPath []byte) bool {
+	if ri.URLPathRegex != nil {
+		return ri.URLPathRegex.Match(urlPath)
+	}
+
+	if ri.URLPathPattern == nil {
+		return true
+	}
+
+	return ri.URLPathPattern.Match(urlPath)
+}
+
+// param возвращает значение именованного параметра пути,
+// путь должен соответствовать правилу
+func (ri *RuleImpl) param(urlPath []byte, name string) ([]byte, bool) {
+	if ri.URLPathRegex == nil {
+		if ri.URLPathPattern == nil {
+			return nil, false
+		}
+
+		return ri.URLPathPattern.Param(urlPath, name)
+	}
+
+	idx := ri.URLPathRegex.SubexpIndex(name)
+	if idx < 0 {
+		return nil, false
+	}
+
+	loc := ri.URLPathRegex.FindSubmatchIndex(urlPath)
+	if loc == nil || loc[2*idx] < 0 {
+		return nil, false
+	}
+
+	return urlPath[loc[2*idx]:loc[2*idx+1]], true
+}
+
+// params возвращает параметры пути в виде полей для логов: name=value
+func (ri *RuleImpl) params(urlPath []byte) []string {
+	var names []string
+	if ri.URLPathRegex != nil {
+		names = ri.URLPathRegex.SubexpNames()
+
+	} else if ri.URLPathPattern != nil {
+		names = ri.URLPathPattern.Names()
+	}
+
+	var fields []string
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+
+		if val, ok := ri.param(urlPath, name); ok {
+			fields = append(fields, name+"="+string(val))
+		}
+	}
+
+	return fields
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
 	}
 
-	return "[" + ri.URLPathPattern.String() + "]"
+	return false
 }
@@ -0,0 +1,312 @@
+package traefik_ratelimit
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLimits_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  Limits
+		wantErr string
+	}{
+		{
+			name: "valid pattern with bucket key",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, BucketKey: "param:id", Rules: []Rule{{URLPathPattern: "/users/{id}"}}},
+			}},
+		},
+		{
+			name: "valid regex with bucket key",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, BucketKey: "param:id", Rules: []Rule{{URLPathRegex: `^/users/(?P<id>\d+)$`}}},
+			}},
+		},
+		{
+			name: "pattern and regex together",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, Rules: []Rule{{URLPathPattern: "/users", URLPathRegex: "^/users$"}}},
+			}},
+			wantErr: "only one of URL pattern and URL regex",
+		},
+		{
+			name: "invalid regex",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, Rules: []Rule{{URLPathRegex: "^/users/(["}}},
+			}},
+			wantErr: "invalid URL regex",
+		},
+		{
+			name: "valid multi any and glob pattern",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, Rules: []Rule{{URLPathPattern: "/api/**/v*/*.json$"}}},
+			}},
+		},
+		{
+			name: "end anchor in the middle of pattern",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, Rules: []Rule{{URLPathPattern: "/api$/users"}}},
+			}},
+			wantErr: "invalid URL pattern",
+		},
+		{
+			name: "valid source cidrs with ip bucket key",
+			limits: Limits{
+				ClientIP: &ClientIP{TrustedProxies: []string{"10.0.0.0/8"}, Depth: 1},
+				Limits: []Limit{
+					{Limit: 1, BucketKey: "ip", Rules: []Rule{{SourceCIDRs: []string{"192.168.0.0/16", "1.2.3.4"}}}},
+				},
+			},
+		},
+		{
+			name: "invalid source cidr",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, Rules: []Rule{{SourceCIDRs: []string{"192.168.0.0/40"}}}},
+			}},
+			wantErr: "invalid source CIDRs",
+		},
+		{
+			name: "invalid trusted proxies",
+			limits: Limits{
+				ClientIP: &ClientIP{TrustedProxies: []string{"proxy"}},
+				Limits:   []Limit{{Limit: 1, Rules: []Rule{{URLPathPattern: "/"}}}},
+			},
+			wantErr: "[clientip]",
+		},
+		{
+			name: "only access lists",
+			limits: Limits{
+				Allow: []Rule{{SourceCIDRs: []string{"10.0.0.0/8"}}},
+				Deny:  []Rule{{URLPathPattern: "/admin"}},
+			},
+		},
+		{
+			name: "invalid deny status",
+			limits: Limits{
+				Deny:       []Rule{{URLPathPattern: "/admin"}},
+				DenyStatus: 500,
+			},
+			wantErr: "[denystatus]",
+		},
+		{
+			name: "invalid allow rule",
+			limits: Limits{
+				Allow: []Rule{{HeaderKey: "X-Health"}},
+			},
+			wantErr: "[allow, rule 0]",
+		},
+		{
+			name:    "empty config",
+			limits:  Limits{},
+			wantErr: "limits are required",
+		},
+		{
+			name: "invalid bypass ttl",
+			limits: Limits{
+				Limits: []Limit{{Limit: 1, Rules: []Rule{{URLPathPattern: "/"}}}},
+				Bypass: &Bypass{Keys: []BypassKey{{ID: "k1", Secret: "s"}}, MaxTTL: "day"},
+			},
+			wantErr: "[bypass]",
+		},
+		{
+			name: "duplicate bypass key",
+			limits: Limits{
+				Limits: []Limit{{Limit: 1, Rules: []Rule{{URLPathPattern: "/"}}}},
+				Bypass: &Bypass{Keys: []BypassKey{{ID: "k1", Secret: "s"}, {ID: "k1", Secret: "s2"}}},
+			},
+			wantErr: "duplicate key id",
+		},
+		{
+			name: "valid claims with claim bucket key",
+			limits: Limits{
+				JWT: &JWT{Verify: true, Keys: []JWTKey{{Alg: "HS256", Secret: "s"}}},
+				Limits: []Limit{
+					{Limit: 1, BucketKey: "claim:merchant_id", Rules: []Rule{{Claims: map[string]string{"tier": "free"}}}},
+				},
+			},
+		},
+		{
+			name: "jwt verify without keys",
+			limits: Limits{
+				JWT:    &JWT{Verify: true},
+				Limits: []Limit{{Limit: 1, Rules: []Rule{{URLPathPattern: "/"}}}},
+			},
+			wantErr: "[jwt]",
+		},
+		{
+			name: "jwt invalid public key",
+			limits: Limits{
+				JWT:    &JWT{Verify: true, Keys: []JWTKey{{Alg: "RS256", PublicKey: "not a pem"}}},
+				Limits: []Limit{{Limit: 1, Rules: []Rule{{URLPathPattern: "/"}}}},
+			},
+			wantErr: "[jwt]",
+		},
+		{
+			name: "jwt unsupported alg",
+			limits: Limits{
+				JWT:    &JWT{Verify: true, Keys: []JWTKey{{Alg: "none"}}},
+				Limits: []Limit{{Limit: 1, Rules: []Rule{{URLPathPattern: "/"}}}},
+			},
+			wantErr: "unsupported token algorithm",
+		},
+		{
+			name: "valid tiers without limit",
+			limits: Limits{Limits: []Limit{
+				{Tiers: &Tiers{Key: "claim:plan", Default: "free", Limits: map[string]int{"free": 10}}, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+		},
+		{
+			name: "limit and tiers",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, Tiers: &Tiers{Key: "claim:plan", Default: "free", Limits: map[string]int{"free": 10}}, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+			wantErr: "only one of limit and tiers",
+		},
+		{
+			name: "invalid tiers",
+			limits: Limits{Limits: []Limit{
+				{Tiers: &Tiers{Key: "claim:plan", Limits: map[string]int{"free": 10}}, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+			wantErr: "[limit 0, tiers]: default tier is required",
+		},
+		{
+			name: "valid daily quota without rps",
+			limits: Limits{Limits: []Limit{
+				{PerDay: 1000000, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+		},
+		{
+			name: "limit and rps",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, RPS: 1, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+			wantErr: "only one of limit and rps",
+		},
+		{
+			name: "negative per minute quota",
+			limits: Limits{Limits: []Limit{
+				{RPS: 1, PerMinute: -1, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+			wantErr: "perminute and perday must not be negative",
+		},
+		{
+			name: "invalid rule cost",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, Rules: []Rule{{URLPathPattern: "/export", Cost: &Cost{Header: "X-Batch-Size"}}}},
+			}},
+			wantErr: "[limit 0, rule 0]: invalid cost",
+		},
+		{
+			name: "valid children",
+			limits: Limits{Limits: []Limit{
+				{
+					Limit:     10000,
+					BucketKey: "param:merchantId",
+					Children: []Limit{
+						{Limit: 500, Rules: []Rule{{URLPathPattern: "/api/v2/merchants/{merchantId}/**"}}},
+					},
+				},
+			}},
+		},
+		{
+			name: "child without rules",
+			limits: Limits{Limits: []Limit{
+				{Limit: 100, Children: []Limit{{Limit: 10}}},
+			}},
+			wantErr: "[limit 0, child 0]: no rules specified",
+		},
+		{
+			name: "parent bucket key param not captured by child",
+			limits: Limits{Limits: []Limit{
+				{Limit: 100, BucketKey: "param:id", Children: []Limit{{Limit: 10, Rules: []Rule{{URLPathPattern: "/users/*"}}}}},
+			}},
+			wantErr: "[limit 0, child 0, rule 0]: bucket key path param 'id' is not captured by the rule",
+		},
+		{
+			name: "invalid match policy",
+			limits: Limits{
+				MatchPolicy: "any",
+				Limits:      []Limit{{Limit: 1, Rules: []Rule{{URLPathPattern: "/"}}}},
+			},
+			wantErr: "[matchpolicy]: must be 'all' or 'first'",
+		},
+		{
+			name: "valid adaptive without limit",
+			limits: Limits{Limits: []Limit{
+				{Adaptive: &Adaptive{Min: 10, Max: 1000}, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+		},
+		{
+			name: "adaptive limit out of bounds",
+			limits: Limits{Limits: []Limit{
+				{Limit: 5, Adaptive: &Adaptive{Min: 10, Max: 1000}, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+			wantErr: "[limit 0, adaptive]: limit 5 is out of [10, 1000]",
+		},
+		{
+			name: "valid breaker without limit",
+			limits: Limits{Limits: []Limit{
+				{Breaker: &Breaker{ConsecutiveFailures: 5}, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+		},
+		{
+			name: "breaker without thresholds",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, Breaker: &Breaker{OpenTimeout: "1m"}, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+			wantErr: "[limit 0, breaker]: errorrate or consecutivefailures is required",
+		},
+		{
+			name: "valid schedule without limit",
+			limits: Limits{Limits: []Limit{
+				{Schedule: &Schedule{Periods: []SchedulePeriod{{Days: "mon-fri", Limit: 100}, {Days: "sat-sun", Limit: 10}}}, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+		},
+		{
+			name: "schedule with limit",
+			limits: Limits{Limits: []Limit{
+				{Limit: 10, Schedule: &Schedule{Periods: []SchedulePeriod{{Limit: 100}}}, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+			wantErr: "[limit 0]: schedule may not be combined with limit, tiers or adaptive",
+		},
+		{
+			name: "schedule with gap",
+			limits: Limits{Limits: []Limit{
+				{Schedule: &Schedule{Periods: []SchedulePeriod{{Days: "mon-fri", Limit: 100}}}, Rules: []Rule{{URLPathPattern: "/"}}},
+			}},
+			wantErr: "[limit 0, schedule]: periods do not cover sun 00:00",
+		},
+		{
+			name: "unknown bucket key source",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, BucketKey: "cookie:id", Rules: []Rule{{URLPathPattern: "/users/{id}"}}},
+			}},
+			wantErr: "unknown source",
+		},
+		{
+			name: "bucket key param not captured",
+			limits: Limits{Limits: []Limit{
+				{Limit: 1, BucketKey: "param:id", Rules: []Rule{{URLPathPattern: "/users/*"}}},
+			}},
+			wantErr: "is not captured by the rule",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.validate()
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
 )
@@ -20,10 +21,51 @@ type Config struct {
 	KeeperURL              string `json:"keeperURL,omitempty"`
 	KeeperSettingsEndpoint string `json:"keeperSettingsEndpoint,omitempty"`
 	KeeperRateLimitKey     string `json:"keeperRateLimitKey,omitempty"`
-	KeeperReqTimeout       string `json:"keeperReqTimeout,omitempty"`
-	KeeperReloadInterval   string `json:"keeperReloadInterval,omitempty"`
-	RatelimitDebug         string `json:"ratelimitDebug,omitempty"`
-	RatelimitData          string `json:"ratelimitData,omitempty"`
+	// KeeperServiceKey ключ keeper с переопределениями лимитов сервиса поверх keeperRateLimitKey и ratelimitData
+	KeeperServiceKey     string `json:"keeperServiceKey,omitempty"`
+	KeeperReqTimeout     string `json:"keeperReqTimeout,omitempty"`
+	KeeperReloadInterval string `json:"keeperReloadInterval,omitempty"`
+	RatelimitDebug       string `json:"ratelimitDebug,omitempty"`
+	RatelimitData        string `json:"ratelimitData,omitempty"`
+	// BypassKeys ключи подписи токенов обхода лимитов "id1:secret1,id2:secret2"
+	BypassKeys string `json:"bypassKeys,omitempty"`
+	// RedisAddr адрес общего хранилища счётчиков (Redis или совместимое), если задан, лимиты действуют на все реплики вместе
+	RedisAddr     string `json:"redisAddr,omitempty"`
+	RedisPassword string `json:"redisPassword,omitempty"`
+	RedisDB       int    `json:"redisDB,omitempty"`
+	RedisTimeout  string `json:"redisTimeout,omitempty"`
+	// ReplicaCount количество реплик traefik, между которыми делятся лимиты, если общее хранилище не задано:
+	// число, "dns:<name>", "srv:<name>" или "keeper:<key>"
+	ReplicaCount string `json:"replicaCount,omitempty"`
+	// GossipAddr адрес UDP для обмена расходом лимитов между репликами, например ":7946", если задан, gossip включён
+	GossipAddr string `json:"gossipAddr,omitempty"`
+	// GossipPeers адреса реплик "host:port,host:port" или "dns:<name>:<port>"
+	GossipPeers    string `json:"gossipPeers,omitempty"`
+	GossipSecret   string `json:"gossipSecret,omitempty"`
+	GossipInterval string `json:"gossipInterval,omitempty"`
+	// ConfigSource источник конфигурации лимитов: "keeper" (по умолчанию), "etcd", "consul" или "kubernetes"
+	ConfigSource string `json:"configSource,omitempty"`
+	// EtcdURL адрес JSON gateway etcd v3, например "http://etcd:2379"
+	EtcdURL string `json:"etcdURL,omitempty"`
+	EtcdKey string `json:"etcdKey,omitempty"`
+	// ConsulURL адрес HTTP API consul, например "http://consul:8500"
+	ConsulURL   string `json:"consulURL,omitempty"`
+	ConsulKey   string `json:"consulKey,omitempty"`
+	ConsulToken string `json:"consulToken,omitempty"`
+	// KubernetesConfigMap имя ConfigMap, ключ KubernetesKey которого содержит конфигурацию. API и токен берутся из service account пода
+	KubernetesConfigMap string `json:"kubernetesConfigMap,omitempty"`
+	KubernetesKey       string `json:"kubernetesKey,omitempty"`
+	KubernetesNamespace string `json:"kubernetesNamespace,omitempty"`
+	// KubernetesURL адрес API без авторизации, например kubectl proxy, вместо API кластера
+	KubernetesURL string `json:"kubernetesURL,omitempty"`
+	// ConfigHistorySize количество последних принятых конфигураций в истории, по умолчанию 10
+	ConfigHistorySize int `json:"configHistorySize,omitempty"`
+	// ConfigHistoryFile файл, в котором история сохраняется между перезапусками
+	ConfigHistoryFile string `json:"configHistoryFile,omitempty"`
+	// ConfigPin закрепляет конфигурацию: "current" или mod_revision слоя окружения из истории
+	ConfigPin string `json:"configPin,omitempty"`
+	// KeeperControlKey ключ keeper с командами, например {"pin": "42"}, имеет приоритет над ConfigPin
+	KeeperControlKey string `json:"keeperControlKey,omitempty"`
 }
 
 func CreateConfig() *Config {
@@ -43,13 +85,45 @@ type TraefikRateLimiter struct {
 func (rl *TraefikRateLimiter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	encoder := json.NewEncoder(rw)
 
-	if globalRateLimiter.Allow(req) {
+	// при канареечном применении конфигурации часть клиентов проверяется лимитами новой конфигурации
+	limiter, side := globalRateLimiter.route(req)
+
+	claims := limiter.verifyBypass(req)
+
+	d := limiter.decide(req, claims)
+	side.count(d.allow)
+
+	if limiter.headers.Load() {
+		d.writeHeaders(rw.Header())
+	}
+
+	if d.allow {
+		if d.observes() {
+			d.serveObserved(rl.next, rw, req)
+			return
+		}
+
 		rl.next.ServeHTTP(rw, req)
 		return
 	}
 
+	if d.status == http.StatusServiceUnavailable {
+		rw.Header().Set("Retry-After", strconv.FormatInt(int64((d.retryAfter+time.Second-1)/time.Second), 10))
+	}
+
 	rw.Header().Set("Content-Type", "application/json")
-	rw.WriteHeader(http.StatusTooManyRequests)
+	rw.WriteHeader(d.status)
+
+	if d.status == http.StatusForbidden {
+		_ = encoder.Encode(map[string]any{"error_code": "ERR_FORBIDDEN", "error_description": "Доступ запрещён."})
+		return
+	}
+
+	if d.status == http.StatusServiceUnavailable {
+		_ = encoder.Encode(map[string]any{"error_code": "ERR_SERVICE_UNAVAILABLE", "error_description": "Сервис временно недоступен. Повторите попытку позднее."})
+		return
+	}
+
 	_ = encoder.Encode(map[string]any{"error_code": "ERR_TOO_MANY_REQUESTS", "error_description": "Слишком много запросов. Повторите попытку позднее."})
 
 }
@@ -71,7 +145,24 @@ func New(ctx context.Context, next http.Handler, cfg *Config, name string) (http
 }
 
 func logConfig(ctx context.Context, cfg *Config) {
-	configJSON, err := json.Marshal(cfg)
+	masked := *cfg
+	if masked.BypassKeys != "" {
+		masked.BypassKeys = "***"
+	}
+
+	if masked.RedisPassword != "" {
+		masked.RedisPassword = "***"
+	}
+
+	if masked.GossipSecret != "" {
+		masked.GossipSecret = "***"
+	}
+
+	if masked.ConsulToken != "" {
+		masked.ConsulToken = "***"
+	}
+
+	configJSON, err := json.Marshal(&masked)
 	if err != nil {
 		logger.Error(ctx, fmt.Sprintf("failed to marshal config: %v", err))
 		return
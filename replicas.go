@@ -0,0 +1,265 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+)
+
+const (
+	replicasDNS    = "dns"    // количество A/AAAA записей имени, например headless сервиса
+	replicasSRV    = "srv"    // количество SRV записей
+	replicasKeeper = "keeper" // число в ключе keeper
+)
+
+// replicaShare доля реплики в лимитах: count реплик, index - номер этой реплики
+type replicaShare struct {
+	count int
+	index int
+}
+
+// split возвращает долю реплики в значении value. Остаток деления достаётся репликам с меньшими номерами,
+// поэтому сумма долей всех реплик равна value. Доля положительного значения не меньше 1,
+// так что при value меньше числа реплик сумма долей равна числу реплик
+func (rs *replicaShare) split(value int) int {
+	if rs == nil || rs.count <= 1 || value <= 0 {
+		return value
+	}
+
+	share := value / rs.count
+	if rs.index < value%rs.count {
+		share++
+	}
+
+	if share == 0 {
+		share = 1 // 0 означал бы отсутствие лимита
+	}
+
+	return share
+}
+
+// splitLimit возвращает копию лимита со значениями, разделёнными между репликами. Дочерние лимиты делятся в limitsBuilder.add
+func (rs *replicaShare) splitLimit(limit Limit) Limit {
+	if rs == nil || rs.count <= 1 {
+		return limit
+	}
+
+	return mapLimitValues(limit, rs.split)
+}
+
+// mapLimitValues возвращает копию лимита, в которой значения лимитов заменены на split(value)
+func mapLimitValues(limit Limit, split func(int) int) Limit {
+	limit.Limit = split(limit.Limit)
+	limit.RPS = split(limit.RPS)
+	limit.PerMinute = split(limit.PerMinute)
+	limit.PerDay = split(limit.PerDay)
+
+	if limit.Tiers != nil {
+		tiers := *limit.Tiers
+		tiers.Limits = make(map[string]int, len(limit.Tiers.Limits))
+		for name, value := range limit.Tiers.Limits {
+			tiers.Limits[name] = split(value)
+		}
+
+		limit.Tiers = &tiers
+	}
+
+	if limit.Adaptive != nil {
+		adaptive := *limit.Adaptive
+		adaptive.Min = split(adaptive.Min)
+		adaptive.Max = split(adaptive.Max)
+		adaptive.Increase = split(adaptive.Increase)
+		limit.Adaptive = &adaptive
+	}
+
+	if limit.Schedule != nil {
+		schedule := *limit.Schedule
+		schedule.Periods = make([]SchedulePeriod, len(limit.Schedule.Periods))
+		for i, p := range limit.Schedule.Periods {
+			p.Limit = split(p.Limit)
+			schedule.Periods[i] = p
+		}
+
+		limit.Schedule = &schedule
+	}
+
+	return limit
+}
+
+func (rs *replicaShare) String() string {
+	return strconv.Itoa(rs.index) + "/" + strconv.Itoa(rs.count)
+}
+
+// replicaConfig источник количества реплик из конфигурации middleware, source nil - лимиты не делятся
+type replicaConfig struct {
+	source replicaSource
+}
+
+// replicaSource источник количества реплик traefik
+type replicaSource interface {
+	// replicas возвращает количество реплик и номер этой реплики
+	replicas(ctx context.Context) (*replicaShare, error)
+}
+
+// parseReplicaSource разбирает replicaCount: число, "dns:<name>", "srv:<name>" или "keeper:<key>".
+// Для числа и keeper номер реплики берётся из порядкового номера пода StatefulSet в имени хоста host
+func parseReplicaSource(s, host string, kc func() *keeper.KeeperClient) (replicaSource, error) {
+	if count, err := strconv.Atoi(s); err == nil {
+		if count <= 0 {
+			return nil, fmt.Errorf("replica count must be greater than 0, got %d", count)
+		}
+
+		ordinal, errOrdinal := hostOrdinal(host)
+		if errOrdinal != nil {
+			return nil, fmt.Errorf("replica count '%s': %w", s, errOrdinal)
+		}
+
+		return &staticReplicas{count: count, ordinal: ordinal}, nil
+	}
+
+	source, name, _ := strings.Cut(s, ":")
+	if name == "" {
+		return nil, fmt.Errorf("replica count '%s': want a number or '<source>:<name>'", s)
+	}
+
+	switch source {
+	case replicasDNS:
+		return dnsReplicas(name), nil
+
+	case replicasSRV:
+		return srvReplicas(name), nil
+
+	case replicasKeeper:
+		ordinal, err := hostOrdinal(host)
+		if err != nil {
+			return nil, fmt.Errorf("replica count '%s': %w", s, err)
+		}
+
+		return &keeperReplicas{key: name, ordinal: ordinal, client: kc}, nil
+	}
+
+	return nil, fmt.Errorf("replica count '%s': unknown source '%s'", s, source)
+}
+
+type staticReplicas struct {
+	count   int
+	ordinal int
+}
+
+func (sr *staticReplicas) replicas(_ context.Context) (*replicaShare, error) {
+	return ordinalShare(sr.count, sr.ordinal)
+}
+
+type dnsReplicas string
+
+func (dr dnsReplicas) replicas(ctx context.Context) (*replicaShare, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, string(dr))
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", string(dr), err)
+	}
+
+	sort.Strings(addrs)
+
+	rs := &replicaShare{count: len(addrs), index: -1}
+
+	if own, errAddrs := net.InterfaceAddrs(); errAddrs == nil {
+		for i, addr := range addrs {
+			for _, o := range own {
+				if ipNet, ok := o.(*net.IPNet); ok && ipNet.IP.String() == addr {
+					rs.index = i
+				}
+			}
+		}
+	}
+
+	if rs.index == -1 {
+		return nil, fmt.Errorf("lookup %s: own address not found among %d records", string(dr), rs.count)
+	}
+
+	return rs, nil
+}
+
+type srvReplicas string
+
+func (sr srvReplicas) replicas(ctx context.Context) (*replicaShare, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", string(sr))
+	if err != nil {
+		return nil, fmt.Errorf("lookup srv %s: %w", string(sr), err)
+	}
+
+	targets := make([]string, len(records))
+	for i, r := range records {
+		targets[i] = r.Target
+	}
+
+	sort.Strings(targets)
+
+	rs := &replicaShare{count: len(targets), index: -1}
+
+	if host, errHost := os.Hostname(); errHost == nil {
+		for i, target := range targets {
+			if strings.HasPrefix(target, host+".") {
+				rs.index = i
+			}
+		}
+	}
+
+	if rs.index == -1 {
+		return nil, fmt.Errorf("lookup srv %s: own hostname not found among %d targets", string(sr), rs.count)
+	}
+
+	return rs, nil
+}
+
+type keeperReplicas struct {
+	key     string
+	ordinal int
+	client  func() *keeper.KeeperClient
+}
+
+func (kr *keeperReplicas) replicas(ctx context.Context) (*replicaShare, error) {
+	kc := kr.client()
+	if kc == nil {
+		return nil, fmt.Errorf("keeperClient not init")
+	}
+
+	value, err := kc.GetValue(ctx, kr.key)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(value.Value))
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("keeper key %s: invalid replica count '%s'", kr.key, value.Value)
+	}
+
+	return ordinalShare(count, kr.ordinal)
+}
+
+// ordinalShare доля реплики с порядковым номером пода ordinal. Номер за пределами count означает,
+// что количество реплик ещё не обновлено, и совпал бы с номером другой реплики
+func ordinalShare(count, ordinal int) (*replicaShare, error) {
+	if ordinal >= count {
+		return nil, fmt.Errorf("replica ordinal %d is out of replica count %d", ordinal, count)
+	}
+
+	return &replicaShare{count: count, index: ordinal}, nil
+}
+
+// hostOrdinal порядковый номер пода StatefulSet из имени хоста ("traefik-2"). Без него номера реплик
+// не уникальны и сумма долей не равна лимиту, поэтому нужен источник dns или srv
+func hostOrdinal(host string) (int, error) {
+	if i := strings.LastIndexByte(host, '-'); i >= 0 {
+		if ordinal, err := strconv.Atoi(host[i+1:]); err == nil && ordinal >= 0 {
+			return ordinal, nil
+		}
+	}
+
+	return 0, fmt.Errorf("hostname '%s' has no StatefulSet ordinal, use dns or srv source", host)
+}
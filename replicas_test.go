@@ -0,0 +1,187 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+)
+
+func TestReplicaShare_split(t *testing.T) {
+	for _, tt := range []struct{ value, count int }{{10, 3}, {100, 7}, {5, 5}, {1000, 1}} {
+		total := 0
+		for index := 0; index < tt.count; index++ {
+			total += (&replicaShare{count: tt.count, index: index}).split(tt.value)
+		}
+
+		if total != tt.value {
+			t.Errorf("split(%d) over %d replicas: total %d, want %d", tt.value, tt.count, total, tt.value)
+		}
+	}
+
+	if got := (&replicaShare{count: 3, index: 2}).split(2); got != 1 {
+		t.Errorf("split(2) = %d, want 1: share must not become unlimited 0", got)
+	}
+
+	// лимит меньше числа реплик: каждая пропускает 1, сумма равна числу реплик
+	total := 0
+	for index := 0; index < 5; index++ {
+		total += (&replicaShare{count: 5, index: index}).split(2)
+	}
+
+	if total != 5 {
+		t.Errorf("split(2) over 5 replicas: total %d, want 5", total)
+	}
+
+	if got := (*replicaShare)(nil).split(10); got != 10 {
+		t.Errorf("nil split(10) = %d, want 10", got)
+	}
+}
+
+func TestReplicaShare_splitLimit(t *testing.T) {
+	limit := Limit{
+		PerMinute: 600,
+		Tiers:     &Tiers{Key: "header:X-Plan", Default: "free", Limits: map[string]int{"free": 10, "gold": 100}},
+	}
+
+	got := (&replicaShare{count: 3, index: 0}).splitLimit(limit)
+
+	if got.PerMinute != 200 || got.Tiers.Limits["free"] != 4 || got.Tiers.Limits["gold"] != 34 {
+		t.Errorf("splitLimit() = perminute %d, tiers %v, want 200, free 4, gold 34", got.PerMinute, got.Tiers.Limits)
+	}
+
+	if limit.Tiers.Limits["free"] != 10 {
+		t.Error("splitLimit() must not modify the original config")
+	}
+}
+
+func TestParseReplicaSource(t *testing.T) {
+	for _, tt := range []struct{ value, host, wantErr string }{
+		{value: "3", host: "traefik-2"},
+		{value: "dns:traefik-headless", host: "gateway"},
+		{value: "srv:_web._tcp.traefik", host: "gateway"},
+		{value: "keeper:traefik-replicas", host: "traefik-0"},
+		{value: "0", host: "traefik-0", wantErr: "must be greater than 0"},
+		{value: "3", host: "traefik-7d9f8b-x2k4q", wantErr: "has no StatefulSet ordinal"},
+		{value: "keeper:traefik-replicas", host: "gateway", wantErr: "has no StatefulSet ordinal"},
+		{value: "consul:traefik", wantErr: "unknown source 'consul'"},
+		{value: "dns", wantErr: "want a number"},
+	} {
+		_, err := parseReplicaSource(tt.value, tt.host, nil)
+
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("parseReplicaSource(%q) unexpected error: %v", tt.value, err)
+		}
+
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("parseReplicaSource(%q) error = %v, want containing %q", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestStaticReplicas_ordinal(t *testing.T) {
+	source, err := parseReplicaSource("3", "traefik-2", nil)
+	if err != nil {
+		t.Fatalf("parseReplicaSource() error: %v", err)
+	}
+
+	share, err := source.replicas(context.Background())
+	if err != nil || share.index != 2 || share.count != 3 {
+		t.Errorf("replicas() = %+v, %v, want index 2 of 3", share, err)
+	}
+
+	// номер пода за пределами количества совпал бы с номером другой реплики
+	source, _ = parseReplicaSource("3", "traefik-3", nil)
+	if _, err = source.replicas(context.Background()); err == nil {
+		t.Error("replicas() should reject ordinal out of replica count")
+	}
+}
+
+func TestRateLimiter_updateReplicas(t *testing.T) {
+	srv := keeper.NewTestServer("4")
+	defer srv.Close()
+
+	kc := keeper.NewTestClient(http.DefaultClient, srv.URL)
+
+	source, err := parseReplicaSource("keeper:traefik-replicas", "traefik-1", func() *keeper.KeeperClient { return kc })
+	if err != nil {
+		t.Fatalf("parseReplicaSource() error: %v", err)
+	}
+
+	rl := &RateLimiter{
+		rules:         atomic.Value{},
+		replicaSource: atomic.Value{},
+		replicas:      atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+	rl.replicaSource.Store(&replicaConfig{source: source})
+
+	if !rl.updateReplicas(context.Background()) {
+		t.Fatal("updateReplicas() should report the first share")
+	}
+
+	if rl.updateReplicas(context.Background()) {
+		t.Error("updateReplicas() should not report unchanged share")
+	}
+
+	share := rl.replicas.Load().(*replicaShare)
+	if share.count != 4 {
+		t.Fatalf("replica count = %d, want 4", share.count)
+	}
+
+	rl.hotReloadLimits(&Limits{Limits: []Limit{{Limit: 10, Rules: []Rule{{URLPathPattern: "/"}}}}})
+
+	var lim *LimitImpl
+	rl.rules.Load().(*sync.Map).Range(func(_, v any) bool {
+		lim = v.(*LimitImpl)
+		return false
+	})
+
+	if want := share.split(10); lim.Limit() != want {
+		t.Errorf("Limit() = %d, want replica share %d of 10", lim.Limit(), want)
+	}
+}
+
+func TestRateLimiter_replicaCostClamp(t *testing.T) {
+	rl := &RateLimiter{
+		rules:    atomic.Value{},
+		replicas: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+	rl.replicas.Store(&replicaShare{count: 4, index: 0})
+
+	// проверка конфигурации пропускает cost 50 при limit 100, но доля реплики - 25
+	rl.hotReloadLimits(&Limits{Limits: []Limit{
+		{PerMinute: 100, Rules: []Rule{{URLPathPattern: "/export", Cost: &Cost{Value: 50}}}},
+	}})
+
+	decide := func() bool {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/export", http.NoBody)
+		return rl.decide(req, nil).allow
+	}
+
+	if !decide() {
+		t.Fatal("request with cost above the replica share should be allowed with clamped cost")
+	}
+
+	if decide() {
+		t.Error("clamped cost 25 should use up the replica window of 25")
+	}
+
+	var rule RuleImpl
+	rl.rules.Load().(*sync.Map).Range(func(k, _ any) bool {
+		rule = k.(RuleImpl)
+		return false
+	})
+
+	if got := rule.Cost.String(); got != "25 (clamped to window 25)" {
+		t.Errorf("Cost.String() = %q, want clamped to 25", got)
+	}
+}
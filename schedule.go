@@ -0,0 +1,272 @@
+package traefik_ratelimit
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/limiter"
+)
+
+const (
+	minutesPerDay  = 24 * 60
+	minutesPerWeek = 7 * minutesPerDay
+
+	// scheduleRecheck максимальный интервал проверки периода, защищает от сдвига границ при переходе на летнее время
+	scheduleRecheck = time.Hour
+)
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// scheduleSegment непрерывный отрезок недели с одним значением лимита
+type scheduleSegment struct {
+	start int // минута недели, с воскресенья 00:00
+	limit int
+}
+
+// scheduleLimit скомпилированный Schedule, переключает лимит бакета rps по времени
+type scheduleLimit struct {
+	loc      *time.Location
+	segments []scheduleSegment // отсортированы по start, первый начинается с 0
+
+	current atomic.Int64
+	logged  atomic.Int64 // значение, выведенное в лог последним
+	next    atomic.Int64 // unix nano следующей проверки периода
+
+	// бакет rps, лимит которого переключается: общий или по bucketkey
+	limiter *limiter.Limiter
+	keyed   *limiter.Keyed
+}
+
+// compile проверяет и компилирует расписание: периоды должны покрывать всю неделю без пересечений
+func (s *Schedule) compile() (*scheduleLimit, error) {
+	loc := time.UTC
+	if s.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(s.TimeZone); err != nil {
+			return nil, fmt.Errorf("invalid timezone '%s': %v", s.TimeZone, err)
+		}
+	}
+
+	if len(s.Periods) == 0 {
+		return nil, fmt.Errorf("no periods specified")
+	}
+
+	// owner[m] - номер периода, которому принадлежит минута недели m
+	owner := make([]int, minutesPerWeek)
+	for m := range owner {
+		owner[m] = -1
+	}
+
+	for i, p := range s.Periods {
+		if p.Limit <= 0 {
+			return nil, fmt.Errorf("period %d: limit value <= 0", i)
+		}
+
+		days, err := parseDays(p.Days)
+		if err != nil {
+			return nil, fmt.Errorf("period %d: %v", i, err)
+		}
+
+		from, to, err := parseTimeRange(p.From, p.To)
+		if err != nil {
+			return nil, fmt.Errorf("period %d: %v", i, err)
+		}
+
+		for _, day := range days {
+			// период, который заканчивается раньше начала, переходит на следующий день
+			for m := day*minutesPerDay + from; m < day*minutesPerDay+to; m++ {
+				wm := m % minutesPerWeek
+				if owner[wm] != -1 {
+					return nil, fmt.Errorf("period %d overlaps period %d at %s", i, owner[wm], weekMinuteString(wm))
+				}
+
+				owner[wm] = i
+			}
+		}
+	}
+
+	sl := &scheduleLimit{loc: loc}
+
+	for m, i := range owner {
+		if i == -1 {
+			return nil, fmt.Errorf("periods do not cover %s", weekMinuteString(m))
+		}
+
+		if limit := s.Periods[i].Limit; len(sl.segments) == 0 || sl.segments[len(sl.segments)-1].limit != limit {
+			sl.segments = append(sl.segments, scheduleSegment{start: m, limit: limit})
+		}
+	}
+
+	sl.current.Store(int64(sl.active(time.Now())))
+	sl.logged.Store(sl.current.Load())
+
+	return sl, nil
+}
+
+// parseDays разбирает дни недели "mon-fri", "sat,sun", пустая строка - каждый день
+func parseDays(s string) ([]int, error) {
+	if s == "" {
+		return []int{0, 1, 2, 3, 4, 5, 6}, nil
+	}
+
+	var days []int
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+
+		from, err := parseWeekday(first)
+		if err != nil {
+			return nil, err
+		}
+
+		to := from
+		if isRange {
+			if to, err = parseWeekday(last); err != nil {
+				return nil, err
+			}
+		}
+
+		// диапазон может переходить через воскресенье, например "fri-mon"
+		for d := from; ; d = (d + 1) % 7 {
+			days = append(days, d)
+			if d == to {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+func parseWeekday(s string) (int, error) {
+	for i, name := range weekdayNames {
+		if strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown day '%s', want one of %s", s, strings.Join(weekdayNames, ", "))
+}
+
+// parseTimeRange возвращает минуты дня начала и конца периода, to больше from.
+// По умолчанию период длится весь день, конец раньше начала означает переход через полночь
+func parseTimeRange(fromStr, toStr string) (int, int, error) {
+	from, to := 0, minutesPerDay
+
+	var err error
+	if fromStr != "" {
+		if from, err = parseClock(fromStr); err != nil || from == minutesPerDay {
+			return 0, 0, fmt.Errorf("invalid from '%s', want HH:MM", fromStr)
+		}
+	}
+
+	if toStr != "" {
+		if to, err = parseClock(toStr); err != nil {
+			return 0, 0, fmt.Errorf("invalid to '%s', want HH:MM", toStr)
+		}
+	}
+
+	if to == from {
+		return 0, 0, fmt.Errorf("period from '%s' to '%s' is empty", fromStr, toStr)
+	}
+
+	if to < from {
+		to += minutesPerDay
+	}
+
+	return from, to, nil
+}
+
+// parseClock разбирает время "HH:MM", допускается "24:00" как конец дня
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	if !ok || len(h) != 2 || len(m) != 2 {
+		return 0, fmt.Errorf("invalid time '%s'", s)
+	}
+
+	hours, errH := strconv.Atoi(h)
+	minutes, errM := strconv.Atoi(m)
+	if errH != nil || errM != nil || hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time '%s'", s)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+func weekMinuteString(m int) string {
+	return fmt.Sprintf("%s %02d:%02d", weekdayNames[m/minutesPerDay], m%minutesPerDay/60, m%60)
+}
+
+// weekMinute минута недели для времени в часовом поясе расписания
+func (sl *scheduleLimit) weekMinute(now time.Time) int {
+	t := now.In(sl.loc)
+	return int(t.Weekday())*minutesPerDay + t.Hour()*60 + t.Minute()
+}
+
+// segment номер отрезка, в который попадает минута недели
+func (sl *scheduleLimit) segment(m int) int {
+	return sort.Search(len(sl.segments), func(i int) bool {
+		return sl.segments[i].start > m
+	}) - 1
+}
+
+// active значение лимита, действующее в момент now
+func (sl *scheduleLimit) active(now time.Time) int {
+	return sl.segments[sl.segment(sl.weekMinute(now))].limit
+}
+
+func (sl *scheduleLimit) Current() int {
+	return int(sl.current.Load())
+}
+
+// update переключает лимит, если начался другой период. Проверка дешёвая и выполняется на каждом запросе,
+// пересчёт - только на границе периода, его выполняет выигравший CAS запрос
+func (sl *scheduleLimit) update(now time.Time) {
+	next := sl.next.Load()
+	if now.UnixNano() < next {
+		return
+	}
+
+	m := sl.weekMinute(now)
+	i := sl.segment(m)
+
+	end := minutesPerWeek
+	if i+1 < len(sl.segments) {
+		end = sl.segments[i+1].start
+	}
+
+	wait := time.Duration(end-m)*time.Minute - time.Duration(now.Second())*time.Second - time.Duration(now.Nanosecond())
+	if wait > scheduleRecheck {
+		wait = scheduleRecheck
+	}
+
+	if !sl.next.CompareAndSwap(next, now.Add(wait).UnixNano()) {
+		return
+	}
+
+	limit := sl.segments[i].limit
+	if int(sl.current.Swap(int64(limit))) == limit {
+		return
+	}
+
+	if sl.limiter != nil {
+		sl.limiter.SetLimit(limit)
+	}
+
+	if sl.keyed != nil {
+		sl.keyed.SetLimit(limit)
+	}
+}
+
+// changedSinceLog сообщает, что лимит изменился с прошлого вызова
+func (sl *scheduleLimit) changedSinceLog() bool {
+	current := sl.current.Load()
+	return sl.logged.Swap(current) != current
+}
+
+func (sl *scheduleLimit) String() string {
+	return "schedule: " + strconv.Itoa(sl.Current()) + " (" + sl.loc.String() + ")"
+}
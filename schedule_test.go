@@ -0,0 +1,142 @@
+package traefik_ratelimit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedule_compile(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+		wantErr  string
+	}{
+		{
+			name:     "whole week",
+			schedule: Schedule{Periods: []SchedulePeriod{{Limit: 100}}},
+		},
+		{
+			name: "day and night across midnight",
+			schedule: Schedule{TimeZone: "Europe/Moscow", Periods: []SchedulePeriod{
+				{Days: "mon-fri", From: "09:00", To: "21:00", Limit: 500},
+				{Days: "mon-fri", From: "21:00", To: "09:00", Limit: 100},
+				{Days: "sat,sun", Limit: 200},
+			}},
+			wantErr: "period 2 overlaps period 1 at sat 00:00",
+		},
+		{
+			name: "weekend starting friday night",
+			schedule: Schedule{Periods: []SchedulePeriod{
+				{Days: "mon-fri", From: "07:00", To: "21:00", Limit: 500},
+				{Days: "mon-thu", From: "21:00", To: "07:00", Limit: 100},
+				{Days: "fri", From: "21:00", To: "24:00", Limit: 200},
+				{Days: "sat", Limit: 200},
+				{Days: "sun", To: "24:00", Limit: 200},
+				{Days: "mon", To: "07:00", Limit: 100},
+			}},
+		},
+		{
+			name: "gap",
+			schedule: Schedule{Periods: []SchedulePeriod{
+				{From: "00:00", To: "12:00", Limit: 1},
+				{From: "12:30", To: "24:00", Limit: 2},
+			}},
+			wantErr: "periods do not cover sun 12:00",
+		},
+		{
+			name:     "invalid timezone",
+			schedule: Schedule{TimeZone: "Mars/Olympus", Periods: []SchedulePeriod{{Limit: 1}}},
+			wantErr:  "invalid timezone",
+		},
+		{
+			name:     "unknown day",
+			schedule: Schedule{Periods: []SchedulePeriod{{Days: "mon-fry", Limit: 1}}},
+			wantErr:  "period 0: unknown day 'fry'",
+		},
+		{
+			name:     "invalid time",
+			schedule: Schedule{Periods: []SchedulePeriod{{From: "9:00", Limit: 1}}},
+			wantErr:  "invalid from '9:00'",
+		},
+		{
+			name:     "empty period",
+			schedule: Schedule{Periods: []SchedulePeriod{{From: "10:00", To: "10:00", Limit: 1}}},
+			wantErr:  "is empty",
+		},
+		{
+			name:     "zero limit",
+			schedule: Schedule{Periods: []SchedulePeriod{{}}},
+			wantErr:  "period 0: limit value <= 0",
+		},
+		{
+			name:     "no periods",
+			schedule: Schedule{},
+			wantErr:  "no periods specified",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.schedule.compile()
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("compile() unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("compile() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScheduleLimit_update(t *testing.T) {
+	li := newLimitImpl(Limit{
+		Schedule: &Schedule{TimeZone: "Europe/Moscow", Periods: []SchedulePeriod{
+			{From: "09:00", To: "21:00", Limit: 500},
+			{From: "21:00", To: "09:00", Limit: 100},
+		}},
+	}, nil)
+	defer li.Close()
+
+	sl := li.schedule
+	if sl == nil || li.limiter == nil {
+		t.Fatal("schedule and limiter should be compiled")
+	}
+
+	// 1700000000 - вторник 01:13:20 по Москве
+	night := time.Unix(1700000000, 0)
+
+	sl.update(night)
+	li.changedSinceLog(night) // значение на момент создания зависит от текущего времени
+
+	if got := li.Limit(); got != 100 {
+		t.Fatalf("Limit() at night = %d, want 100", got)
+	}
+
+	if got := li.limiter.Limit(); got != 100 {
+		t.Fatalf("limiter.Limit() at night = %d, want 100", got)
+	}
+
+	if want := time.Date(2023, time.November, 15, 9, 0, 0, 0, sl.loc); time.Unix(0, sl.next.Load()).After(want) {
+		t.Errorf("next check = %v, want not after %v", time.Unix(0, sl.next.Load()).In(sl.loc), want)
+	}
+
+	sl.update(night.Add(8 * time.Hour))
+
+	if got := li.limiter.Limit(); got != 500 {
+		t.Errorf("limiter.Limit() in the morning = %d, want 500", got)
+	}
+
+	if !strings.Contains(li.String(), "schedule: 500 (Europe/Moscow)") {
+		t.Errorf("String() = %q, want active value", li.String())
+	}
+
+	if !li.changedSinceLog(night.Add(8*time.Hour)) || li.changedSinceLog(night.Add(8*time.Hour)) {
+		t.Error("changedSinceLog() should report the switch exactly once")
+	}
+}
@@ -0,0 +1,351 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/limiter"
+	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
+	"github.com/wbpaygate/traefik-ratelimit/internal/resp"
+)
+
+const (
+	defaultSharedTimeout = 50 * time.Millisecond
+	defaultSharedRetry   = 5 * time.Second
+
+	sharedKeyPrefix = "ratelimit:"
+
+	// sharedBatchShare доля лимита реплики, резервируемая за один запрос в хранилище
+	sharedBatchShare = 10
+	// sharedMinBatch лимит меньше sharedMinBatch разрешений на реплику считается в хранилище по запросу,
+	// а следующая пачка заранее резервируется, только если пачка не меньше sharedMinBatch
+	sharedMinBatch = 10
+
+	sharedSweepEvery = 1024 // очистка аренд прошедших окон раз в столько резервирований
+
+	// sharedOverflowKey ключ общей аренды ключей бакета сверх limiter.KeyedMaxKeys, не совпадает со значением заголовка
+	sharedOverflowKey = "\x00overflow"
+)
+
+// sharedStore общее хранилище счётчиков лимитов для всех реплик traefik.
+// Реплика резервирует разрешения пачками (INCRBY+PEXPIRE одним запросом) и расходует их локально,
+// поэтому запрос в хранилище выполняется раз в пачку, а не на каждый запрос. Пачка - десятая часть доли
+// реплики в лимите, так что неизрасходованные пачки всех реплик не превышают десятой части лимита.
+// Следующая большая пачка резервируется в фоне, когда израсходована половина текущей, малые лимиты считаются по запросу.
+// Если хранилище недоступно, лимиты retry времени считаются локально
+type sharedStore struct {
+	client   *resp.Client
+	retry    time.Duration
+	replicas atomic.Int64 // количество реплик из replicaCount, 0 - неизвестно
+
+	downUntil atomic.Int64 // unix nano, до которого хранилище считается недоступным
+	down      atomic.Bool
+}
+
+func newSharedStore(addr, password string, db int, timeout time.Duration) *sharedStore {
+	if timeout <= 0 {
+		timeout = defaultSharedTimeout
+	}
+
+	return &sharedStore{
+		client: resp.NewClient(addr, password, db, timeout),
+		retry:  defaultSharedRetry,
+	}
+}
+
+func (s *sharedStore) Close() {
+	s.client.Close()
+}
+
+// replicaCount количество реплик, между которыми делятся пачки, не меньше 1
+func (s *sharedStore) replicaCount() int {
+	if n := int(s.replicas.Load()); n > 1 {
+		return n
+	}
+
+	return 1
+}
+
+// available сообщает, что лимиты нужно считать в хранилище
+func (s *sharedStore) available(now time.Time) bool {
+	return now.UnixNano() >= s.downUntil.Load()
+}
+
+// incr резервирует n разрешений в окне key и возвращает счётчик окна после резервирования
+func (s *sharedStore) incr(ctx context.Context, key string, n int, ttl time.Duration, now time.Time) (int, error) {
+	replies, err := s.client.Do(ctx,
+		[]string{"INCRBY", key, strconv.Itoa(n)},
+		[]string{"PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10)},
+	)
+	if err == nil {
+		if e, ok := replies[0].(resp.Error); ok {
+			err = e
+		}
+	}
+
+	if err != nil {
+		s.downUntil.Store(now.Add(s.retry).UnixNano())
+		if !s.down.Swap(true) {
+			logger.Warn(ctx, "shared store "+s.client.Addr()+" is unavailable, limits are counted locally", "error="+err.Error())
+		}
+
+		return 0, err
+	}
+
+	if s.down.Swap(false) {
+		logger.Info(ctx, "shared store "+s.client.Addr()+" is available again")
+	}
+
+	count, _ := replies[0].(int64)
+
+	return int(count), nil
+}
+
+// sharedWindow окно лимита в общем хранилище, дублирует локальный бакет
+type sharedWindow struct {
+	store  *sharedStore
+	id     string
+	period time.Duration
+	local  interface{ Limit() int } // локальный бакет, из него берётся текущее значение лимита
+
+	leases       sync.Map // ключ бакета -> *lease
+	keys         atomic.Int64
+	maxKeys      int64
+	overflow     lease // общая аренда ключей сверх maxKeys
+	acquisitions atomic.Int64
+}
+
+// lease разрешения, зарезервированные репликой в текущем окне
+type lease struct {
+	mu        sync.Mutex
+	window    int64 // unix nano начала окна
+	tokens    int   // зарезервированные и ещё не израсходованные
+	count     int   // счётчик окна в хранилище при последнем резервировании
+	exhausted bool  // в окне хранилища не осталось разрешений
+
+	reserving chan struct{} // закрывается по завершении резервирования, nil - резервирования нет
+	err       error         // ошибка последнего резервирования
+}
+
+func newSharedWindow(store *sharedStore, id string, period time.Duration, local interface{ Limit() int }) *sharedWindow {
+	return &sharedWindow{
+		store:   store,
+		id:      id + ":" + strconv.FormatInt(int64(period/time.Second), 10),
+		period:  period,
+		local:   local,
+		maxKeys: limiter.KeyedMaxKeys,
+	}
+}
+
+// batch размер пачки резервирования: доля лимита на реплику, не меньше n. Лимит меньше sharedMinBatch
+// разрешений на реплику считается по запросу, иначе первая реплика зарезервировала бы окно остальных
+func (sw *sharedWindow) batch(limit, n int) int {
+	replicas := sw.store.replicaCount()
+
+	batch := n
+	if limit > replicas*sharedMinBatch {
+		batch = limit / (replicas * sharedBatchShare)
+	}
+
+	if batch < n {
+		batch = n
+	}
+
+	if batch < 1 {
+		batch = 1
+	}
+
+	return batch
+}
+
+// leaseOf возвращает аренду ключа и ключ её счётчика в хранилище, создавая аренду.
+// Если ключей уже maxKeys, новый ключ получает общую аренду, как ключи сверх limiter.KeyedMaxKeys в локальных бакетах
+func (sw *sharedWindow) leaseOf(key string) (*lease, string) {
+	if v, ok := sw.leases.Load(key); ok {
+		return v.(*lease), key
+	}
+
+	// место резервируется до вставки, чтобы параллельные вставки не превысили maxKeys
+	if sw.keys.Add(1) > sw.maxKeys {
+		sw.keys.Add(-1)
+		return &sw.overflow, sharedOverflowKey
+	}
+
+	v, loaded := sw.leases.LoadOrStore(key, &lease{})
+	if loaded {
+		sw.keys.Add(-1)
+	}
+
+	return v.(*lease), key
+}
+
+// take списывает n разрешений из аренды ключа. Если разрешений не хватает, резервирует пачку в хранилище
+// или дожидается резервирования, начатого другим запросом, без блокировки аренды.
+// Возвращает остаток окна по всем репликам и ошибку хранилища, при которой нужно перейти на локальный бакет
+func (sw *sharedWindow) take(ctx context.Context, key string, n int, now time.Time) (int, bool, error) {
+	limit := sw.local.Limit()
+	window := now.Truncate(sw.period).UnixNano()
+	batch := sw.batch(limit, n)
+
+	l, key := sw.leaseOf(key)
+
+	for waited := false; ; waited = true {
+		l.mu.Lock()
+
+		if l.window != window {
+			l.window, l.tokens, l.count, l.exhausted, l.err = window, 0, 0, false, nil
+		}
+
+		remaining := limit - l.count
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		if l.tokens >= n {
+			l.tokens -= n
+
+			// следующая большая пачка резервируется заранее, пока текущая не кончилась
+			if batch >= sharedMinBatch && l.tokens < batch/2 && !l.exhausted && l.reserving == nil {
+				l.reserving = make(chan struct{})
+				go sw.reserve(context.WithoutCancel(ctx), l, key, window, batch, now)
+			}
+
+			tokens := l.tokens
+			l.mu.Unlock()
+
+			return remaining + tokens, true, nil
+		}
+
+		if l.exhausted || (waited && l.reserving == nil) {
+			tokens, err := l.tokens, l.err
+			l.mu.Unlock()
+
+			return remaining + tokens, false, err
+		}
+
+		reserving := l.reserving
+		if reserving == nil {
+			l.reserving = make(chan struct{})
+		}
+
+		l.mu.Unlock()
+
+		if reserving == nil {
+			if err := sw.reserve(ctx, l, key, window, batch, now); err != nil {
+				return 0, false, err
+			}
+
+			continue
+		}
+
+		select {
+		case <-reserving:
+		case <-ctx.Done():
+			return 0, false, ctx.Err()
+		}
+	}
+}
+
+// reserve резервирует пачку в хранилище и добавляет выданные разрешения в аренду.
+// Вызывается тем, кто установил l.reserving, запрос в хранилище выполняется без блокировки аренды
+func (sw *sharedWindow) reserve(ctx context.Context, l *lease, key string, window int64, batch int, now time.Time) error {
+	count, err := sw.store.incr(ctx, sw.key(key, window), batch, sw.period+time.Second, now)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	close(l.reserving)
+	l.reserving = nil
+	l.err = err
+
+	if err != nil || l.window != window {
+		return err
+	}
+
+	// пачка может быть выдана частично, если другие реплики уже израсходовали окно
+	granted := sw.local.Limit() - (count - batch)
+	if granted > batch {
+		granted = batch
+	}
+
+	if granted < batch {
+		l.exhausted = true
+	}
+
+	if granted > 0 {
+		l.tokens += granted
+	}
+
+	if count > l.count {
+		l.count = count
+	}
+
+	if sw.acquisitions.Add(1)%sharedSweepEvery == 0 {
+		go sw.sweep(window)
+	}
+
+	return nil
+}
+
+// giveBack возвращает n разрешений в аренду ключа, если окно не сменилось
+func (sw *sharedWindow) giveBack(key string, n int, now time.Time) {
+	l := &sw.overflow
+	if v, ok := sw.leases.Load(key); ok {
+		l = v.(*lease)
+	}
+
+	l.mu.Lock()
+	if l.window == now.Truncate(sw.period).UnixNano() {
+		l.tokens += n
+	}
+	l.mu.Unlock()
+}
+
+// resetIn время до начала следующего окна
+func (sw *sharedWindow) resetIn(now time.Time) time.Duration {
+	return now.Truncate(sw.period).Add(sw.period).Sub(now)
+}
+
+func (sw *sharedWindow) key(key string, window int64) string {
+	return sharedKeyPrefix + sw.id + ":" + strconv.FormatInt(window/int64(time.Second), 10) + ":" + key
+}
+
+// sweep удаляет аренды прошедших окон
+func (sw *sharedWindow) sweep(window int64) {
+	sw.leases.Range(func(k, v any) bool {
+		l := v.(*lease)
+
+		l.mu.Lock()
+		stale := l.window < window
+		l.mu.Unlock()
+
+		if stale {
+			if _, loaded := sw.leases.LoadAndDelete(k); loaded {
+				sw.keys.Add(-1)
+			}
+		}
+
+		return true
+	})
+}
+
+// limitID идентификатор лимита по умолчанию: хеш конфигурации лимита и его родителя без описаний,
+// одинаковый на всех репликах с одной конфигурацией
+func limitID(limit Limit, parentID string) string {
+	limit.Children = nil
+	limit.Description = ""
+	limit.Rules = withoutDescriptions(limit.Rules)
+
+	b, _ := json.Marshal(limit) // ключи мап сортируются, результат стабилен
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(parentID))
+	_, _ = h.Write(b)
+
+	return strconv.FormatUint(h.Sum64(), 36)
+}
@@ -0,0 +1,209 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/resp"
+)
+
+// staticLimit локальный бакет с постоянным лимитом
+type staticLimit int
+
+func (l staticLimit) Limit() int {
+	return int(l)
+}
+
+func newSharedReplica(store *sharedStore, limits *Limits) *RateLimiter {
+	rl := &RateLimiter{
+		rules:  atomic.Value{},
+		shared: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+	rl.shared.Store(store)
+	rl.hotReloadLimits(limits)
+
+	return rl
+}
+
+func TestRateLimiter_Shared(t *testing.T) {
+	srv := resp.NewTestServer()
+	defer srv.Close()
+
+	limits := &Limits{
+		Limits: []Limit{
+			{PerMinute: 100, Rules: []Rule{{URLPathPattern: "/api/**"}}},
+		},
+	}
+
+	// окно не должно смениться посреди теста
+	if time.Now().Second() >= 55 {
+		time.Sleep(6 * time.Second)
+	}
+
+	replicas := []*RateLimiter{
+		newSharedReplica(newSharedStore(srv.Addr(), "", 0, time.Second), limits),
+		newSharedReplica(newSharedStore(srv.Addr(), "", 0, time.Second), limits),
+	}
+
+	allowed := 0
+	for i := 0; i < 150; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/api/payments", http.NoBody)
+		if replicas[i%2].decide(req, nil).allow {
+			allowed++
+		}
+	}
+
+	if allowed != 100 {
+		t.Errorf("allowed %d requests across replicas, want 100", allowed)
+	}
+
+	// разрешения резервируются пачками по 10, INCRBY и PEXPIRE на пачку
+	if calls := srv.Calls(); calls > 30 {
+		t.Errorf("store received %d commands, want batched reservations", calls)
+	}
+
+	var lim *LimitImpl
+	replicas[0].rules.Load().(*sync.Map).Range(func(_, v any) bool {
+		lim = v.(*LimitImpl)
+		return false
+	})
+
+	if !strings.Contains(lim.String(), ", shared") {
+		t.Errorf("String() = %q, want shared", lim.String())
+	}
+
+	srv.Close()
+
+	// хранилище недоступно - лимит считается локальным бакетом реплики
+	replica := newSharedReplica(newSharedStore(srv.Addr(), "", 0, time.Second), limits)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/api/payments", http.NoBody)
+	if !replica.decide(req, nil).allow {
+		t.Error("request should be allowed by local limit when store is down")
+	}
+
+	store := replica.shared.Load().(*sharedStore)
+	if store.available(time.Now()) || !store.available(time.Now().Add(defaultSharedRetry)) {
+		t.Error("store should be skipped for retry period after failure")
+	}
+}
+
+func TestRateLimiter_SharedSmallLimit(t *testing.T) {
+	srv := resp.NewTestServer()
+	defer srv.Close()
+
+	limits := &Limits{
+		Limits: []Limit{
+			{PerMinute: 20, Rules: []Rule{{URLPathPattern: "/api/**"}}},
+		},
+	}
+
+	if time.Now().Second() >= 55 {
+		time.Sleep(6 * time.Second)
+	}
+
+	var replicas []*RateLimiter
+	for i := 0; i < 3; i++ {
+		store := newSharedStore(srv.Addr(), "", 0, time.Second)
+		store.replicas.Store(3)
+
+		replicas = append(replicas, newSharedReplica(store, limits))
+	}
+
+	serve := func(rl *RateLimiter, n int) int {
+		allowed := 0
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/api/payments", http.NoBody)
+			if rl.decide(req, nil).allow {
+				allowed++
+			}
+		}
+
+		return allowed
+	}
+
+	// первая реплика не резервирует окно остальных: малый лимит считается по запросу
+	if got := serve(replicas[0], 1); got != 1 {
+		t.Fatalf("replica 0 allowed %d, want 1", got)
+	}
+
+	if got := serve(replicas[1], 1); got != 1 {
+		t.Fatalf("replica 1 allowed %d after a single request on replica 0, want 1", got)
+	}
+
+	total := 2
+	for i, n := range []int{5, 10, 30} {
+		total += serve(replicas[i], n)
+	}
+
+	if total != 20 {
+		t.Errorf("replicas admitted %d requests in total, want the limit 20", total)
+	}
+}
+
+func TestSharedWindow_maxKeys(t *testing.T) {
+	srv := resp.NewTestServer()
+	defer srv.Close()
+
+	// 10 реплик: лимит 100 считается по запросу, счётчики хранилища точные
+	store := newSharedStore(srv.Addr(), "", 0, time.Second)
+	store.replicas.Store(10)
+
+	sw := newSharedWindow(store, "keys", time.Hour, staticLimit(100))
+	sw.maxKeys = 10
+
+	now := time.Now()
+
+	for i := 0; i < 50; i++ {
+		if _, ok, err := sw.take(context.Background(), "client-"+strconv.Itoa(i), 1, now); err != nil || !ok {
+			t.Fatalf("take() = %v, %v, want allowed", ok, err)
+		}
+	}
+
+	if got := sw.keys.Load(); got != 10 {
+		t.Errorf("leases = %d, want capped at 10", got)
+	}
+
+	// ключи сверх maxKeys делят одну аренду и один счётчик в хранилище
+	sw.overflow.mu.Lock()
+	count := sw.overflow.count
+	sw.overflow.mu.Unlock()
+
+	if count != 40 {
+		t.Errorf("overflow counter = %d, want 40", count)
+	}
+}
+
+func TestLimitID(t *testing.T) {
+	limit := Limit{
+		Limit:    10,
+		Tiers:    &Tiers{Key: "header:X-Plan", Default: "free", Limits: map[string]int{"free": 1, "gold": 10}},
+		Rules:    []Rule{{URLPathPattern: "/api/**"}},
+		Children: []Limit{{Limit: 1}},
+	}
+
+	other := limit
+	other.Children = nil
+
+	if limitID(limit, "") != limitID(other, "") {
+		t.Error("limitID() should not depend on children")
+	}
+
+	if limitID(limit, "") == limitID(limit, "parent") {
+		t.Error("limitID() should depend on parent")
+	}
+
+	other.Limit = 20
+	if limitID(limit, "") == limitID(other, "") {
+		t.Error("limitID() should depend on limit config")
+	}
+}
@@ -0,0 +1,109 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/consul"
+	"github.com/wbpaygate/traefik-ratelimit/internal/etcd"
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+	"github.com/wbpaygate/traefik-ratelimit/internal/kube"
+	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
+)
+
+const (
+	configSourceKeeper = "keeper"
+	configSourceEtcd   = "etcd"
+	configSourceConsul = "consul"
+	configSourceKube   = "kubernetes"
+
+	watchRetry = 5 * time.Second // пауза перед переподключением прерванного watch
+)
+
+// configSource источник конфигурации лимитов, опрашивается с периодом keeperReloadInterval.
+// Version и ModRevision значения используются для определения изменений, см. keeper.Value.Equal
+type configSource interface {
+	GetRateLimits(ctx context.Context) (*keeper.Value, error)
+}
+
+// configWatcher источник, который сообщает об изменениях сразу, не дожидаясь опроса
+type configWatcher interface {
+	// Watch вызывает fn с текущим значением и на каждое изменение, блокируется до отмены ctx или обрыва потока
+	Watch(ctx context.Context, fn func(*keeper.Value)) error
+}
+
+// sourceConfig выбранный источник конфигурации
+type sourceConfig struct {
+	name   string
+	source configSource
+
+	serviceKey string // ключ keeper слоя переопределений сервиса, пустой - слоя нет
+	controlKey string // ключ keeper с командами закрепления конфигурации, пустой - не опрашивается
+	pin        string // закрепление конфигурации из configPin
+}
+
+// newConfigSource создаёт источник из параметра configSource, по умолчанию keeper
+func newConfigSource(cfg *Config, cl *http.Client, kc *keeper.KeeperClient) (*sourceConfig, error) {
+	switch cfg.ConfigSource {
+	case "", configSourceKeeper:
+		return &sourceConfig{name: configSourceKeeper, source: kc}, nil
+
+	case configSourceEtcd:
+		if cfg.EtcdURL == "" || cfg.EtcdKey == "" {
+			return nil, fmt.Errorf("etcdURL and etcdKey are required for config source '%s'", cfg.ConfigSource)
+		}
+
+		return &sourceConfig{name: configSourceEtcd, source: etcd.NewClient(cl, cfg.EtcdURL, cfg.EtcdKey)}, nil
+
+	case configSourceConsul:
+		if cfg.ConsulURL == "" || cfg.ConsulKey == "" {
+			return nil, fmt.Errorf("consulURL and consulKey are required for config source '%s'", cfg.ConfigSource)
+		}
+
+		return &sourceConfig{name: configSourceConsul, source: consul.NewClient(cl, cfg.ConsulURL, cfg.ConsulKey, cfg.ConsulToken)}, nil
+
+	case configSourceKube:
+		if cfg.KubernetesConfigMap == "" || cfg.KubernetesKey == "" {
+			return nil, fmt.Errorf("kubernetesConfigMap and kubernetesKey are required for config source '%s'", cfg.ConfigSource)
+		}
+
+		// адрес задаётся для доступа через kubectl proxy, без токена
+		if cfg.KubernetesURL != "" {
+			if cfg.KubernetesNamespace == "" {
+				return nil, fmt.Errorf("kubernetesNamespace is required with kubernetesURL")
+			}
+
+			return &sourceConfig{name: configSourceKube, source: kube.NewClient(cl, cfg.KubernetesURL, "", cfg.KubernetesNamespace, cfg.KubernetesConfigMap, cfg.KubernetesKey)}, nil
+		}
+
+		kc, err := kube.NewInClusterClient(cl.Timeout, cfg.KubernetesNamespace, cfg.KubernetesConfigMap, cfg.KubernetesKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return &sourceConfig{name: configSourceKube, source: kc}, nil
+	}
+
+	return nil, fmt.Errorf("unknown config source '%s'", cfg.ConfigSource)
+}
+
+// watchLimits применяет изменения конфигурации из watch, пока ctx не отменён, переподключаясь при обрыве
+func (rl *RateLimiter) watchLimits(ctx context.Context, name string, w configWatcher) {
+	for {
+		err := w.Watch(ctx, func(value *keeper.Value) {
+			if errApply := rl.applyLimits(ctx, value); errApply != nil {
+				logger.Error(ctx, fmt.Sprintf("cannot apply limits from %s watch, error: %v", name, errApply))
+			}
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetry):
+		}
+
+		logger.Warn(ctx, name+" watch interrupted, reconnecting", fmt.Sprintf("error=%v", err))
+	}
+}
@@ -0,0 +1,134 @@
+package traefik_ratelimit
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/consul"
+	"github.com/wbpaygate/traefik-ratelimit/internal/etcd"
+	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
+	"github.com/wbpaygate/traefik-ratelimit/internal/kube"
+)
+
+func TestNewConfigSource(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "") // тесты могут выполняться в кластере
+
+	kc := keeper.NewKeeperClient(http.DefaultClient, "http://keeper", "/settings", "ratelimits")
+
+	tests := []struct {
+		name    string
+		cfg     *Config
+		want    string
+		wantErr bool
+	}{
+		{name: "default keeper", cfg: &Config{}, want: configSourceKeeper},
+		{name: "keeper", cfg: &Config{ConfigSource: "keeper"}, want: configSourceKeeper},
+		{name: "etcd", cfg: &Config{ConfigSource: "etcd", EtcdURL: "http://etcd:2379", EtcdKey: "ratelimits"}, want: configSourceEtcd},
+		{name: "etcd without url", cfg: &Config{ConfigSource: "etcd", EtcdKey: "ratelimits"}, wantErr: true},
+		{name: "etcd without key", cfg: &Config{ConfigSource: "etcd", EtcdURL: "http://etcd:2379"}, wantErr: true},
+		{name: "consul", cfg: &Config{ConfigSource: "consul", ConsulURL: "http://consul:8500", ConsulKey: "traefik/ratelimits"}, want: configSourceConsul},
+		{name: "consul without key", cfg: &Config{ConfigSource: "consul", ConsulURL: "http://consul:8500"}, wantErr: true},
+		{name: "kubernetes proxy", cfg: &Config{ConfigSource: "kubernetes", KubernetesURL: "http://127.0.0.1:8001", KubernetesNamespace: "ingress", KubernetesConfigMap: "ratelimits", KubernetesKey: "limits.json"}, want: configSourceKube},
+		{name: "kubernetes proxy without namespace", cfg: &Config{ConfigSource: "kubernetes", KubernetesURL: "http://127.0.0.1:8001", KubernetesConfigMap: "ratelimits", KubernetesKey: "limits.json"}, wantErr: true},
+		{name: "kubernetes without key", cfg: &Config{ConfigSource: "kubernetes", KubernetesConfigMap: "ratelimits"}, wantErr: true},
+		{name: "kubernetes not in cluster", cfg: &Config{ConfigSource: "kubernetes", KubernetesConfigMap: "ratelimits", KubernetesKey: "limits.json"}, wantErr: true},
+		{name: "unknown", cfg: &Config{ConfigSource: "zookeeper"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := newConfigSource(tt.cfg, http.DefaultClient, kc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newConfigSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err == nil && src.name != tt.want {
+				t.Errorf("newConfigSource() = %s, want %s", src.name, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_etcdWatch(t *testing.T) {
+	srv := etcd.NewTestServer()
+	defer srv.Close()
+
+	testSourceWatch(t, &Config{ConfigSource: configSourceEtcd, EtcdURL: srv.URL, EtcdKey: "ratelimits"}, func(value string) {
+		srv.Put("ratelimits", value)
+	})
+}
+
+func TestRateLimiter_consulWatch(t *testing.T) {
+	srv := consul.NewTestServer()
+	srv.Token = "secret"
+	defer srv.Close()
+
+	testSourceWatch(t, &Config{ConfigSource: configSourceConsul, ConsulURL: srv.URL, ConsulKey: "traefik/ratelimits", ConsulToken: "secret"}, func(value string) {
+		srv.Put("traefik/ratelimits", value)
+	})
+}
+
+func TestRateLimiter_kubernetesWatch(t *testing.T) {
+	srv := kube.NewTestServer()
+	defer srv.Close()
+
+	cfg := &Config{ConfigSource: configSourceKube, KubernetesURL: srv.URL, KubernetesNamespace: "ingress", KubernetesConfigMap: "ratelimits", KubernetesKey: "limits.json"}
+
+	testSourceWatch(t, cfg, func(value string) {
+		srv.Set("ratelimits", map[string]string{"limits.json": value})
+	})
+}
+
+// testSourceWatch проверяет, что изменения источника применяются без опроса, а опрос той же ревизии не пересоздаёт лимиты
+func testSourceWatch(t *testing.T, cfg *Config, put func(value string)) {
+	t.Helper()
+
+	put(`{"limits": [{"limit": 1, "rules": [{"urlpathpattern": "/v1"}]}]}`)
+
+	ctx := context.Background()
+
+	cfg.KeeperReloadInterval = "1h" // применяется только watch
+	cfg.RatelimitData = defaultRateLimitLimits
+
+	rl := NewRateLimiter(ctx, defaultRateLimitLimits)
+	rl.Configure(ctx, cfg, nil)
+
+	defer func() {
+		rl.watchCancel.Load().(context.CancelFunc)()
+		rl.ticker.Load().(*time.Ticker).Stop()
+	}()
+
+	waitPattern := func(path string) {
+		t.Helper()
+
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if _, ok := findPattern(rl.rules.Load().(*sync.Map), path); ok {
+				return
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		t.Fatalf("limits for %s not loaded from %s watch", path, cfg.ConfigSource)
+	}
+
+	waitPattern("/v1")
+
+	put(`{"limits": [{"limit": 1, "rules": [{"urlpathpattern": "/v2"}]}]}`)
+
+	waitPattern("/v2")
+
+	limits := rl.limits.Load().(*Limits)
+
+	if err := rl.updateLimits(ctx); err != nil {
+		t.Fatalf("updateLimits() error: %v", err)
+	}
+
+	if rl.limits.Load().(*Limits) != limits {
+		t.Errorf("limits reloaded for the same %s revision", cfg.ConfigSource)
+	}
+}
@@ -0,0 +1,168 @@
+package traefik_ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/wbpaygate/traefik-ratelimit/internal/clientip"
+)
+
+const (
+	tierKeyHeader  = "header"  // значение заголовка запроса
+	tierKeyClaim   = "claim"   // claim из JWT, см. JWT
+	tierKeyIPGroup = "ipgroup" // группа подсетей, в которую входит адрес клиента, см. ClientIP
+)
+
+// ipGroup подсети клиентов тарифа
+type ipGroup struct {
+	tier string
+	set  *clientip.Set
+}
+
+// tiersImpl скомпилированный Tiers
+type tiersImpl struct {
+	source      string
+	name        string
+	defaultTier string
+	limits      map[string]int
+	groups      []ipGroup // отсортированы по имени тарифа, при пересечении подсетей побеждает первый
+}
+
+// compile проверяет и компилирует тарифы, используется и в validate, и при загрузке лимитов
+func (t *Tiers) compile() (*tiersImpl, error) {
+	source, name, _ := strings.Cut(t.Key, ":")
+
+	ti := &tiersImpl{
+		source:      source,
+		name:        name,
+		defaultTier: t.Default,
+		limits:      t.Limits,
+	}
+
+	switch source {
+	case tierKeyHeader:
+		if name == "" {
+			return nil, fmt.Errorf("tier key '%s': header name is empty", t.Key)
+		}
+
+		ti.name = http.CanonicalHeaderKey(name)
+
+	case tierKeyClaim:
+		if name == "" {
+			return nil, fmt.Errorf("tier key '%s': claim name is empty", t.Key)
+		}
+
+	case tierKeyIPGroup:
+		if name != "" {
+			return nil, fmt.Errorf("tier key '%s': ipgroup does not take a name", t.Key)
+		}
+
+		if len(t.IPGroups) == 0 {
+			return nil, fmt.Errorf("tier key '%s': no ip groups specified", t.Key)
+		}
+
+	default:
+		return nil, fmt.Errorf("tier key '%s': unknown source '%s'", t.Key, source)
+	}
+
+	if len(t.Limits) == 0 {
+		return nil, fmt.Errorf("no tier limits specified")
+	}
+
+	for tier, value := range t.Limits {
+		if tier == "" {
+			return nil, fmt.Errorf("tier name is empty")
+		}
+
+		if value <= 0 {
+			return nil, fmt.Errorf("tier '%s': limit value <= 0", tier)
+		}
+	}
+
+	if t.Default == "" {
+		return nil, fmt.Errorf("default tier is required")
+	}
+
+	if _, ok := t.Limits[t.Default]; !ok {
+		return nil, fmt.Errorf("default tier '%s' has no limit", t.Default)
+	}
+
+	if len(t.IPGroups) > 0 && source != tierKeyIPGroup {
+		return nil, fmt.Errorf("ip groups require tier key '%s'", tierKeyIPGroup)
+	}
+
+	for tier, cidrs := range t.IPGroups {
+		if _, ok := t.Limits[tier]; !ok {
+			return nil, fmt.Errorf("ip group '%s' has no tier limit", tier)
+		}
+
+		set, err := clientip.ParseSet(cidrs)
+		if err != nil {
+			return nil, fmt.Errorf("ip group '%s': %w", tier, err)
+		}
+
+		ti.groups = append(ti.groups, ipGroup{tier: tier, set: set})
+	}
+
+	// порядок мапы случайный, сортируем, чтобы тариф при пересечении подсетей был стабильным
+	sort.Slice(ti.groups, func(i, j int) bool {
+		return ti.groups[i].tier < ti.groups[j].tier
+	})
+
+	return ti, nil
+}
+
+// tier возвращает тариф клиента, неизвестные тарифы считаются тарифом по умолчанию
+func (ti *tiersImpl) tier(ri *requestInfo) string {
+	var val string
+
+	switch ti.source {
+	case tierKeyHeader:
+		if values := ri.req.Header[ti.name]; len(values) > 0 {
+			val = values[0]
+		}
+
+	case tierKeyClaim:
+		if token := ri.jwtToken(); token != nil {
+			val, _ = token.Claim(ti.name)
+		}
+
+	case tierKeyIPGroup:
+		if ip := ri.clientIP(); ip.IsValid() {
+			for _, g := range ti.groups {
+				if g.set.Contains(ip) {
+					val = g.tier
+					break
+				}
+			}
+		}
+	}
+
+	if _, ok := ti.limits[val]; ok {
+		return val
+	}
+
+	return ti.defaultTier
+}
+
+// names имена тарифов по алфавиту
+func (ti *tiersImpl) names() []string {
+	names := make([]string, 0, len(ti.limits))
+	for name := range ti.limits {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (ti *tiersImpl) key() string {
+	if ti.name == "" {
+		return ti.source
+	}
+
+	return ti.source + ":" + ti.name
+}
@@ -0,0 +1,209 @@
+package traefik_ratelimit
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow_Tiers(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+
+	// лимит 1 меньше количества окон, значит в текущем окне нет ни одного разрешения
+	tiers := func(key string) *Tiers {
+		return &Tiers{
+			Key:     key,
+			Default: "free",
+			Limits:  map[string]int{"free": 1, "gold": 100},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		tiers   *Tiers
+		prepare func(req *http.Request, tier string)
+	}{
+		{
+			name:  "header",
+			tiers: tiers("header:x-plan"),
+			prepare: func(req *http.Request, tier string) {
+				req.Header.Set("X-Plan", tier)
+			},
+		},
+		{
+			name:  "claim",
+			tiers: tiers("claim:plan"),
+			prepare: func(req *http.Request, tier string) {
+				req.Header.Set("Authorization", "Bearer "+testJWT(t, "secret", map[string]any{"plan": tier, "exp": exp}))
+			},
+		},
+		{
+			name: "ip group",
+			tiers: func() *Tiers {
+				tt := tiers("ipgroup")
+				tt.IPGroups = map[string][]string{"gold": {"192.168.0.0/16"}}
+				return tt
+			}(),
+			prepare: func(req *http.Request, tier string) {
+				if tier == "gold" {
+					req.RemoteAddr = "192.168.1.1:1234"
+				} else {
+					req.RemoteAddr = "172.16.1.1:1234"
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := &RateLimiter{
+				rules: atomic.Value{},
+			}
+
+			rl.rules.Store(&sync.Map{})
+
+			rl.hotReloadLimits(&Limits{
+				Limits: []Limit{
+					{Tiers: tt.tiers, Rules: []Rule{{URLPathPattern: "/api/**"}}},
+				},
+			})
+
+			allow := func(tier string) bool {
+				req, err := http.NewRequest(http.MethodGet, "http://localhost/api/payments", http.NoBody)
+				if err != nil {
+					t.Fatalf("failed to create request: %v", err)
+				}
+
+				tt.prepare(req, tier)
+
+				return rl.Allow(req)
+			}
+
+			for i := 0; i < 3; i++ {
+				if !allow("gold") {
+					t.Fatal("gold tier request should be allowed")
+				}
+			}
+
+			if allow("free") {
+				t.Error("free tier request should be limited")
+			}
+
+			if allow("unknown") {
+				t.Error("unknown tier should fall back to the default tier")
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Allow_TiersBucketKey(t *testing.T) {
+	rl := &RateLimiter{
+		rules: atomic.Value{},
+	}
+
+	rl.rules.Store(&sync.Map{})
+
+	rl.hotReloadLimits(&Limits{
+		Limits: []Limit{
+			{
+				BucketKey: "param:merchantId",
+				Tiers:     &Tiers{Key: "header:X-Plan", Default: "free", Limits: map[string]int{"free": 2, "gold": 20}},
+				Rules:     []Rule{{URLPathPattern: "/merchants/{merchantId}/payments"}},
+			},
+		},
+	})
+
+	allowed := func(merchant, tier string, n int) int {
+		var count int
+
+		for i := 0; i < n; i++ {
+			req, err := http.NewRequest(http.MethodGet, "http://localhost/merchants/"+merchant+"/payments", http.NoBody)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			req.Header.Set("X-Plan", tier)
+
+			if rl.Allow(req) {
+				count++
+			}
+		}
+
+		return count
+	}
+
+	if got := allowed("1", "free", 5); got != 2 {
+		t.Errorf("free merchant 1 allowed %d requests, want 2", got)
+	}
+
+	if got := allowed("2", "free", 5); got != 2 {
+		t.Errorf("free merchant 2 allowed %d requests, want 2", got)
+	}
+
+	if got := allowed("3", "gold", 30); got != 20 {
+		t.Errorf("gold merchant 3 allowed %d requests, want 20", got)
+	}
+}
+
+func TestTiers_compile(t *testing.T) {
+	limits := map[string]int{"free": 10, "gold": 100}
+
+	tests := []struct {
+		name    string
+		tiers   Tiers
+		wantErr string
+	}{
+		{name: "valid header", tiers: Tiers{Key: "header:X-Plan", Default: "free", Limits: limits}},
+		{name: "valid claim", tiers: Tiers{Key: "claim:plan", Default: "free", Limits: limits}},
+		{
+			name:  "valid ip group",
+			tiers: Tiers{Key: "ipgroup", Default: "free", Limits: limits, IPGroups: map[string][]string{"gold": {"10.0.0.0/8"}}},
+		},
+		{name: "unknown source", tiers: Tiers{Key: "query:plan", Default: "free", Limits: limits}, wantErr: "unknown source"},
+		{name: "header without name", tiers: Tiers{Key: "header", Default: "free", Limits: limits}, wantErr: "header name is empty"},
+		{name: "ip group without groups", tiers: Tiers{Key: "ipgroup", Default: "free", Limits: limits}, wantErr: "no ip groups"},
+		{name: "no limits", tiers: Tiers{Key: "claim:plan", Default: "free"}, wantErr: "no tier limits"},
+		{
+			name:    "non-positive limit",
+			tiers:   Tiers{Key: "claim:plan", Default: "free", Limits: map[string]int{"free": 0}},
+			wantErr: "tier 'free': limit value <= 0",
+		},
+		{name: "no default", tiers: Tiers{Key: "claim:plan", Limits: limits}, wantErr: "default tier is required"},
+		{name: "unknown default", tiers: Tiers{Key: "claim:plan", Default: "basic", Limits: limits}, wantErr: "default tier 'basic'"},
+		{
+			name:    "ip groups with header key",
+			tiers:   Tiers{Key: "header:X-Plan", Default: "free", Limits: limits, IPGroups: map[string][]string{"gold": {"10.0.0.0/8"}}},
+			wantErr: "ip groups require",
+		},
+		{
+			name:    "ip group without tier",
+			tiers:   Tiers{Key: "ipgroup", Default: "free", Limits: limits, IPGroups: map[string][]string{"vip": {"10.0.0.0/8"}}},
+			wantErr: "ip group 'vip' has no tier limit",
+		},
+		{
+			name:    "invalid ip group",
+			tiers:   Tiers{Key: "ipgroup", Default: "free", Limits: limits, IPGroups: map[string][]string{"gold": {"10.0.0.0/33"}}},
+			wantErr: "ip group 'gold'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.tiers.compile()
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("compile() unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("compile() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
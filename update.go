@@ -4,98 +4,92 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"regexp"
 	"sync"
 
+	"github.com/wbpaygate/traefik-ratelimit/internal/bypass"
+	"github.com/wbpaygate/traefik-ratelimit/internal/clientip"
 	"github.com/wbpaygate/traefik-ratelimit/internal/keeper"
-	"github.com/wbpaygate/traefik-ratelimit/internal/limiter"
 	"github.com/wbpaygate/traefik-ratelimit/internal/logger"
 	"github.com/wbpaygate/traefik-ratelimit/internal/pattern"
 )
 
-func serializeAndValidateLimits(b []byte) (*Limits, error) {
-	var l Limits
-	if err := json.Unmarshal(b, &l); err != nil {
-		return nil, fmt.Errorf("unmarshal error: %w", err)
+// loadLimits загружает базовый слой из ratelimitData. Остальные слои сбрасываются и загружаются заново при следующем опросе
+func (rl *RateLimiter) loadLimits(ctx context.Context, limitsConfig []byte) error {
+	l, err := parseLimits(limitsConfig)
+	if err != nil {
+		return fmt.Errorf("parseLimits error: %w", err)
 	}
 
-	if err := l.validate(); err != nil {
-		return nil, fmt.Errorf("validate error: %w", err)
-	}
+	rl.updateMu.Lock()
+	defer rl.updateMu.Unlock()
 
-	return &l, nil
-}
+	rl.stopCanary(ctx, "configuration reloaded from ratelimitData")
 
-func (rl *RateLimiter) loadLimits(limitsConfig []byte) error {
-	l, err := serializeAndValidateLimits(limitsConfig)
-	if err != nil {
-		return fmt.Errorf("serializeAndValidateLimits error: %w", err)
+	if err = rl.storeLayers(ctx, &configLayers{base: l, baseData: string(limitsConfig)}); err != nil {
+		return err
 	}
 
-	settings, ok := rl.keeperSetting.Load().(*keeper.Value)
-	if !ok {
-		return fmt.Errorf("cannot type assert *keeper.Value")
-	}
-	if settings == nil {
-		return fmt.Errorf("settings is nil")
-	}
-
-	settings.Version = 0
-	settings.ModRevision = 0
-
-	rl.limits.Store(l)
-	rl.hotReloadLimits(l)
+	rl.keeperSetting.Store(&keeper.Value{})
+	rl.serviceSetting.Store(&keeper.Value{})
 
 	return nil
 }
 
 func (rl *RateLimiter) updateLimits(ctx context.Context) error {
-	kc, ok := rl.keeperClient.Load().(*keeper.KeeperClient)
-	if !ok {
-		return fmt.Errorf("keeperClient not init, try reconfigure")
+	src, ok := rl.source.Load().(*sourceConfig)
+	if !ok || src.source == nil {
+		return fmt.Errorf("config source not init, try reconfigure")
 	}
 
-	result, err := kc.GetRateLimits(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get limits from keeper, error: %w", err)
-	}
+	var errs []error
 
-	if result == nil || result.Value == "" {
-		return fmt.Errorf("empty result from keeper")
+	if err := rl.updateControl(ctx, src); err != nil {
+		errs = append(errs, err)
 	}
 
-	logDebugJSON(ctx, result.Value)
-
-	settings, ok := rl.keeperSetting.Load().(*keeper.Value)
-	if !ok {
-		return fmt.Errorf("cannot type assert *keeper.Value")
-	}
-	if settings == nil {
-		return fmt.Errorf("settings is nil")
+	if pin := rl.pinned(); pin != nil {
+		logger.Info(ctx, "configuration pinned, skip update", pin.version.String())
+		return errors.Join(errs...)
 	}
 
-	if !settings.Equal(result) {
-		logger.Debug(ctx, fmt.Sprintf("old configuration: version: %d, mod_revision: %d", settings.Version, settings.ModRevision))
+	result, err := src.source.GetRateLimits(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to get limits from %s, error: %w", src.name, err))
+	} else if err = rl.applyLimits(ctx, result); err != nil {
+		errs = append(errs, err)
+	}
 
-		l, err := serializeAndValidateLimits([]byte(result.Value))
-		if err != nil {
-			return fmt.Errorf("failed serialize and validate limits: %w", err)
+	if src.serviceKey != "" {
+		if err = rl.updateServiceLimits(ctx, src.serviceKey); err != nil {
+			errs = append(errs, err)
 		}
+	}
 
-		rl.keeperSetting.Store(result)
-		rl.limits.Store(l)
-
-		rl.hotReloadLimits(l)
-
-		logger.Info(ctx, fmt.Sprintf("new configuration loaded: version: %d, mod_revision: %d", result.Version, result.ModRevision))
+	return errors.Join(errs...)
+}
 
-		rl.logWorkingLimits(ctx)
+// updateServiceLimits загружает слой переопределений сервиса из keeper
+func (rl *RateLimiter) updateServiceLimits(ctx context.Context, key string) error {
+	kc, _ := rl.keeperClient.Load().(*keeper.KeeperClient)
+	if kc == nil {
+		return fmt.Errorf("keeper client not init, try reconfigure")
+	}
 
-	} else {
-		logger.Info(ctx, fmt.Sprintf("no update, use configuration: version: %d, mod_revision: %d", settings.Version, settings.ModRevision))
+	result, err := kc.GetValue(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to get service limits from keeper, error: %w", err)
 	}
 
-	return nil
+	return rl.applyLayer(ctx, layerService, result)
+}
+
+// applyLimits загружает слой окружения из источника, если его версия изменилась
+func (rl *RateLimiter) applyLimits(ctx context.Context, result *keeper.Value) error {
+	return rl.applyLayer(ctx, layerEnvironment, result)
 }
 
 func (rl *RateLimiter) hotReloadLimits(limits *Limits) {
@@ -104,31 +98,64 @@ func (rl *RateLimiter) hotReloadLimits(limits *Limits) {
 
 	newRules := &sync.Map{}
 
+	b := &limitsBuilder{rules: newRules, built: make(map[string]*LimitImpl), inherited: make(map[*LimitImpl]*LimitImpl)}
+	b.store, _ = rl.shared.Load().(*sharedStore)
+
+	g, _ := rl.gossip.Load().(*gossip)
+
+	// с общим хранилищем лимит и так действует на все реплики
+	if b.store == nil {
+		b.share, _ = rl.replicas.Load().(*replicaShare)
+		b.gossip = g != nil
+	}
+
+	b.scale, _ = rl.canaryScale.Load().(*limitScale)
+
+	// бакеты прошлой загрузки переносятся, только если они созданы с теми же хранилищем, долей реплики и gossip.
+	// Канарейка вместо прошлой загрузки получает бакеты прежней конфигурации
+	env := b.env()
+	switch {
+	case b.scale.canary():
+		b.previous = b.scale.stable
+
+	case env == rl.limitsEnv:
+		b.previous = rl.limitsByID
+	}
+
 	for _, limit := range limits.Limits {
-		lim := limiter.NewLimiter(limit.Limit)
+		b.add(limit, nil)
+	}
 
-		for _, rule := range limit.Rules {
-			ruleImpl := RuleImpl{
-				URLPathPattern: pattern.NewPattern(rule.URLPathPattern),
-			}
+	rl.limitsEnv = env
+	rl.limitsByID = b.built
 
-			if rule.HeaderKey != "" && rule.HeaderVal != "" {
-				ruleImpl.Header = &Header{
-					key: rule.HeaderKey,
-					val: rule.HeaderVal,
-				}
-			}
+	if g != nil {
+		g.setLimits(newRules)
+	}
 
-			newRules.Store(ruleImpl, lim)
-		}
+	access := &accessRules{
+		allow:      compileRules(limits.Allow, "allow"),
+		deny:       compileRules(limits.Deny, "deny"),
+		denyStatus: limits.DenyStatus,
+	}
+
+	if access.denyStatus == 0 {
+		access.denyStatus = http.StatusForbidden
 	}
 
-	// закрытие старых лимитеров
+	// закрытие старых лимитеров, кроме перенесённых в новые лимиты
 	if oldRules, ok := rl.rules.Load().(*sync.Map); ok {
+		kept := make(map[*LimitImpl]bool, len(b.inherited))
+		for _, old := range b.inherited {
+			kept[old] = true
+		}
+
 		defer func() {
 			oldRules.Range(func(key, value any) bool {
-				if lim, ok := value.(*limiter.Limiter); ok {
-					lim.Close()
+				for lim, ok := value.(*LimitImpl); ok && lim != nil; lim = lim.parent {
+					if !kept[lim] {
+						lim.closeBuckets()
+					}
 				}
 
 				return true
@@ -136,16 +163,266 @@ func (rl *RateLimiter) hotReloadLimits(limits *Limits) {
 		}()
 	}
 
+	var resolver *clientip.Resolver
+	if limits.ClientIP != nil {
+		resolver, _ = clientip.NewResolver(limits.ClientIP.TrustedProxies, limits.ClientIP.Depth)
+	}
+
+	rl.clientIP.Store(resolver)
+	rl.jwt.Store(newJWTSettings(limits.JWT))
+	rl.access.Store(access)
+	rl.headers.Store(limits.Headers)
+	rl.matchFirst.Store(limits.MatchPolicy == matchPolicyFirst)
+
+	staticKeys, _ := rl.bypassKeys.Load().([]bypass.Key)
+	rl.bypass.Store(newBypassSettings(limits.Bypass, staticKeys))
 	rl.rules.Store(newRules) // атомарное переключение
 }
 
+// limitsBuilder компилирует лимиты конфигурации в правила
+type limitsBuilder struct {
+	rules  *sync.Map
+	order  int           // порядковый номер следующего лимита (обход в глубину)
+	store  *sharedStore  // общее хранилище счётчиков, может быть nil
+	share  *replicaShare // доля реплики в лимитах, nil - лимиты не делятся
+	gossip bool          // расход лимитов без bucketkey, tiers, adaptive и schedule рассылается пирам
+	scale  *limitScale   // доля лимитов стороны канарейки, nil - канарейки нет
+
+	previous  map[string]*LimitImpl     // лимиты прошлой загрузки по id, nil - бакеты не переносятся
+	built     map[string]*LimitImpl     // лимиты этой загрузки по id
+	inherited map[*LimitImpl]*LimitImpl // новый лимит -> лимит прошлой загрузки, чьи бакеты он получил
+}
+
+// limitsEnv параметры, с которыми созданы бакеты лимитов
+type limitsEnv struct {
+	store  *sharedStore
+	share  replicaShare
+	gossip bool
+}
+
+func (b *limitsBuilder) env() limitsEnv {
+	env := limitsEnv{store: b.store, gossip: b.gossip}
+	if b.share != nil {
+		env.share = *b.share
+	}
+
+	return env
+}
+
+// add компилирует лимит и его дочерние лимиты в правила
+func (b *limitsBuilder) add(limit Limit, parent *LimitImpl) {
+	parentID := ""
+	if parent != nil {
+		parentID = parent.id
+	}
+
+	id := limit.ID
+	if id == "" {
+		id = limitID(limit, parentID)
+	}
+
+	stateKey := limitStateKey(limit)
+
+	// лимит, который отличается на другой стороне канарейки, делится между сторонами вместе с дочерними
+	scaled := b.scale.changed(id, stateKey) || (parent != nil && parent.scaled)
+	if scaled {
+		stateKey = b.scale.stateKey(stateKey)
+	}
+
+	var lim *LimitImpl
+
+	// бакеты переносятся, если у лимита те же параметры и его родитель тоже получил бакеты своего прошлого лимита.
+	// Одинаковые лимиты без id получают один хеш, бакеты переносятся только первому
+	if old, ok := b.previous[id]; ok && b.built[id] == nil && old.stateKey == stateKey && old.parent == b.inherited[parent] {
+		copied := *old
+		lim = &copied
+		lim.parent = parent
+		b.inherited[lim] = old
+
+	} else {
+		// лимит канарейки без общих с прежней конфигурацией бакетов тоже получает только свою долю
+		if b.scale.canary() && !scaled {
+			scaled = true
+			stateKey = b.scale.stateKey(stateKey)
+		}
+
+		// адаптивный лимит и расписание сами меняют лимит бакета, расход пиров его бы перезаписывал.
+		// Лимит с gossip не делится между репликами: реплика вычитает расход пиров из полного лимита
+		gossiped := b.gossip && limit.Tiers == nil && limit.BucketKey == "" && limit.Adaptive == nil && limit.Schedule == nil
+		if !gossiped {
+			limit = b.share.splitLimit(limit)
+		}
+
+		if scaled {
+			limit = mapLimitValues(limit, b.scale.split)
+		}
+
+		lim = newLimitImpl(limit, parent)
+		lim.id = id
+		lim.stateKey = stateKey
+		lim.scaled = scaled
+		lim.capacity = limit.minCapacity()
+
+		if limit.Breaker != nil {
+			if breaker, err := limit.Breaker.compile(id); err == nil {
+				lim.breaker = breaker
+			}
+		}
+
+		if b.store != nil {
+			lim.share(b.store, lim.id)
+		}
+
+		if gossiped {
+			lim.gossip = newGossipUsage(lim)
+		}
+	}
+
+	lim.desc = limit.Description
+	lim.order = b.order
+	b.order++
+
+	// следующая загрузка переносит бакеты первого из одинаковых лимитов без id, как и эта
+	if b.built[id] == nil {
+		b.built[id] = lim
+	}
+
+	// validate сравнивает стоимость с окнами из конфигурации, доли реплики и канарейки могут быть меньше
+	capacity := 0
+	for l := lim; l != nil; l = l.parent {
+		capacity = minPositive(capacity, l.capacity)
+	}
+
+	for _, rule := range limit.Rules {
+		ruleImpl, err := compileRule(rule, id)
+		if err != nil {
+			continue // правила уже проверены в validate
+		}
+
+		if ruleImpl.Cost != nil {
+			ruleImpl.Cost.clamp(capacity)
+		}
+
+		b.rules.Store(ruleImpl, lim)
+	}
+
+	for _, child := range limit.Children {
+		b.add(child, lim)
+	}
+}
+
+// updateReplicas запрашивает количество реплик и сообщает, что доля этой реплики изменилась
+func (rl *RateLimiter) updateReplicas(ctx context.Context) bool {
+	rc, ok := rl.replicaSource.Load().(*replicaConfig)
+	if !ok || rc.source == nil {
+		return false
+	}
+
+	share, err := rc.source.replicas(ctx)
+	if err != nil {
+		logger.Error(ctx, fmt.Sprintf("cannot get replica count, keep previous, error: %v", err))
+		return false
+	}
+
+	if share.count == 0 {
+		logger.Error(ctx, "replica count source returned no replicas, keep previous")
+		return false
+	}
+
+	if old, _ := rl.replicas.Load().(*replicaShare); old != nil && *old == *share {
+		return false
+	}
+
+	rl.replicas.Store(share)
+	logger.Info(ctx, "replica share changed", "replica="+share.String())
+
+	// с общим хранилищем количество реплик задаёт размер пачек резервирования
+	if store, _ := rl.shared.Load().(*sharedStore); store != nil {
+		store.replicas.Store(int64(share.count))
+	}
+
+	return true
+}
+
+// compileRule компилирует правило, scope - id лимита, "allow" или "deny" для id правила по умолчанию
+func compileRule(rule Rule, scope string) (RuleImpl, error) {
+	ruleImpl := RuleImpl{
+		ID:          ruleID(rule, scope),
+		Description: rule.Description,
+	}
+
+	if rule.URLPathRegex != "" {
+		re, err := regexp.Compile(rule.URLPathRegex)
+		if err != nil {
+			return RuleImpl{}, fmt.Errorf("compile URL regex: %w", err)
+		}
+
+		ruleImpl.URLPathRegex = re
+
+	} else if rule.URLPathPattern != "" {
+		p, err := pattern.NewPattern(rule.URLPathPattern)
+		if err != nil {
+			return RuleImpl{}, fmt.Errorf("compile URL pattern: %w", err)
+		}
+
+		ruleImpl.URLPathPattern = p
+	}
+
+	if len(rule.SourceCIDRs) > 0 {
+		set, err := clientip.ParseSet(rule.SourceCIDRs)
+		if err != nil {
+			return RuleImpl{}, fmt.Errorf("parse source CIDRs: %w", err)
+		}
+
+		ruleImpl.SourceCIDRs = set
+	}
+
+	if rule.HeaderKey != "" && rule.HeaderVal != "" {
+		ruleImpl.Header = newHeader(rule.HeaderKey, rule.HeaderVal, rule.CaseSensitive)
+	}
+
+	if len(rule.Claims) > 0 {
+		ruleImpl.Claims = newClaimsMatcher(rule.Claims)
+	}
+
+	if rule.Cost != nil {
+		cost, err := rule.Cost.compile()
+		if err != nil {
+			return RuleImpl{}, fmt.Errorf("compile cost: %w", err)
+		}
+
+		ruleImpl.Cost = cost
+	}
+
+	return ruleImpl, nil
+}
+
+// compileRules компилирует список правил, пропуская некорректные
+func compileRules(rules []Rule, scope string) []RuleImpl {
+	var compiled []RuleImpl
+
+	for _, rule := range rules {
+		ruleImpl, err := compileRule(rule, scope)
+		if err != nil {
+			continue // правила уже проверены в validate
+		}
+
+		compiled = append(compiled, ruleImpl)
+	}
+
+	return compiled
+}
+
+// secretRe значения секретов, которые нельзя выводить в лог
+var secretRe = regexp.MustCompile(`("secret"\s*:\s*)"[^"]*"`)
+
 func logDebugJSON(ctx context.Context, rawJSON string) {
 	var compacted bytes.Buffer
 
 	if err := json.Compact(&compacted, []byte(rawJSON)); err != nil {
-		logger.Debug(ctx, "invalid JSON, logging raw:", rawJSON)
+		logger.Debug(ctx, "invalid JSON, logging raw:", secretRe.ReplaceAllString(rawJSON, `$1"***"`))
 		return
 	}
 
-	logger.Debug(ctx, "raw limits from keeper:", compacted.String())
+	logger.Debug(ctx, "raw limits from keeper:", secretRe.ReplaceAllString(compacted.String(), `$1"***"`))
 }
@@ -7,18 +7,17 @@ import (
 	"testing"
 	"time"
 
-	"github.com/wbpaygate/traefik-ratelimit/internal/limiter"
 	"github.com/wbpaygate/traefik-ratelimit/internal/pattern"
 )
 
 // пспомогательная функция для поиска паттерна в sync.Map
-var findPattern = func(m *sync.Map, path string) (*limiter.Limiter, bool) {
-	var foundLimiter *limiter.Limiter
+var findPattern = func(m *sync.Map, path string) (*LimitImpl, bool) {
+	var foundLimiter *LimitImpl
 	var found bool
 
 	m.Range(func(key, value any) bool {
 		if rule, ok := key.(RuleImpl); ok && rule.URLPathPattern.Match([]byte(path)) {
-			foundLimiter = value.(*limiter.Limiter)
+			foundLimiter = value.(*LimitImpl)
 			found = true
 
 			return false
@@ -30,6 +29,17 @@ var findPattern = func(m *sync.Map, path string) (*limiter.Limiter, bool) {
 	return foundLimiter, found
 }
 
+func mustPattern(t *testing.T, s string) *pattern.Pattern {
+	t.Helper()
+
+	p, err := pattern.NewPattern(s)
+	if err != nil {
+		t.Fatalf("cannot create pattern %q: %v", s, err)
+	}
+
+	return p
+}
+
 func TestRateLimiter_hotReloadLimits(t *testing.T) {
 	rl := &RateLimiter{
 		rules: atomic.Value{},
@@ -105,9 +115,9 @@ func TestRateLimiter_hotReloadLimits(t *testing.T) {
 	})
 
 	t.Run("no leaks comprehensive check", func(t *testing.T) {
-		oldLimiter1 := limiter.NewLimiter(5)
-		oldLimiter2 := limiter.NewLimiter(10)
-		oldLimiter3 := limiter.NewLimiter(15)
+		oldLimiter1 := newLimitImpl(Limit{Limit: 5}, nil)
+		oldLimiter2 := newLimitImpl(Limit{Limit: 10}, nil)
+		oldLimiter3 := newLimitImpl(Limit{Limit: 15}, nil)
 
 		rules, okTypeAssert := rl.rules.Load().(*sync.Map)
 		if !okTypeAssert {
@@ -115,15 +125,15 @@ func TestRateLimiter_hotReloadLimits(t *testing.T) {
 		}
 
 		rules.Store(RuleImpl{
-			URLPathPattern: pattern.NewPattern("/path1"),
+			URLPathPattern: mustPattern(t, "/path1"),
 		}, oldLimiter1)
 
 		rules.Store(RuleImpl{
-			URLPathPattern: pattern.NewPattern("/path2"),
+			URLPathPattern: mustPattern(t, "/path2"),
 		}, oldLimiter2)
 
 		rules.Store(RuleImpl{
-			URLPathPattern: pattern.NewPattern("/path3"),
+			URLPathPattern: mustPattern(t, "/path3"),
 			Header:         &Header{key: "X-Test", val: "1"},
 		}, oldLimiter3)
 
@@ -0,0 +1,114 @@
+package traefik_ratelimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// statusWriter запоминает код ответа upstream для адаптивных лимитов и circuit breaker
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack нужен для websocket
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", w.ResponseWriter)
+	}
+
+	return h.Hijack()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+
+	return w.status
+}
+
+// observes сообщает, что лимиту нужны наблюдения за ответами upstream
+func (li *LimitImpl) observes() bool {
+	return li.adaptive != nil || li.breaker != nil
+}
+
+func (li *LimitImpl) observe(ctx context.Context, latency time.Duration, status int, now time.Time) {
+	if li.adaptive != nil {
+		li.adaptive.observe(latency, status, now)
+	}
+
+	if li.breaker != nil {
+		li.breaker.observe(ctx, status, now)
+	}
+}
+
+// breakerAllow проверяет circuit breaker лимита и всех его родителей
+func (li *LimitImpl) breakerAllow(ctx context.Context, now time.Time) (bool, time.Duration) {
+	for lim := li; lim != nil; lim = lim.parent {
+		if lim.breaker == nil {
+			continue
+		}
+
+		if ok, wait := lim.breaker.allow(ctx, now); !ok {
+			return false, wait
+		}
+	}
+
+	return true, 0
+}
+
+// observes сообщает, что хотя бы одному из пропустивших запрос лимитов нужен ответ upstream
+func (d *decision) observes() bool {
+	for _, db := range d.debited {
+		if db.limit.observes() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveObserved передаёт запрос в next и сообщает задержку и код ответа лимитам, пропустившим запрос
+func (d *decision) serveObserved(next http.Handler, rw http.ResponseWriter, req *http.Request) {
+	sw := &statusWriter{ResponseWriter: rw}
+
+	start := time.Now()
+	next.ServeHTTP(sw, req)
+	now := time.Now()
+
+	for _, db := range d.debited {
+		db.limit.observe(req.Context(), now.Sub(start), sw.statusCode(), now)
+	}
+}